@@ -0,0 +1,308 @@
+package apply
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/christianh814/gokp/cmd/utils"
+	"github.com/christianh814/gokp/cmd/waiter"
+	log "github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer/yaml"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+)
+
+// FieldManager owns the fields gokp applies
+var FieldManager = "gokp-bootstrapper"
+
+// CRDResource is the API resource of CustomResourceDefinitions
+var CRDResource = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+
+// RetryInterval is how long to wait before applying the objects that didn't apply again
+var RetryInterval = 5 * time.Second
+
+var decUnstructured = yaml.NewDecodingSerializer(unstructured.UnstructuredJSONScheme)
+
+// Result is how applying one object went
+type Result struct {
+	// Object is the kind, namespace and name of the object
+	Object string
+
+	// Attempts is how many times it was applied
+	Attempts int
+
+	// Err is why it wasn't applied, nil if it was
+	Err error
+}
+
+// Applier applies manifests to a cluster with server side apply. It keeps one REST mapper for all of them,
+// that's refreshed when new CRDs are established or a kind isn't found.
+type Applier struct {
+	client dynamic.Interface
+	mapper *restmapper.DeferredDiscoveryRESTMapper
+
+	// Wait is how long to keep retrying what didn't apply, and how to report on it
+	Wait waiter.Options
+}
+
+// New returns an Applier for the cluster
+func New(cfg *rest.Config, wait waiter.Options) (*Applier, error) {
+	dc, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Applier{
+		client: client,
+		mapper: restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(dc)),
+		Wait:   wait,
+	}, nil
+}
+
+// File applies the manifests in the YAML file
+func (a *Applier) File(ctx context.Context, file string, description string) ([]Result, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return a.Stream(ctx, f, description)
+}
+
+// Stream applies the manifests in the multi document YAML stream
+func (a *Applier) Stream(ctx context.Context, r io.Reader, description string) ([]Result, error) {
+	objs, err := Decode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.Objects(ctx, objs, description)
+}
+
+// Objects applies the objects. Namespaces and CRDs go first, and the rest once the CRDs are established,
+// in the order kubectl would. What the API server doesn't take yet, like custom resources whose webhook
+// isn't up, is applied again until it's taken or the wait is over.
+func (a *Applier) Objects(ctx context.Context, objs []*unstructured.Unstructured, description string) ([]Result, error) {
+	objs = sortObjects(objs)
+	results := make([]Result, len(objs))
+	for i, obj := range objs {
+		results[i].Object = objectName(obj)
+	}
+
+	// Namespaces and CRDs first, everything else may need them
+	first := 0
+	for first < len(objs) && isFoundation(objs[first]) {
+		first++
+	}
+	pending := []int{}
+	crds := map[string]bool{}
+	for i := 0; i < first; i++ {
+		if a.applyResult(ctx, objs[i], &results[i]) {
+			pending = append(pending, i)
+		}
+		if objs[i].GetKind() == "CustomResourceDefinition" && results[i].Err == nil {
+			crds[objs[i].GetName()] = true
+		}
+	}
+	if len(crds) != 0 {
+		err := a.waitForCRDs(ctx, crds, description)
+		if err != nil {
+			return results, err
+		}
+		a.mapper.Reset()
+	}
+
+	for i := first; i < len(objs); i++ {
+		if a.applyResult(ctx, objs[i], &results[i]) {
+			pending = append(pending, i)
+		}
+	}
+
+	// Apply what didn't go in until it does
+	if len(pending) != 0 {
+		err := waiter.Poll(ctx, RetryInterval, description, func(ctx context.Context) (bool, string, error) {
+			retry := []int{}
+			for _, i := range pending {
+				if a.applyResult(ctx, objs[i], &results[i]) {
+					retry = append(retry, i)
+				}
+			}
+			pending = retry
+			if len(pending) == 0 {
+				return true, "", nil
+			}
+
+			return false, strconv.Itoa(len(pending)) + " of " + strconv.Itoa(len(objs)) + " not applied yet, " + results[pending[0]].Object + ": " + results[pending[0]].Err.Error(), nil
+		}, a.Wait)
+		if err != nil {
+			return results, err
+		}
+	}
+
+	return results, Failed(results)
+}
+
+// Failed returns an error naming the objects that weren't applied, nil if all of them were
+func Failed(results []Result) error {
+	failed := []Result{}
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+
+	msg := strconv.Itoa(len(failed)) + " of " + strconv.Itoa(len(results)) + " objects not applied"
+	for _, result := range failed {
+		msg += "\n  " + result.Object + ": " + result.Err.Error()
+	}
+
+	return errors.New(msg)
+}
+
+// applyResult applies the object into its result, and returns true if it's worth trying again
+func (a *Applier) applyResult(ctx context.Context, obj *unstructured.Unstructured, result *Result) bool {
+	result.Attempts++
+	result.Err = a.apply(ctx, obj)
+	if result.Err == nil {
+		log.Debug("Applied ", result.Object)
+		return false
+	}
+
+	return retryable(result.Err)
+}
+
+// apply applies the object with server side apply
+func (a *Applier) apply(ctx context.Context, obj *unstructured.Unstructured) error {
+	gvk := obj.GroupVersionKind()
+	mapping, err := a.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		// The kind may have been added since the mapper last looked
+		a.mapper.Reset()
+		mapping, err = a.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Namespaced objects without one go in default, like with kubectl. The object is the caller's, so it's a copy that gets it.
+	var dr dynamic.ResourceInterface
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		if obj.GetNamespace() == "" {
+			obj = obj.DeepCopy()
+			obj.SetNamespace(metav1.NamespaceDefault)
+		}
+		dr = a.client.Resource(mapping.Resource).Namespace(obj.GetNamespace())
+	} else {
+		dr = a.client.Resource(mapping.Resource)
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	force := true
+	_, err = dr.Patch(ctx, obj.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{
+		FieldManager: FieldManager,
+		Force:        &force,
+	})
+
+	return err
+}
+
+// waitForCRDs waits until the CRDs are established, so what uses them can be applied
+func (a *Applier) waitForCRDs(ctx context.Context, names map[string]bool, description string) error {
+	target := waiter.Target{
+		Resource:    CRDResource,
+		Description: "CRDs of the " + description,
+	}
+
+	return waiter.For(ctx, a.client, target, func(objects []*unstructured.Unstructured) (bool, string, error) {
+		crds := []*unstructured.Unstructured{}
+		for _, obj := range objects {
+			if names[obj.GetName()] {
+				crds = append(crds, obj)
+			}
+		}
+		if len(crds) < len(names) {
+			return false, strconv.Itoa(len(crds)) + " of " + strconv.Itoa(len(names)) + " created", nil
+		}
+
+		return waiter.ConditionTrue("Established")(crds)
+	}, a.Wait)
+}
+
+// retryable returns true if the error may go away on its own, like a kind that isn't served yet
+// or a webhook that isn't up
+func retryable(err error) bool {
+	return meta.IsNoMatchError(err) ||
+		apierrors.IsNotFound(err) ||
+		apierrors.IsInternalError(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsConflict(err)
+}
+
+// Decode reads the objects out of the multi document YAML stream. Documents without anything in them,
+// like those with only comments, are skipped, and Lists are expanded into their items.
+func Decode(r io.Reader) ([]*unstructured.Unstructured, error) {
+	docs, err := utils.SplitYamlDocuments(r)
+	if err != nil {
+		return nil, err
+	}
+
+	objs := []*unstructured.Unstructured{}
+	for i, doc := range docs {
+		obj := &unstructured.Unstructured{}
+		_, _, err = decUnstructured.Decode(doc, nil, obj)
+		if err != nil {
+			return nil, errors.New("document " + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+		if !obj.IsList() {
+			objs = append(objs, obj)
+			continue
+		}
+		err = obj.EachListItem(func(item runtime.Object) error {
+			objs = append(objs, item.(*unstructured.Unstructured))
+			return nil
+		})
+		if err != nil {
+			return nil, errors.New("document " + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+	}
+
+	return objs, nil
+}
+
+// objectName returns the kind, namespace and name of the object, like Deployment argocd/argocd-server
+func objectName(obj *unstructured.Unstructured) string {
+	if obj.GetNamespace() == "" {
+		return obj.GetKind() + " " + obj.GetName()
+	}
+
+	return obj.GetKind() + " " + obj.GetNamespace() + "/" + obj.GetName()
+}
@@ -0,0 +1,449 @@
+package apply
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/christianh814/gokp/cmd/waiter"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery/cached/memory"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/restmapper"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// widgets are the custom resources the test CRD adds
+var widgets = &metav1.APIResourceList{
+	GroupVersion: "example.com/v1",
+	APIResources: []metav1.APIResource{
+		{Name: "widgets", Kind: "Widget", Namespaced: true, Verbs: metav1.Verbs{"patch"}},
+	},
+}
+
+// fakeCluster is an API server that takes applies, failing them with the errors queued for an object
+type fakeCluster struct {
+	client    *dynamicfake.FakeDynamicClient
+	discovery *fakediscovery.FakeDiscovery
+
+	mu      sync.Mutex
+	applied []string
+	errs    map[string][]error
+}
+
+// newFakeCluster returns a cluster that serves the built in kinds, CRDs that are applied are created unestablished
+func newFakeCluster() *fakeCluster {
+	c := &fakeCluster{errs: map[string][]error{}}
+	c.discovery = &fakediscovery.FakeDiscovery{Fake: &k8stesting.Fake{Resources: []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "namespaces", Kind: "Namespace", Verbs: metav1.Verbs{"patch"}},
+				{Name: "configmaps", Kind: "ConfigMap", Namespaced: true, Verbs: metav1.Verbs{"patch"}},
+			},
+		},
+		{
+			GroupVersion: "apps/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "deployments", Kind: "Deployment", Namespaced: true, Verbs: metav1.Verbs{"patch"}},
+			},
+		},
+		{
+			GroupVersion: "apiextensions.k8s.io/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "customresourcedefinitions", Kind: "CustomResourceDefinition", Verbs: metav1.Verbs{"patch", "list", "watch"}},
+			},
+		},
+	}}}
+	c.client = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		CRDResource: "CustomResourceDefinitionList",
+	})
+	c.client.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		name := patch.GetResource().Resource + " " + patch.GetNamespace() + "/" + patch.GetName()
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if errs := c.errs[name]; len(errs) != 0 {
+			c.errs[name] = errs[1:]
+			return true, nil, errs[0]
+		}
+		c.applied = append(c.applied, name)
+
+		obj := &unstructured.Unstructured{}
+		err := obj.UnmarshalJSON(patch.GetPatch())
+		if err != nil {
+			return true, nil, err
+		}
+		if patch.GetResource() == CRDResource {
+			err = c.client.Tracker().Create(CRDResource, obj, "")
+		}
+
+		return true, obj, err
+	})
+
+	return c
+}
+
+// applier returns an Applier for the cluster
+func (c *fakeCluster) applier(wait waiter.Options) *Applier {
+	return &Applier{
+		client: c.client,
+		mapper: restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(c.discovery)),
+		Wait:   wait,
+	}
+}
+
+// fail queues errors for the applies of the object, named by resource, namespace and name
+func (c *fakeCluster) fail(name string, errs ...error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errs[name] = errs
+}
+
+func (c *fakeCluster) appliedObjects() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.applied...)
+}
+
+// establish adds the widgets to discovery and marks their CRD established
+func (c *fakeCluster) establish(t *testing.T) {
+	c.discovery.Resources = append(c.discovery.Resources, widgets)
+
+	crd, err := c.client.Tracker().Get(CRDResource, "", "widgets.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := crd.(*unstructured.Unstructured).DeepCopy()
+	err = unstructured.SetNestedSlice(obj.Object, []interface{}{
+		map[string]interface{}{"type": "Established", "status": "True"},
+	}, "status", "conditions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.client.Tracker().Update(CRDResource, obj, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestObject(apiVersion string, kind string, namespace string, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+	}}
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+
+	return obj
+}
+
+func setRetryInterval(t *testing.T, interval time.Duration) {
+	old := RetryInterval
+	RetryInterval = interval
+	t.Cleanup(func() {
+		RetryInterval = old
+	})
+}
+
+func TestObjectsWaitsForCRDs(t *testing.T) {
+	setRetryInterval(t, 10*time.Millisecond)
+	cluster := newFakeCluster()
+
+	// The CRD waits for its turn, the custom resource is first in the stream
+	established := make(chan struct{})
+	var once sync.Once
+	a := cluster.applier(waiter.Options{Timeout: 10 * time.Second, Progress: func(description string, status string) {
+		if description == "CRDs of the test manifests" && status == "0 of 1 Established" {
+			once.Do(func() { close(established) })
+		}
+	}})
+	objs := []*unstructured.Unstructured{
+		newTestObject("example.com/v1", "Widget", "gokp", "big"),
+		newTestObject("apps/v1", "Deployment", "gokp", "server"),
+		newTestObject("apiextensions.k8s.io/v1", "CustomResourceDefinition", "", "widgets.example.com"),
+		newTestObject("v1", "Namespace", "", "gokp"),
+	}
+	result := make(chan error, 1)
+	var results []Result
+	go func() {
+		var err error
+		results, err = a.Objects(context.Background(), objs, "test manifests")
+		result <- err
+	}()
+
+	select {
+	case <-established:
+	case err := <-result:
+		t.Fatalf("applied before the CRD was established: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("didn't wait for the CRD")
+	}
+
+	// Nothing else goes in while the CRD isn't established
+	time.Sleep(200 * time.Millisecond)
+	want := []string{"namespaces /gokp", "customresourcedefinitions /widgets.example.com"}
+	if got := cluster.appliedObjects(); strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Fatalf("got %v applied while waiting, want %v", got, want)
+	}
+
+	// The mapper finds the widgets once it's established, without retrying them
+	cluster.establish(t)
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("didn't apply once the CRD was established")
+	}
+	want = append(want, "deployments gokp/server", "widgets gokp/big")
+	if got := cluster.appliedObjects(); strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got %v applied, want %v", got, want)
+	}
+	for _, r := range results {
+		if r.Attempts != 1 || r.Err != nil {
+			t.Errorf("%s: got %d attempts and error %v", r.Object, r.Attempts, r.Err)
+		}
+	}
+}
+
+func TestObjectsResetsMapperOnNoMatch(t *testing.T) {
+	setRetryInterval(t, 10*time.Millisecond)
+	cluster := newFakeCluster()
+	a := cluster.applier(waiter.Options{Timeout: 2 * time.Second})
+
+	// The mapper has looked before the widgets were served
+	_, err := a.Objects(context.Background(), []*unstructured.Unstructured{newTestObject("v1", "ConfigMap", "gokp", "settings")}, "test manifests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster.discovery.Resources = append(cluster.discovery.Resources, widgets)
+
+	results, err := a.Objects(context.Background(), []*unstructured.Unstructured{newTestObject("example.com/v1", "Widget", "gokp", "big")}, "test manifests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Attempts != 1 {
+		t.Errorf("got %d attempts, want the widget applied the first time", results[0].Attempts)
+	}
+}
+
+func TestObjectsRetries(t *testing.T) {
+	setRetryInterval(t, 10*time.Millisecond)
+	cluster := newFakeCluster()
+	a := cluster.applier(waiter.Options{Timeout: 10 * time.Second})
+
+	gr := schema.GroupResource{Resource: "configmaps"}
+	cluster.fail("configmaps gokp/webhooked", apierrors.NewInternalError(errors.New("webhook not up")), apierrors.NewServiceUnavailable("starting"))
+	cluster.fail("configmaps gokp/invalid", apierrors.NewInvalid(schema.GroupKind{Kind: "ConfigMap"}, "invalid", nil))
+	cluster.fail("configmaps gokp/forbidden", apierrors.NewForbidden(gr, "forbidden", errors.New("no")))
+
+	objs := []*unstructured.Unstructured{
+		newTestObject("v1", "ConfigMap", "gokp", "webhooked"),
+		newTestObject("v1", "ConfigMap", "gokp", "invalid"),
+		newTestObject("v1", "ConfigMap", "gokp", "settings"),
+		newTestObject("v1", "ConfigMap", "gokp", "forbidden"),
+	}
+	results, err := a.Objects(context.Background(), objs, "test manifests")
+	if err == nil {
+		t.Fatal("didn't fail")
+	}
+
+	// What can't go in isn't tried again, and the error names only it
+	attempts := map[string]int{
+		"ConfigMap gokp/webhooked": 3,
+		"ConfigMap gokp/invalid":   1,
+		"ConfigMap gokp/settings":  1,
+		"ConfigMap gokp/forbidden": 1,
+	}
+	for _, r := range results {
+		if r.Attempts != attempts[r.Object] {
+			t.Errorf("%s: got %d attempts, want %d", r.Object, r.Attempts, attempts[r.Object])
+		}
+	}
+	if !strings.HasPrefix(err.Error(), "2 of 4 objects not applied\n") {
+		t.Errorf("got %q", err)
+	}
+	for name, failed := range map[string]bool{
+		"ConfigMap gokp/webhooked": false,
+		"ConfigMap gokp/invalid":   true,
+		"ConfigMap gokp/settings":  false,
+		"ConfigMap gokp/forbidden": true,
+	} {
+		if strings.Contains(err.Error(), "\n  "+name+": ") != failed {
+			t.Errorf("%s: got %q", name, err)
+		}
+	}
+}
+
+func TestObjectsRetryTimeout(t *testing.T) {
+	setRetryInterval(t, 10*time.Millisecond)
+	cluster := newFakeCluster()
+	a := cluster.applier(waiter.Options{Timeout: 200 * time.Millisecond})
+
+	// The widgets are never served
+	results, err := a.Objects(context.Background(), []*unstructured.Unstructured{newTestObject("example.com/v1", "Widget", "gokp", "big")}, "test manifests")
+	if err == nil || !strings.Contains(err.Error(), "test manifests") {
+		t.Fatalf("got %v", err)
+	}
+	if results[0].Attempts < 2 || !meta.IsNoMatchError(results[0].Err) {
+		t.Errorf("got %d attempts and error %v", results[0].Attempts, results[0].Err)
+	}
+}
+
+func TestObjectsDefaultNamespace(t *testing.T) {
+	cluster := newFakeCluster()
+	a := cluster.applier(waiter.Options{Timeout: 2 * time.Second})
+
+	objs := []*unstructured.Unstructured{
+		newTestObject("v1", "ConfigMap", "", "settings"),
+		newTestObject("v1", "Namespace", "", "gokp"),
+	}
+	_, err := a.Objects(context.Background(), objs, "test manifests")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// It goes in default, without changing what the caller gave
+	want := []string{"namespaces /gokp", "configmaps default/settings"}
+	if got := cluster.appliedObjects(); strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got %v applied, want %v", got, want)
+	}
+	if objs[0].GetNamespace() != "" || objs[1].GetNamespace() != "" {
+		t.Errorf("got namespaces %q and %q, want them unchanged", objs[0].GetNamespace(), objs[1].GetNamespace())
+	}
+}
+
+func TestSortObjects(t *testing.T) {
+	objs := []*unstructured.Unstructured{
+		newTestObject("example.com/v1", "Widget", "gokp", "big"),
+		newTestObject("apps/v1", "Deployment", "gokp", "server"),
+		newTestObject("v1", "ConfigMap", "gokp", "b"),
+		newTestObject("admissionregistration.k8s.io/v1", "ValidatingWebhookConfiguration", "", "widgets"),
+		newTestObject("apiextensions.k8s.io/v1", "CustomResourceDefinition", "", "widgets.example.com"),
+		newTestObject("v1", "ConfigMap", "gokp", "a"),
+		newTestObject("example.com/v1", "Gadget", "gokp", "small"),
+		newTestObject("v1", "Namespace", "", "gokp"),
+	}
+	sorted := sortObjects(objs)
+
+	// Kinds in the order kubectl uses, unknown kinds last, and the stream order within a kind
+	got := []string{}
+	for _, obj := range sorted {
+		got = append(got, objectName(obj))
+	}
+	want := []string{
+		"Namespace gokp",
+		"CustomResourceDefinition widgets.example.com",
+		"ConfigMap gokp/b",
+		"ConfigMap gokp/a",
+		"Deployment gokp/server",
+		"ValidatingWebhookConfiguration widgets",
+		"Widget gokp/big",
+		"Gadget gokp/small",
+	}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if objectName(objs[0]) != "Widget gokp/big" {
+		t.Error("the objects given were sorted")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	gr := schema.GroupResource{Resource: "widgets"}
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&meta.NoKindMatchError{GroupKind: schema.GroupKind{Group: "example.com", Kind: "Widget"}}, true},
+		{apierrors.NewNotFound(gr, "big"), true},
+		{apierrors.NewInternalError(errors.New("webhook not up")), true},
+		{apierrors.NewServiceUnavailable("starting"), true},
+		{apierrors.NewServerTimeout(gr, "patch", 1), true},
+		{apierrors.NewTimeoutError("slow", 1), true},
+		{apierrors.NewTooManyRequests("busy", 1), true},
+		{apierrors.NewConflict(gr, "big", errors.New("changed")), true},
+		{apierrors.NewBadRequest("bad"), false},
+		{apierrors.NewInvalid(schema.GroupKind{Kind: "Widget"}, "big", nil), false},
+		{apierrors.NewForbidden(gr, "big", errors.New("no")), false},
+		{apierrors.NewUnauthorized("who"), false},
+		{errors.New("connection refused"), false},
+	} {
+		if got := retryable(tc.err); got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	objs, err := Decode(strings.NewReader(`# the namespace
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: gokp
+---
+# nothing here
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: a
+    namespace: gokp
+- apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: server
+    namespace: gokp
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+  namespace: gokp
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	for _, obj := range objs {
+		got = append(got, obj.GetAPIVersion()+" "+objectName(obj))
+	}
+	want := []string{"v1 Namespace gokp", "v1 ConfigMap gokp/a", "apps/v1 Deployment gokp/server", "v1 ConfigMap gokp/b"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{"no kind", "apiVersion: v1\nkind: Namespace\n---\napiVersion: v1\nmetadata:\n  name: a\n", "document 2: "},
+		{"invalid yaml", "kind: [\n", "document 1: "},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Decode(strings.NewReader(tc.yaml))
+			if err == nil || !strings.HasPrefix(err.Error(), tc.want) {
+				t.Fatalf("got %v, want an error starting with %q", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package apply
+
+import (
+	"sort"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// kindOrder is the order kinds are applied in, so what's used is there before what uses it.
+// Kinds that aren't in it, like custom resources, go last.
+var kindOrder = []string{
+	"Namespace",
+	"CustomResourceDefinition",
+	"NetworkPolicy",
+	"ResourceQuota",
+	"LimitRange",
+	"PodSecurityPolicy",
+	"PodDisruptionBudget",
+	"PriorityClass",
+	"ServiceAccount",
+	"Secret",
+	"ConfigMap",
+	"StorageClass",
+	"PersistentVolume",
+	"PersistentVolumeClaim",
+	"ClusterRole",
+	"ClusterRoleBinding",
+	"Role",
+	"RoleBinding",
+	"Service",
+	"DaemonSet",
+	"Pod",
+	"ReplicationController",
+	"ReplicaSet",
+	"Deployment",
+	"HorizontalPodAutoscaler",
+	"StatefulSet",
+	"Job",
+	"CronJob",
+	"IngressClass",
+	"Ingress",
+	"APIService",
+	"MutatingWebhookConfiguration",
+	"ValidatingWebhookConfiguration",
+}
+
+// isFoundation returns true for what everything else may need, Namespaces and CRDs
+func isFoundation(obj *unstructured.Unstructured) bool {
+	return obj.GetKind() == "Namespace" || obj.GetKind() == "CustomResourceDefinition"
+}
+
+// sortObjects returns the objects in the order they're applied in, keeping the order
+// of the stream for objects of the same kind
+func sortObjects(objs []*unstructured.Unstructured) []*unstructured.Unstructured {
+	rank := map[string]int{}
+	for i, kind := range kindOrder {
+		rank[kind] = i
+	}
+	rankOf := func(obj *unstructured.Unstructured) int {
+		if r, ok := rank[obj.GetKind()]; ok {
+			return r
+		}
+		return len(kindOrder)
+	}
+
+	sorted := append([]*unstructured.Unstructured{}, objs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return rankOf(sorted[i]) < rankOf(sorted[j])
+	})
+
+	return sorted
+}
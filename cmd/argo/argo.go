@@ -2,74 +2,53 @@ package argo
 
 import (
 	"context"
-	"errors"
+	"io/ioutil"
 	"os"
-	"path/filepath"
-	"time"
 
 	"github.com/christianh814/gokp/cmd/capi"
+	"github.com/christianh814/gokp/cmd/templates"
 	"github.com/christianh814/gokp/cmd/utils"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 // BootstrapArgoCD installs ArgoCD on a given cluster with the provided Kustomize-ed dir
-func BootstrapArgoCD(clustername *string, workdir string, capicfg string) (bool, error) {
+func BootstrapArgoCD(ctx context.Context, clustername *string, workdir string, capicfg string, repoPath string) (bool, error) {
 	// Set the repoDir path where things should be cloned.
 	// check if it exists
 	repoDir := workdir + "/" + *clustername
+	if repoPath != "" {
+		repoDir = repoDir + "/" + repoPath
+	}
 	overlay := repoDir + "/cluster/bootstrap/overlays/default"
 	if _, err := os.Stat(repoDir); os.IsNotExist(err) {
 		return false, err
 	}
 
 	// generate the ArgoCD Install YAML
-	argocdyaml := workdir + "/" + "argocd-install.yaml"
-	_, err := utils.RunKustomize(overlay, argocdyaml)
+	argocdyaml, err := utils.KustomizeBuild(overlay)
 	if err != nil {
 		return false, err
 	}
 
-	// Let's take that YAML and apply it to the created cluster
-	// First, let's split this up into smaller files
-	err = utils.SplitYamls(workdir+"/"+"argocd-install-output", argocdyaml, "---")
+	// Set up a connection to the K8S cluster and apply these bad boys
+	capiInstallConfig, err := clientcmd.BuildConfigFromFlags("", capicfg)
 	if err != nil {
 		return false, err
 	}
 
-	//get a list of those files
-	argoInstallYamls, err := filepath.Glob(workdir + "/" + "argocd-install-output" + "/" + "*.yaml")
+	// Apply them, the CRDs go in before what uses them
+	err = capi.ApplyManifests(ctx, capiInstallConfig, argocdyaml, "Argo CD manifests", capi.ApplyTimeout)
 	if err != nil {
 		return false, err
 	}
 
-	// Set up a connection to the K8S cluster and apply these bad boys
-	capiInstallConfig, err := clientcmd.BuildConfigFromFlags("", capicfg)
-	if err != nil {
-		return false, err
+	// The token or GitHub App key isn't in the repo, so it's applied from the work dir
+	credentials, err := ioutil.ReadFile(templates.GitCredentialsFile(workdir))
+	if err == nil {
+		err = capi.ApplyManifests(ctx, capiInstallConfig, credentials, "git credentials", capi.ApplyTimeout)
 	}
-
-	// Loop until all are applied. Set a counter so we don't loop endlessly. Keep track of errors
-	counter := 0
-	for runs := 15; counter <= runs; counter++ {
-		// break if we've tried 15 times (aka 30 seconds)
-		if counter > runs {
-			return false, errors.New("failed to apply argo manifests")
-		}
-		// set the error count
-		errcount := 0
-		// loop through the YAMLS counting the errors
-		for _, argoInstallYaml := range argoInstallYamls {
-			err = capi.DoSSA(context.TODO(), capiInstallConfig, argoInstallYaml)
-			if err != nil {
-				errcount++
-			}
-			// sleep and wait to apply the next one
-			time.Sleep(2 * time.Second)
-		}
-		// If no errors were found, break out of the loop
-		if errcount == 0 {
-			break
-		}
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
 	}
 
 	return true, nil
@@ -0,0 +1,140 @@
+package capi
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	cfn "github.com/aws/aws-sdk-go/service/cloudformation"
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/cluster-api-provider-aws/cmd/clusterawsadm/cloudformation/bootstrap"
+	cloudformation "sigs.k8s.io/cluster-api-provider-aws/cmd/clusterawsadm/cloudformation/service"
+	creds "sigs.k8s.io/cluster-api-provider-aws/cmd/clusterawsadm/credentials"
+	capiclient "sigs.k8s.io/cluster-api/cmd/clusterctl/client"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// AWS creates clusters on AWS with CAPA
+type AWS struct {
+	// Credentials are the AWS_ variables clusterctl creates the cluster with
+	Credentials map[string]string
+
+	// SkipCloudFormation doesn't create the CloudFormation stack CAPA needs, for accounts that have it
+	SkipCloudFormation bool
+}
+
+// Name returns aws
+func (p *AWS) Name() string {
+	return "aws"
+}
+
+// DisplayName returns AWS
+func (p *AWS) DisplayName() string {
+	return "AWS"
+}
+
+// Controller returns the CAPA controller
+func (p *AWS) Controller() (string, string) {
+	return "capa-system", "capa-controller-manager"
+}
+
+// Flavor returns the default flavor
+func (p *AWS) Flavor() string {
+	return ""
+}
+
+// Variables returns the AWS credentials and settings
+func (p *AWS) Variables() map[string]string {
+	return p.Credentials
+}
+
+// CNIURL returns the Calico YAML
+func (p *AWS) CNIURL() string {
+	return CNIurl
+}
+
+// SelfManaged returns true, AWS clusters manage themselves
+func (p *AWS) SelfManaged() bool {
+	return true
+}
+
+// SetupCredentials bootstraps the CloudFormation stack and encodes the credentials for CAPA. When moving,
+// it uses the credentials CAPA already has instead.
+func (p *AWS) SetupCredentials(ctx context.Context, clusterName string, mgmt *rest.Config, from *rest.Config) error {
+	if from != nil {
+		// Get the secret and base64 encode it (you'd think it would come encoded but it doesn't)
+		clientset, err := kubernetes.NewForConfig(from)
+		if err != nil {
+			return err
+		}
+		namespace, _ := p.Controller()
+		secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, "capa-manager-bootstrap-credentials", metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		os.Setenv("AWS_B64ENCODED_CREDENTIALS", base64.StdEncoding.EncodeToString(secret.Data["credentials"]))
+
+		return nil
+	}
+
+	// Boostrapping Cloud Formation stack on AWS only if needed
+	if !p.SkipCloudFormation {
+		log.Info("Boostrapping Cloud Formation stack on AWS")
+		template := bootstrap.NewTemplate()
+		sess, err := session.NewSession()
+		if err != nil {
+			return err
+		}
+
+		cfnSvc := cloudformation.NewService(cfn.New(sess))
+
+		// tag things based on the clustername
+		tags := map[string]string{
+			"gokp-cluster": clusterName,
+		}
+		err = cfnSvc.ReconcileBootstrapStack(template.Spec.StackName, *template.RenderCloudFormation(), tags)
+		if err != nil {
+			return err
+		}
+	} else {
+		log.Info("Skipping CloudFormation Creation")
+	}
+
+	//Encode credentials
+	awsCreds, err := creds.NewAWSCredentialFromDefaultChain(p.Credentials["AWS_REGION"])
+	if err != nil {
+		return err
+	}
+
+	b64creds, err := awsCreds.RenderBase64EncodedAWSDefaultProfile()
+	if err != nil {
+		return err
+	}
+	os.Setenv("AWS_B64ENCODED_CREDENTIALS", b64creds)
+
+	return nil
+}
+
+// Prepare does nothing, CAPA has what it needs
+func (p *AWS) Prepare(ctx context.Context, mgmt *rest.Config) error {
+	return nil
+}
+
+// Kubeconfig returns the kubeconfig from clusterctl
+func (p *AWS) Kubeconfig(ctx context.Context, c capiclient.Client, mgmtKubeconfig string, clusterName string) (string, error) {
+	return workloadKubeconfig(c, mgmtKubeconfig, clusterName)
+}
+
+// PreMove does nothing, the credentials are set up
+func (p *AWS) PreMove(ctx context.Context, src *rest.Config, dest *rest.Config) error {
+	return nil
+}
+
+// Cleanup unexports the encoded credentials
+func (p *AWS) Cleanup() {
+	os.Unsetenv("AWS_B64ENCODED_CREDENTIALS")
+}
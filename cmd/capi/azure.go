@@ -0,0 +1,214 @@
+package capi
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	capiclient "sigs.k8s.io/cluster-api/cmd/clusterctl/client"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	corev1 "k8s.io/api/core/v1"
+	infrav1 "sigs.k8s.io/cluster-api-provider-azure/api/v1beta1"
+)
+
+// azureIdentityResource is the API resource of the identity CAPZ creates clusters with
+var azureIdentityResource = schema.GroupVersionResource{
+	Group:    "infrastructure.cluster.x-k8s.io",
+	Version:  "v1beta1",
+	Resource: "azureclusteridentities",
+}
+
+// Azure creates clusters on Azure with CAPZ
+type Azure struct {
+	// Credentials are the AZURE_ variables clusterctl creates the cluster with
+	Credentials map[string]string
+}
+
+// Name returns azure
+func (p *Azure) Name() string {
+	return "azure"
+}
+
+// DisplayName returns Azure
+func (p *Azure) DisplayName() string {
+	return "Azure"
+}
+
+// Controller returns the CAPZ controller
+func (p *Azure) Controller() (string, string) {
+	return "capz-system", "capz-controller-manager"
+}
+
+// Flavor returns the default flavor
+func (p *Azure) Flavor() string {
+	return ""
+}
+
+// Variables returns the Azure credentials and settings, and the identity the cluster is created with
+func (p *Azure) Variables() map[string]string {
+	vars := map[string]string{
+		"AZURE_CLUSTER_IDENTITY_SECRET_NAME":      "cluster-identity-secret",
+		"AZURE_CLUSTER_IDENTITY_SECRET_NAMESPACE": "default",
+		"CLUSTER_IDENTITY_NAME":                   "cluster-identity",
+	}
+	for k, v := range p.Credentials {
+		vars[k] = v
+	}
+
+	return vars
+}
+
+// CNIURL returns the Calico YAML made for Azure
+func (p *Azure) CNIURL() string {
+	return azureCNIurl
+}
+
+// SelfManaged returns true, Azure clusters manage themselves
+func (p *Azure) SelfManaged() bool {
+	return true
+}
+
+// SetupCredentials creates the secret with the service principal. When moving, PreMove copies it instead.
+func (p *Azure) SetupCredentials(ctx context.Context, clusterName string, mgmt *rest.Config, from *rest.Config) error {
+	if from != nil {
+		return nil
+	}
+
+	clientset, err := kubernetes.NewForConfig(mgmt)
+	if err != nil {
+		return err
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "cluster-identity-secret",
+			Namespace: "default",
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{"clientSecret": []byte(p.Credentials["AZURE_CLIENT_SECRET"])},
+	}
+
+	_, err = clientset.CoreV1().Secrets("default").Create(ctx, secret, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	log.Info("Created service principal secret")
+
+	return nil
+}
+
+// Prepare creates the AzureClusterIdentity of the service principal
+func (p *Azure) Prepare(ctx context.Context, mgmt *rest.Config) error {
+	log.Info("Creating azureidentity")
+	identity := &infrav1.AzureClusterIdentity{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "AzureClusterIdentity",
+			APIVersion: "infrastructure.cluster.x-k8s.io/v1beta1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "cluster-identity",
+		},
+		Spec: infrav1.AzureClusterIdentitySpec{
+			Type:         infrav1.ServicePrincipal,
+			ClientID:     p.Credentials["AZURE_CLIENT_ID"],
+			ClientSecret: corev1.SecretReference{Name: "cluster-identity-secret"},
+			TenantID:     p.Credentials["AZURE_TENANT_ID"],
+			AllowedNamespaces: &infrav1.AllowedNamespaces{
+				NamespaceList: []string{"default"},
+			},
+		},
+	}
+
+	identityObj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(identity)
+	if err != nil {
+		return err
+	}
+
+	dc, err := dynamic.NewForConfig(mgmt)
+	if err != nil {
+		return err
+	}
+	_, err = dc.Resource(azureIdentityResource).Namespace("default").Create(ctx, &unstructured.Unstructured{Object: identityObj}, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	log.Info("Created azureidentity")
+
+	return nil
+}
+
+// Kubeconfig returns the kubeconfig from clusterctl
+func (p *Azure) Kubeconfig(ctx context.Context, c capiclient.Client, mgmtKubeconfig string, clusterName string) (string, error) {
+	return workloadKubeconfig(c, mgmtKubeconfig, clusterName)
+}
+
+// PreMove copies the service principal secret and identity, CAPZ doesn't move them
+func (p *Azure) PreMove(ctx context.Context, src *rest.Config, dest *rest.Config) error {
+	_, err := MoveAzureSecrets(ctx, src, dest)
+
+	return err
+}
+
+// Cleanup does nothing, the variables are all there is
+func (p *Azure) Cleanup() {}
+
+// MoveAzureSecrets copies the service principal secret and the AzureClusterIdentity from src to dest
+func MoveAzureSecrets(ctx context.Context, src *rest.Config, dest *rest.Config) (bool, error) {
+	// Create clients
+	log.Info("creating clients for moving azure secrets")
+	srcclientset, err := kubernetes.NewForConfig(src)
+	if err != nil {
+		return false, err
+	}
+	destclientset, err := kubernetes.NewForConfig(dest)
+	if err != nil {
+		return false, err
+	}
+
+	// Get and move secret
+	log.Info("moving secret")
+	secret, err := srcclientset.CoreV1().Secrets("default").Get(ctx, "cluster-identity-secret", metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	log.Info("got secret")
+	secret.ObjectMeta.ResourceVersion = ""
+
+	_, err = destclientset.CoreV1().Secrets("default").Create(ctx, secret, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+	log.Info("copied secret")
+
+	// Get and move AzureIdentity
+	log.Info("moving azure identity")
+	dynamicsrc, err := dynamic.NewForConfig(src)
+	if err != nil {
+		return false, err
+	}
+	dynamicdest, err := dynamic.NewForConfig(dest)
+	if err != nil {
+		return false, err
+	}
+
+	azureIdentity, err := dynamicsrc.Resource(azureIdentityResource).Namespace("default").Get(ctx, "cluster-identity", metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	azureIdentity.SetResourceVersion("")
+
+	_, err = dynamicdest.Resource(azureIdentityResource).Namespace("default").Create(ctx, azureIdentity, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+	log.Info("copied azure identity")
+	return true, nil
+}
@@ -0,0 +1,89 @@
+package capi
+
+import (
+	"context"
+	osruntime "runtime"
+	"strings"
+
+	"github.com/christianh814/gokp/cmd/kind"
+	"github.com/rwtodd/Go.Sed/sed"
+	capiclient "sigs.k8s.io/cluster-api/cmd/clusterctl/client"
+
+	"k8s.io/client-go/rest"
+)
+
+// Docker creates local development clusters on docker with CAPD
+type Docker struct{}
+
+// Name returns docker
+func (p *Docker) Name() string {
+	return "docker"
+}
+
+// DisplayName returns Docker
+func (p *Docker) DisplayName() string {
+	return "Docker"
+}
+
+// Controller returns the CAPD controller
+func (p *Docker) Controller() (string, string) {
+	return "capd-system", "capd-controller-manager"
+}
+
+// Flavor returns development, the CAPD template
+func (p *Docker) Flavor() string {
+	return "development"
+}
+
+// Variables turns on the cluster topology the development template needs
+func (p *Docker) Variables() map[string]string {
+	return map[string]string{"CLUSTER_TOPOLOGY": "true"}
+}
+
+// CNIURL returns the Calico YAML
+func (p *Docker) CNIURL() string {
+	return CNIurl
+}
+
+// SelfManaged returns false, development clusters stay managed by the bootstrap cluster until it's deleted
+func (p *Docker) SelfManaged() bool {
+	return false
+}
+
+// SetupCredentials does nothing, docker doesn't need any
+func (p *Docker) SetupCredentials(ctx context.Context, clusterName string, mgmt *rest.Config, from *rest.Config) error {
+	return nil
+}
+
+// Prepare does nothing, CAPD has what it needs
+func (p *Docker) Prepare(ctx context.Context, mgmt *rest.Config) error {
+	return nil
+}
+
+// Kubeconfig returns the kubeconfig from clusterctl, or from kind on a mac where it has to be fixed up
+func (p *Docker) Kubeconfig(ctx context.Context, c capiclient.Client, mgmtKubeconfig string, clusterName string) (string, error) {
+	if osruntime.GOOS != "darwin" {
+		return workloadKubeconfig(c, mgmtKubeconfig, clusterName)
+	}
+
+	// HACK: If we are on a mac we have to modify the file first
+	dirtyKK, err := kind.GetKindKubeconfig(clusterName, false)
+	if err != nil {
+		return "", err
+	}
+	// Let's try this sed thing
+	engine, err := sed.New(strings.NewReader(`s/0.0.0.0/127.0.0.1/g s/certificate-authority-data:.*/insecure-skip-tls-verify: true/g`))
+	if err != nil {
+		return "", err
+	}
+
+	return engine.RunString(dirtyKK)
+}
+
+// PreMove does nothing, development clusters aren't moved
+func (p *Docker) PreMove(ctx context.Context, src *rest.Config, dest *rest.Config) error {
+	return nil
+}
+
+// Cleanup does nothing
+func (p *Docker) Cleanup() {}
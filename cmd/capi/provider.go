@@ -0,0 +1,275 @@
+package capi
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+
+	"github.com/christianh814/gokp/cmd/utils"
+	log "github.com/sirupsen/logrus"
+	capiclient "sigs.k8s.io/cluster-api/cmd/clusterctl/client"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// InfraProvider is an infrastructure CAPI creates clusters on. CreateCluster and MoveMgmtCluster run
+// the same steps for all of them, and call into the provider for what's different.
+type InfraProvider interface {
+	// Name of the infrastructure provider for clusterctl, like aws
+	Name() string
+
+	// DisplayName of the provider for people, like AWS
+	DisplayName() string
+
+	// Controller returns the namespace and name of the controller deployment to wait for once it's initialized
+	Controller() (string, string)
+
+	// Flavor of the cluster template, empty for the default one
+	Flavor() string
+
+	// Variables are exported for clusterctl while the cluster is created, and unexported after
+	Variables() map[string]string
+
+	// CNIURL is where the CNI YAML of the cluster is downloaded from
+	CNIURL() string
+
+	// SelfManaged is true if the CAPI objects are moved into the cluster once it's created
+	SelfManaged() bool
+
+	// SetupCredentials makes the credentials available before the provider is initialized on the management
+	// cluster. When moving, from is the cluster the objects come from, otherwise it's nil.
+	SetupCredentials(ctx context.Context, clusterName string, mgmt *rest.Config, from *rest.Config) error
+
+	// Prepare runs once the controller is up on the management cluster, before the cluster is applied
+	Prepare(ctx context.Context, mgmt *rest.Config) error
+
+	// Kubeconfig returns the kubeconfig of the created cluster
+	Kubeconfig(ctx context.Context, c capiclient.Client, mgmtKubeconfig string, clusterName string) (string, error)
+
+	// PreMove runs once the provider is up on dest, before the objects are moved into it from src
+	PreMove(ctx context.Context, src *rest.Config, dest *rest.Config) error
+
+	// Cleanup removes what SetupCredentials set up for clusterctl
+	Cleanup()
+}
+
+// CreateCluster creates a Kubernetes cluster on the provider using CAPI, from the KIND instance
+func CreateCluster(ctx context.Context, p InfraProvider, kindkconfig string, clusterName string, capicfg string, createHaCluster bool) (bool, error) {
+	log.Info("Started creating " + p.DisplayName() + " cluster")
+
+	// Export the provider settings as env vars for clusterctl, and unexport them when we're done
+	for k, v := range p.Variables() {
+		os.Setenv(k, v)
+	}
+	defer func() {
+		for k := range p.Variables() {
+			os.Unsetenv(k)
+		}
+		p.Cleanup()
+	}()
+
+	clusterInstallConfig, err := clientcmd.BuildConfigFromFlags("", kindkconfig)
+	if err != nil {
+		return false, err
+	}
+
+	log.Info("Setting up credentials")
+	err = p.SetupCredentials(ctx, clusterName, clusterInstallConfig, nil)
+	if err != nil {
+		return false, err
+	}
+
+	// init the provider into the Kind instance
+	log.Info("Initializing " + p.DisplayName() + " provider")
+	c, err := capiclient.New("")
+	if err != nil {
+		return false, err
+	}
+
+	_, err = c.Init(capiclient.InitOptions{
+		Kubeconfig:              capiclient.Kubeconfig{Path: kindkconfig},
+		InfrastructureProviders: []string{p.Name()},
+		LogUsageInstructions:    false,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// Wait for the controller to roll out before using it
+	namespace, name := p.Controller()
+	err = waitForController(ctx, clusterInstallConfig, namespace, name)
+	if err != nil {
+		return false, err
+	}
+
+	err = p.Prepare(ctx, clusterInstallConfig)
+	if err != nil {
+		return false, err
+	}
+
+	//	Set up options to write out the install YAML
+	//	TODO: Make Kubernetes version an option
+	var cpMachineCount int64 = 1
+	var workerMachineCount int64 = 2
+	if createHaCluster {
+		// If HA was requested we create it
+		cpMachineCount = 3
+		workerMachineCount = 3
+	}
+	cto := capiclient.GetClusterTemplateOptions{
+		Kubeconfig:               capiclient.Kubeconfig{Path: kindkconfig},
+		ClusterName:              clusterName,
+		ControlPlaneMachineCount: &cpMachineCount,
+		WorkerMachineCount:       &workerMachineCount,
+		KubernetesVersion:        KubernetesVersion,
+		TargetNamespace:          "default",
+	}
+	if p.Flavor() != "" {
+		cto.ProviderRepositorySource = &capiclient.ProviderRepositorySourceOptions{Flavor: p.Flavor()}
+	}
+
+	//	Load up the config with the options
+	installYaml, err := c.GetClusterTemplate(cto)
+	if err != nil {
+		return false, err
+	}
+
+	// Get the YAML of the cluster
+	installClusterYaml, err := installYaml.Yaml()
+	if err != nil {
+		return false, err
+	}
+
+	// Apply the YAML to the KIND instance so that the cluster gets installed
+	log.Info("Preflight complete, installing cluster")
+	err = ApplyManifests(ctx, clusterInstallConfig, installClusterYaml, "cluster config", ApplyTimeout)
+	if err != nil {
+		return false, err
+	}
+
+	//	First, wait for the infra to appear
+	_, err = waitForInfra(ctx, clusterInstallConfig, clusterName)
+	if err != nil {
+		return false, err
+	}
+
+	//	Then, wait for the CP to appear
+	_, err = waitForCP(ctx, clusterInstallConfig, clusterName)
+	if err != nil {
+		return false, err
+	}
+
+	log.Info("Control Plane Nodes are Online, saving Kubeconfig")
+
+	// Write out CAPI kubeconfig and save it
+	clusterKubeconfig, err := p.Kubeconfig(ctx, c, kindkconfig, clusterName)
+	if err != nil {
+		return false, err
+	}
+
+	err = ioutil.WriteFile(capicfg, []byte(clusterKubeconfig), 0600)
+	if err != nil {
+		return false, err
+	}
+
+	//Apply the CNI solution. For now we use Calico
+	//	TODO: This should be something that is an end user can choose
+
+	// Set up the Capi CFG connection
+	capiInstallConfig, err := clientcmd.BuildConfigFromFlags("", capicfg)
+	if err != nil {
+		return false, err
+	}
+
+	//	Download the CNI YAML
+	cniYaml, err := utils.FetchURL(p.CNIURL())
+	if err != nil {
+		return false, err
+	}
+
+	//	Apply the CNI YAML
+	err = ApplyManifests(ctx, capiInstallConfig, cniYaml, "CNI manifests", ApplyTimeout)
+	if err != nil {
+		return false, err
+	}
+
+	// Wait until Nodes are READY, which they only are once the CNI is up
+	log.Info("Waiting for worker nodes to come online")
+	_, err = waitForReadyNodes(ctx, clusterInstallConfig, capiInstallConfig, clusterName)
+	if err != nil {
+		return false, err
+	}
+
+	// If we're here, that means everything turned out okay
+	log.Info("Successfully created " + p.DisplayName() + " Kubernetes Cluster")
+	return true, nil
+}
+
+// MoveMgmtCluster moves the management cluster from src kubeconfig to dest kubeconfig
+func MoveMgmtCluster(ctx context.Context, p InfraProvider, src string, dest string) (bool, error) {
+	// create capi client
+	c, err := capiclient.New("")
+	if err != nil {
+		return false, err
+	}
+
+	// Create configs for src and dest
+	srcclient, err := clientcmd.BuildConfigFromFlags("", src)
+	if err != nil {
+		return false, err
+	}
+	destclient, err := clientcmd.BuildConfigFromFlags("", dest)
+	if err != nil {
+		return false, err
+	}
+
+	// The provider needs its credentials on dest too
+	defer p.Cleanup()
+	err = p.SetupCredentials(ctx, "", destclient, srcclient)
+	if err != nil {
+		return false, err
+	}
+
+	// init the dest cluster
+	log.Info("Setting up " + p.DisplayName() + " provider on target cluster")
+	_, err = c.Init(capiclient.InitOptions{
+		Kubeconfig:              capiclient.Kubeconfig{Path: dest},
+		InfrastructureProviders: []string{p.Name()},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// Wait for the controller to roll out before using it
+	namespace, name := p.Controller()
+	err = waitForController(ctx, destclient, namespace, name)
+	if err != nil {
+		return false, err
+	}
+
+	err = p.PreMove(ctx, srcclient, destclient)
+	if err != nil {
+		return false, err
+	}
+
+	// perform the move
+	err = c.Move(capiclient.MoveOptions{
+		FromKubeconfig: capiclient.Kubeconfig{Path: src},
+		ToKubeconfig:   capiclient.Kubeconfig{Path: dest},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// if we're here we must be okay
+	return true, nil
+}
+
+// workloadKubeconfig returns the kubeconfig of the cluster the way clusterctl has it
+func workloadKubeconfig(c capiclient.Client, mgmtKubeconfig string, clusterName string) (string, error) {
+	return c.GetKubeconfig(capiclient.GetKubeconfigOptions{
+		Kubeconfig:          capiclient.Kubeconfig{Path: mgmtKubeconfig},
+		WorkloadClusterName: clusterName,
+	})
+}
@@ -0,0 +1,213 @@
+package capi
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/soap"
+	capiclient "sigs.k8s.io/cluster-api/cmd/clusterctl/client"
+	"sigs.k8s.io/yaml"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// VSphere creates clusters on vSphere with CAPV
+type VSphere struct {
+	// Credentials are the VSPHERE_ variables, and CONTROL_PLANE_ENDPOINT_IP, clusterctl creates the cluster with
+	Credentials map[string]string
+}
+
+// vsphereCredentials is what CAPV keeps in its bootstrap credentials secret
+type vsphereCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Name returns vsphere
+func (p *VSphere) Name() string {
+	return "vsphere"
+}
+
+// DisplayName returns vSphere
+func (p *VSphere) DisplayName() string {
+	return "vSphere"
+}
+
+// Controller returns the CAPV controller
+func (p *VSphere) Controller() (string, string) {
+	return "capv-system", "capv-controller-manager"
+}
+
+// Flavor returns the default flavor, which runs kube-vip for the control plane endpoint
+func (p *VSphere) Flavor() string {
+	return ""
+}
+
+// Variables returns the vSphere credentials and settings, and what the template needs besides them
+func (p *VSphere) Variables() map[string]string {
+	vars := map[string]string{
+		"CPI_IMAGE_K8S_VERSION":      KubernetesVersion,
+		"EXP_CLUSTER_RESOURCE_SET":   "true",
+		"VSPHERE_SSH_AUTHORIZED_KEY": "",
+		"VSPHERE_STORAGE_POLICY":     "",
+		"VSPHERE_TLS_THUMBPRINT":     "",
+	}
+	for k, v := range p.Credentials {
+		vars[k] = v
+	}
+
+	return vars
+}
+
+// CNIURL returns the Calico YAML
+func (p *VSphere) CNIURL() string {
+	return CNIurl
+}
+
+// SelfManaged returns true, vSphere clusters manage themselves
+func (p *VSphere) SelfManaged() bool {
+	return true
+}
+
+// SetupCredentials logs into vCenter when creating, so wrong credentials or a missing datacenter, datastore, network
+// or template fail before anything is bootstrapped. When moving, it exports the credentials CAPV has on the cluster
+// the objects come from, so CAPV gets them on dest too.
+func (p *VSphere) SetupCredentials(ctx context.Context, clusterName string, mgmt *rest.Config, from *rest.Config) error {
+	if from == nil {
+		log.Info("Checking the vSphere inventory on " + p.Credentials["VSPHERE_SERVER"])
+		return p.checkInventory(ctx)
+	}
+
+	clientset, err := kubernetes.NewForConfig(from)
+	if err != nil {
+		return err
+	}
+	namespace, _ := p.Controller()
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, "capv-manager-bootstrap-credentials", metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	creds := vsphereCredentials{}
+	err = yaml.Unmarshal(secret.Data["credentials.yaml"], &creds)
+	if err != nil {
+		return errors.New("unable to read the vSphere credentials: " + err.Error())
+	}
+	os.Setenv("VSPHERE_USERNAME", creds.Username)
+	os.Setenv("VSPHERE_PASSWORD", creds.Password)
+
+	return nil
+}
+
+// login returns a client logged into vCenter with the credentials, trusting the thumbprint if there's one
+func (p *VSphere) login(ctx context.Context) (*govmomi.Client, error) {
+	u, err := soap.ParseURL(p.Credentials["VSPHERE_SERVER"])
+	if err != nil || u == nil {
+		return nil, errors.New("invalid vSphere server: " + p.Credentials["VSPHERE_SERVER"])
+	}
+	u.User = url.UserPassword(p.Credentials["VSPHERE_USERNAME"], p.Credentials["VSPHERE_PASSWORD"])
+
+	// Like CAPV, the certificate has to be trusted unless its thumbprint is given. The thumbprint is checked here,
+	// govmomi doesn't fall back to it with the verification errors of newer Go versions.
+	soapClient := soap.NewClient(u, false)
+	if thumbprint := p.Credentials["VSPHERE_TLS_THUMBPRINT"]; thumbprint != "" {
+		soapClient.DefaultTransport().TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				cert, err := x509.ParseCertificate(rawCerts[0])
+				if err != nil {
+					return err
+				}
+				if !strings.EqualFold(soap.ThumbprintSHA1(cert), thumbprint) {
+					return errors.New("certificate thumbprint " + soap.ThumbprintSHA1(cert) + " doesn't match " + thumbprint)
+				}
+				return nil
+			},
+		}
+	}
+	vimClient, err := vim25.NewClient(ctx, soapClient)
+	if err != nil {
+		return nil, errors.New("unable to connect to vCenter " + u.Host + ": " + err.Error())
+	}
+
+	client := &govmomi.Client{Client: vimClient, SessionManager: session.NewManager(vimClient)}
+	err = client.Login(ctx, u.User)
+	if err != nil {
+		return nil, errors.New("unable to log into vCenter " + u.Host + ": " + err.Error())
+	}
+
+	return client, nil
+}
+
+// checkInventory checks the datacenter and what the machines are created with exist
+func (p *VSphere) checkInventory(ctx context.Context) error {
+	client, err := p.login(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Logout(ctx)
+
+	finder := find.NewFinder(client.Client, true)
+	dc, err := finder.Datacenter(ctx, p.Credentials["VSPHERE_DATACENTER"])
+	if err != nil {
+		return err
+	}
+	finder.SetDatacenter(dc)
+
+	if _, err := finder.Datastore(ctx, p.Credentials["VSPHERE_DATASTORE"]); err != nil {
+		return err
+	}
+	if _, err := finder.Network(ctx, p.Credentials["VSPHERE_NETWORK"]); err != nil {
+		return err
+	}
+	if _, err := finder.VirtualMachine(ctx, p.Credentials["VSPHERE_TEMPLATE"]); err != nil {
+		return err
+	}
+
+	// The resource pool and folder default to the ones of the datacenter
+	if p.Credentials["VSPHERE_RESOURCE_POOL"] != "" {
+		if _, err := finder.ResourcePool(ctx, p.Credentials["VSPHERE_RESOURCE_POOL"]); err != nil {
+			return err
+		}
+	}
+	if p.Credentials["VSPHERE_FOLDER"] != "" {
+		if _, err := finder.Folder(ctx, p.Credentials["VSPHERE_FOLDER"]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Prepare does nothing, CAPV has what it needs
+func (p *VSphere) Prepare(ctx context.Context, mgmt *rest.Config) error {
+	return nil
+}
+
+// Kubeconfig returns the kubeconfig from clusterctl
+func (p *VSphere) Kubeconfig(ctx context.Context, c capiclient.Client, mgmtKubeconfig string, clusterName string) (string, error) {
+	return workloadKubeconfig(c, mgmtKubeconfig, clusterName)
+}
+
+// PreMove does nothing, the identity secret of the cluster is owned by it and moves with it
+func (p *VSphere) PreMove(ctx context.Context, src *rest.Config, dest *rest.Config) error {
+	return nil
+}
+
+// Cleanup unexports the credentials
+func (p *VSphere) Cleanup() {
+	os.Unsetenv("VSPHERE_USERNAME")
+	os.Unsetenv("VSPHERE_PASSWORD")
+}
@@ -0,0 +1,184 @@
+package capi
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/soap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+// newVCenter returns a vcsim vCenter, and the credentials of the create flags for it
+func newVCenter(t *testing.T) map[string]string {
+	model := simulator.VPX()
+	err := model.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = &tls.Config{}
+	model.Service.Listen = &url.URL{User: url.UserPassword("administrator@vsphere.local", "secret")}
+	server := model.Service.NewServer()
+	t.Cleanup(func() {
+		server.Close()
+		model.Remove()
+	})
+
+	return map[string]string{
+		"VSPHERE_SERVER":            server.URL.Host,
+		"VSPHERE_USERNAME":          "administrator@vsphere.local",
+		"VSPHERE_PASSWORD":          "secret",
+		"VSPHERE_TLS_THUMBPRINT":    soap.ThumbprintSHA1(server.Certificate()),
+		"VSPHERE_DATACENTER":        "DC0",
+		"VSPHERE_DATASTORE":         "LocalDS_0",
+		"VSPHERE_NETWORK":           "VM Network",
+		"VSPHERE_RESOURCE_POOL":     "/DC0/host/DC0_C0/Resources",
+		"VSPHERE_FOLDER":            "/DC0/vm",
+		"VSPHERE_TEMPLATE":          "DC0_H0_VM0",
+		"CONTROL_PLANE_ENDPOINT_IP": "10.0.0.10",
+	}
+}
+
+func TestVSphereSetupCredentials(t *testing.T) {
+	credentials := newVCenter(t)
+
+	for _, tc := range []struct {
+		name     string
+		override map[string]string
+		want     string
+	}{
+		{"valid", nil, ""},
+		{"no resource pool and folder", map[string]string{"VSPHERE_RESOURCE_POOL": "", "VSPHERE_FOLDER": ""}, ""},
+		{"wrong password", map[string]string{"VSPHERE_PASSWORD": "wrong"}, "unable to log into vCenter"},
+		{"untrusted certificate", map[string]string{"VSPHERE_TLS_THUMBPRINT": ""}, "unable to connect to vCenter"},
+		{"wrong thumbprint", map[string]string{"VSPHERE_TLS_THUMBPRINT": "00:11:22"}, "unable to connect to vCenter"},
+		{"missing datacenter", map[string]string{"VSPHERE_DATACENTER": "DC9"}, "datacenter 'DC9' not found"},
+		{"missing datastore", map[string]string{"VSPHERE_DATASTORE": "nfs"}, "datastore 'nfs' not found"},
+		{"missing network", map[string]string{"VSPHERE_NETWORK": "Private"}, "network 'Private' not found"},
+		{"missing template", map[string]string{"VSPHERE_TEMPLATE": "ubuntu"}, "vm 'ubuntu' not found"},
+		{"missing resource pool", map[string]string{"VSPHERE_RESOURCE_POOL": "gokp"}, "resource pool 'gokp' not found"},
+		{"missing folder", map[string]string{"VSPHERE_FOLDER": "gokp"}, "folder 'gokp' not found"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &VSphere{Credentials: map[string]string{}}
+			for k, v := range credentials {
+				p.Credentials[k] = v
+			}
+			for k, v := range tc.override {
+				p.Credentials[k] = v
+			}
+
+			err := p.SetupCredentials(context.Background(), "mycluster", nil, nil)
+			if tc.want == "" && err != nil {
+				t.Fatalf("got %v", err)
+			}
+			if tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)) {
+				t.Fatalf("got error %v, want one containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+// newBootstrapCredentialsServer returns the config of an API server with the bootstrap credentials secret of CAPV
+func newBootstrapCredentialsServer(t *testing.T, credentials string) *rest.Config {
+	path := "/api/v1/namespaces/capv-system/secrets/capv-manager-bootstrap-credentials"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&corev1.Secret{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+			ObjectMeta: metav1.ObjectMeta{Namespace: "capv-system", Name: "capv-manager-bootstrap-credentials"},
+			Data:       map[string][]byte{"credentials.yaml": []byte(credentials)},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	return &rest.Config{Host: server.URL}
+}
+
+func TestVSphereSetupCredentialsMove(t *testing.T) {
+	credentials := newVCenter(t)
+	from := newBootstrapCredentialsServer(t, "username: '"+credentials["VSPHERE_USERNAME"]+"'\npassword: '"+credentials["VSPHERE_PASSWORD"]+"'\n")
+
+	// Nothing but the cluster the objects come from is known when moving
+	p := &VSphere{}
+	err := p.SetupCredentials(context.Background(), "", &rest.Config{}, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Cleanup()
+
+	if os.Getenv("VSPHERE_USERNAME") != credentials["VSPHERE_USERNAME"] || os.Getenv("VSPHERE_PASSWORD") != credentials["VSPHERE_PASSWORD"] {
+		t.Fatalf("got credentials %q/%q", os.Getenv("VSPHERE_USERNAME"), os.Getenv("VSPHERE_PASSWORD"))
+	}
+
+	// They're the ones vCenter takes
+	credentials["VSPHERE_USERNAME"] = os.Getenv("VSPHERE_USERNAME")
+	credentials["VSPHERE_PASSWORD"] = os.Getenv("VSPHERE_PASSWORD")
+	err = (&VSphere{Credentials: credentials}).SetupCredentials(context.Background(), "mycluster", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.Cleanup()
+	if _, ok := os.LookupEnv("VSPHERE_PASSWORD"); ok {
+		t.Error("the credentials are still exported after the cleanup")
+	}
+}
+
+func TestVSphereSetupCredentialsMoveInvalid(t *testing.T) {
+	from := newBootstrapCredentialsServer(t, "username: [")
+
+	p := &VSphere{}
+	err := p.SetupCredentials(context.Background(), "", &rest.Config{}, from)
+	if err == nil || !strings.Contains(err.Error(), "unable to read the vSphere credentials") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestVSphereVariables(t *testing.T) {
+	credentials := newVCenter(t)
+	credentials["VSPHERE_SSH_AUTHORIZED_KEY"] = "ssh-ed25519 AAAA"
+
+	vars := (&VSphere{Credentials: credentials}).Variables()
+	for k, v := range credentials {
+		if vars[k] != v {
+			t.Errorf("%s: got %q, want %q", k, vars[k], v)
+		}
+	}
+
+	// The template needs these even when they're not given
+	vars = (&VSphere{Credentials: map[string]string{}}).Variables()
+	for _, k := range []string{"VSPHERE_SSH_AUTHORIZED_KEY", "VSPHERE_STORAGE_POLICY", "VSPHERE_TLS_THUMBPRINT"} {
+		if v, ok := vars[k]; !ok || v != "" {
+			t.Errorf("%s: got %q, want it empty", k, v)
+		}
+	}
+	if vars["CPI_IMAGE_K8S_VERSION"] != KubernetesVersion || vars["EXP_CLUSTER_RESOURCE_SET"] != "true" {
+		t.Errorf("got %v", vars)
+	}
+}
+
+func TestVSpherePreMove(t *testing.T) {
+	credentials := newVCenter(t)
+
+	// The identity moves with the cluster, so there's nothing for either cluster to serve
+	src := newBootstrapCredentialsServer(t, "")
+	dest := newBootstrapCredentialsServer(t, "")
+	err := (&VSphere{Credentials: credentials}).PreMove(context.Background(), src, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,8 +1,16 @@
 package cmd
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"strings"
 
+	"github.com/christianh814/gokp/cmd/events"
+	"github.com/christianh814/gokp/pkg/gokp"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
@@ -38,4 +46,93 @@ so beware. There be dragons here. PRE-PRE-ALPHA`,
 
 func init() {
 	rootCmd.AddCommand(createClusterCmd)
+
+	// Every provider can resume
+	createClusterCmd.PersistentFlags().Bool("resume", false, "Resume an install that was interrupted or failed, skipping the steps it finished. Takes the same flags as the install.")
+}
+
+// installOptionsFromFlags returns what to install from the flags every create command has
+func installOptionsFromFlags(c *cobra.Command) (gokp.Options, error) {
+	clusterName, _ := c.Flags().GetString("cluster-name")
+	privateRepo, _ := c.Flags().GetBool("private-repo")
+	gitOpsController, _ := c.Flags().GetString("gitops-controller")
+	resume, _ := c.Flags().GetBool("resume")
+
+	// Load the export options now so bad ones fail early
+	exportOpts, err := exportOptionsFromFlags(c)
+	if err != nil {
+		return gokp.Options{}, err
+	}
+
+	return gokp.Options{
+		ClusterName:      clusterName,
+		GitOpsController: gitOpsController,
+		PrivateRepo:      privateRepo,
+		GitAuth:          gitAuthFromFlags(c),
+		Repo:             repoOptionsFromFlags(c),
+		Commit:           commitOptionsFromFlags(c, clusterName),
+		Export:           exportOpts,
+		Resume:           resume,
+	}, nil
+}
+
+// install installs the cluster on the provider with the options of the create command, exiting if it fails.
+// The installer publishes the error of the step that failed, the ones before it starts are published here.
+func install(c *cobra.Command, provider gokp.Provider) {
+	opts, err := installOptionsFromFlags(c)
+	if err != nil {
+		fail(events.CodeInvalidInput, err)
+	}
+
+	installer, err := gokp.NewInstaller(provider, opts)
+	if err != nil {
+		fail(events.CodeInvalidInput, err)
+	}
+
+	_, err = installer.Install(c.Context())
+	if errors.Is(err, gokp.ErrCanceled) {
+		interrupted(c, installer)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// confirm asks the question and returns true if the answer is yes. Only people are asked, not what drives gokp,
+// so it's false when the output isn't text or stdin isn't a terminal.
+func confirm(c *cobra.Command, question string) bool {
+	output, _ := c.Flags().GetString("output")
+	stdin, err := os.Stdin.Stat()
+	if output != "text" || err != nil || stdin.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	fmt.Fprint(os.Stderr, question+" [y/N]: ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+
+	return strings.ToLower(strings.TrimSpace(answer)) == "y"
+}
+
+// interrupted offers to delete the temporary control plane of the install, and tells how to resume it
+func interrupted(c *cobra.Command, installer *gokp.Installer) {
+	// Nothing was made before there's a checkpoint
+	if _, err := os.Stat(installer.CheckpointFile()); err != nil {
+		return
+	}
+
+	deleted := false
+	if confirm(c, "Delete the temporary control plane? Until the cluster is moved it's what manages it") {
+		err := installer.DeleteBootstrap(context.Background())
+		if err != nil {
+			log.Warn("Unable to delete the temporary control plane: ", err)
+		}
+		deleted = err == nil
+	}
+	if !deleted {
+		log.Warn("Kept the temporary control plane, delete it with: kind delete cluster --name ", gokp.DefaultBootstrapName)
+	}
+
+	if _, err := os.Stat(installer.CheckpointFile()); err == nil {
+		log.Warn("Run the same command with --resume to pick up where the install stopped")
+	}
 }
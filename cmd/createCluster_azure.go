@@ -1,18 +1,8 @@
 package cmd
 
 import (
-	"os"
-
-	"github.com/christianh814/gokp/cmd/argo"
 	"github.com/christianh814/gokp/cmd/capi"
-	"github.com/christianh814/gokp/cmd/export"
-	"github.com/christianh814/gokp/cmd/flux"
-
-	"github.com/christianh814/gokp/cmd/github"
-	"github.com/christianh814/gokp/cmd/kind"
-	"github.com/christianh814/gokp/cmd/templates"
-	"github.com/christianh814/gokp/cmd/utils"
-	log "github.com/sirupsen/logrus"
+	"github.com/christianh814/gokp/pkg/gokp"
 	"github.com/spf13/cobra"
 )
 
@@ -33,25 +23,6 @@ gokp create-cluster azure --cluster-name=mycluster \
 --azure-resource-group='rg-name'
 --private-repo=true`,
 	Run: func(cmd *cobra.Command, args []string) {
-		// create home dir
-		err := os.MkdirAll(os.Getenv("HOME")+"/.gokp", 0775)
-		if err != nil {
-			log.Fatal(err)
-		}
-		// Create workdir and set variables based on that
-		WorkDir, _ = utils.CreateWorkDir()
-		KindCfg = WorkDir + "/" + "kind.kubeconfig"
-		// cleanup workdir at the end
-		defer os.RemoveAll(WorkDir)
-
-		// Grab repo related flags
-		ghToken, _ := cmd.Flags().GetString("github-token")
-		clusterName, _ := cmd.Flags().GetString("cluster-name")
-		privateRepo, _ := cmd.Flags().GetBool("private-repo")
-
-		// Set GitOps Controller
-		gitOpsController, _ := cmd.Flags().GetString("gitops-controller")
-
 		// Grab Azure related flags
 		azureRegion, _ := cmd.Flags().GetString("azure-region")
 		azureAppId, _ := cmd.Flags().GetString("azure-app-id")
@@ -63,145 +34,20 @@ gokp create-cluster azure --cluster-name=mycluster \
 		azureWMachine, _ := cmd.Flags().GetString("azure-node-machine")
 		azureResourceGroup, _ := cmd.Flags().GetString("azure-resource-group")
 
-		CapiCfg := WorkDir + "/" + clusterName + ".kubeconfig"
-		gokpartifacts := os.Getenv("HOME") + "/.gokp/" + clusterName
-
-		tcpName := "gokp-bootstrapper"
-
-		// Run PreReq Checks
-		_, err = utils.CheckPreReqs(gokpartifacts, gitOpsController)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		// Create KIND instance
-		log.Info("entering Azure command")
-		log.Info("Creating temporary control plane")
-		err = kind.CreateKindCluster(tcpName, KindCfg)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		// Create CAPI instance on AWS
-		azureCredsMap := map[string]string{
-			"AZURE_LOCATION":                   azureRegion,
-			"AZURE_CLIENT_ID":                  azureAppId,
-			"AZURE_CLIENT_SECRET":              azureAppSecret,
-			"AZURE_TENANT_ID":                  azureTenantId,
-			"AZURE_SUBSCRIPTION_ID":            azureSubscriptionId,
-			"AZURE_CONTROL_PLANE_MACHINE_TYPE": azureCPMachine,
-			"AZURE_NODE_MACHINE_TYPE":          azureWMachine,
-			"AZURE_SSH_KEY":                    azureSSHKey,
-			"AZURE_RESOURCE_GROUP":             azureResourceGroup,
-		}
-
-		// By default, create an HA Cluster
-		haCluster := true
-		_, err = capi.CreateAzureK8sInstance(KindCfg, &clusterName, WorkDir, azureCredsMap, CapiCfg, haCluster)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		// Create the GitOps repo
-		_, gitopsrepo, err := github.CreateRepo(&clusterName, ghToken, &privateRepo, WorkDir)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		// Create repo dir structure based on which gitops controller that was chosen
-		if gitOpsController == "argocd" {
-			// Create repo dir structure. Including Argo CD install YAMLs and base YAMLs. Push initial dir structure out
-			_, err = templates.CreateArgoRepoSkel(&clusterName, WorkDir, ghToken, gitopsrepo, &privateRepo)
-			if err != nil {
-				log.Fatal(err)
-			}
-		} else if gitOpsController == "fluxcd" || gitOpsController == "flux" {
-			// Create repo dir structure. Including Flux CD install YAMLs and base YAMLs. Push initial dir structure out
-			_, err = templates.CreateFluxRepoSkel(&clusterName, WorkDir, ghToken, gitopsrepo, &privateRepo)
-			if err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			log.Fatal("unknown gitops controller")
-		}
-
-		// Export/Create Cluster YAML to the Repo, Make sure kustomize is used for the core components
-		log.Info("Exporting Cluster YAML")
-		_, err = export.ExportClusterYaml(CapiCfg, WorkDir+"/"+clusterName, gitOpsController)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		// Git push newly exported YAML to GitOps repo
-		privateKeyFile := WorkDir + "/" + clusterName + "_rsa"
-		_, err = github.CommitAndPush(WorkDir+"/"+clusterName, privateKeyFile, "exporting existing YAML")
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		// Deplopy the GitOps controller that was chosen
-		if gitOpsController == "argocd" {
-			// Install Argo CD on the newly created cluster with applications/applicationsets
-			log.Info("Deploying Argo CD GitOps Controller")
-			_, err = argo.BootstrapArgoCD(&clusterName, WorkDir, CapiCfg)
-			if err != nil {
-				log.Fatal(err)
-			}
-		} else if gitOpsController == "fluxcd" || gitOpsController == "flux" {
-			// Install Flux CD on the newly created cluster with all it's components
-			log.Info("Deploying Flux CD GitOps Controller")
-			_, err = flux.BootstrapFluxCD(&clusterName, WorkDir, CapiCfg)
-			if err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			log.Fatal("unknown gitops controller")
-		}
-
-		// MOVE from kind to capi instance
-		log.Info("Moving CAPI Artifacts to: " + clusterName)
-		_, err = capi.MoveMgmtCluster(KindCfg, CapiCfg, "capz")
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		// Delete local Kind Cluster
-		log.Info("Deleting temporary control plane")
-		err = kind.DeleteKindCluster(tcpName, KindCfg)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		// Move components to ~/.gokp/<clustername> and remove stuff you don't need to know.
-		// 	TODO: this is ugly and will refactor this later
-		///err = utils.CopyDir(WorkDir, gokpartifacts)
-		err = os.Rename(WorkDir, gokpartifacts)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		notNeeded := []string{
-			"argocd-install-output",
-			"capi-install-yamls-output",
-			"cni-output",
-			"fluxcd-install-output",
-			"argocd-install.yaml",
-			"flux-install.yaml",
-			"cni.yaml",
-			"install-cluster.yaml",
-			"kind.kubeconfig",
-		}
-
-		for _, notNeededthing := range notNeeded {
-			err = os.RemoveAll(gokpartifacts + "/" + notNeededthing)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-
-		// Give info
-		log.Info("Cluster Successfully installed! Everything you need is under: ~/.gokp/", clusterName)
-
+		// Create CAPI instance on Azure, by default an HA Cluster
+		install(cmd, &gokp.CAPIProvider{HA: true, Infra: &capi.Azure{
+			Credentials: map[string]string{
+				"AZURE_LOCATION":                   azureRegion,
+				"AZURE_CLIENT_ID":                  azureAppId,
+				"AZURE_CLIENT_SECRET":              azureAppSecret,
+				"AZURE_TENANT_ID":                  azureTenantId,
+				"AZURE_SUBSCRIPTION_ID":            azureSubscriptionId,
+				"AZURE_CONTROL_PLANE_MACHINE_TYPE": azureCPMachine,
+				"AZURE_NODE_MACHINE_TYPE":          azureWMachine,
+				"AZURE_SSH_KEY":                    azureSSHKey,
+				"AZURE_RESOURCE_GROUP":             azureResourceGroup,
+			},
+		}})
 	},
 }
 
@@ -212,9 +58,9 @@ func init() {
 	azurecreateCmd.Flags().String("gitops-controller", "argocd", "The GitOps Controller to use for this cluster.")
 
 	// Repo specific flags
-	azurecreateCmd.Flags().String("github-token", "", "GitHub token to use.")
 	azurecreateCmd.Flags().String("cluster-name", "", "Name of your cluster.")
-	azurecreateCmd.Flags().BoolP("private-repo", "", true, "Create a private repo.")
+	addGitFlags(azurecreateCmd)
+	addExportFlags(azurecreateCmd)
 
 	// Azure Specific flags
 	azurecreateCmd.Flags().String("azure-region", "westus2", "Which region to deploy to.")
@@ -228,7 +74,6 @@ func init() {
 	azurecreateCmd.Flags().String("azure-resource-group", "gokp-cluster", "The Azure resource group name")
 
 	// require the following flags
-	azurecreateCmd.MarkFlagRequired("github-token")
 	azurecreateCmd.MarkFlagRequired("cluster-name")
 	azurecreateCmd.MarkFlagRequired("azure-app-id")
 	azurecreateCmd.MarkFlagRequired("azure-app-secret")
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"errors"
+	"net"
+
+	"github.com/christianh814/gokp/cmd/capi"
+	"github.com/christianh814/gokp/cmd/events"
+	"github.com/christianh814/gokp/pkg/gokp"
+	"github.com/spf13/cobra"
+)
+
+// vspherecreateCmd represents the vsphere create command
+var vspherecreateCmd = &cobra.Command{
+	Use:   "vsphere",
+	Short: "Creates a GOKP Cluster on vSphere",
+	Long: `Create a GOKP Cluster on vSphere. This will build a cluster on vSphere using the given
+credentials. For example:
+
+gokp create-cluster vsphere --cluster-name=mycluster \
+--github-token=githubtoken \
+--vsphere-server=vcenter.example.com \
+--vsphere-username=administrator@vsphere.local \
+--vsphere-password=password \
+--vsphere-datacenter=dc1 \
+--vsphere-datastore=datastore1 \
+--vsphere-network='VM Network' \
+--vsphere-template=ubuntu-2004-kube-v1.24.0 \
+--control-plane-endpoint-ip=10.0.0.10 \
+--private-repo=true
+
+The template must already exist in vSphere, and the control plane endpoint IP
+must be a free IP on the network, kube-vip serves the API server on it. The
+credentials and inventory are checked against vCenter before anything is
+created. To try it against vcsim, the vCenter simulator, point
+--vsphere-server at it and pass its certificate thumbprint with
+--vsphere-tls-thumbprint.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Grab vSphere related flags
+		vsphereServer, _ := cmd.Flags().GetString("vsphere-server")
+		vsphereUsername, _ := cmd.Flags().GetString("vsphere-username")
+		vspherePassword, _ := cmd.Flags().GetString("vsphere-password")
+		vsphereThumbprint, _ := cmd.Flags().GetString("vsphere-tls-thumbprint")
+		vsphereDatacenter, _ := cmd.Flags().GetString("vsphere-datacenter")
+		vsphereDatastore, _ := cmd.Flags().GetString("vsphere-datastore")
+		vsphereNetwork, _ := cmd.Flags().GetString("vsphere-network")
+		vsphereResourcePool, _ := cmd.Flags().GetString("vsphere-resource-pool")
+		vsphereFolder, _ := cmd.Flags().GetString("vsphere-folder")
+		vsphereTemplate, _ := cmd.Flags().GetString("vsphere-template")
+		vsphereSSHKey, _ := cmd.Flags().GetString("vsphere-ssh-key")
+		endpointIP, _ := cmd.Flags().GetString("control-plane-endpoint-ip")
+
+		// kube-vip needs an IP, not a name
+		if net.ParseIP(endpointIP) == nil {
+			fail(events.CodeInvalidInput, errors.New("control plane endpoint must be an IP: "+endpointIP))
+		}
+
+		// Create CAPI instance on vSphere, by default an HA Cluster
+		install(cmd, &gokp.CAPIProvider{HA: true, Infra: &capi.VSphere{
+			Credentials: map[string]string{
+				"VSPHERE_SERVER":             vsphereServer,
+				"VSPHERE_USERNAME":           vsphereUsername,
+				"VSPHERE_PASSWORD":           vspherePassword,
+				"VSPHERE_TLS_THUMBPRINT":     vsphereThumbprint,
+				"VSPHERE_DATACENTER":         vsphereDatacenter,
+				"VSPHERE_DATASTORE":          vsphereDatastore,
+				"VSPHERE_NETWORK":            vsphereNetwork,
+				"VSPHERE_RESOURCE_POOL":      vsphereResourcePool,
+				"VSPHERE_FOLDER":             vsphereFolder,
+				"VSPHERE_TEMPLATE":           vsphereTemplate,
+				"VSPHERE_SSH_AUTHORIZED_KEY": vsphereSSHKey,
+				"CONTROL_PLANE_ENDPOINT_IP":  endpointIP,
+			},
+		}})
+	},
+}
+
+func init() {
+	createClusterCmd.AddCommand(vspherecreateCmd)
+
+	// GitOps Controller Flag
+	vspherecreateCmd.Flags().String("gitops-controller", "argocd", "The GitOps Controller to use for this cluster.")
+
+	// Repo specific flags
+	vspherecreateCmd.Flags().String("cluster-name", "", "Name of your cluster.")
+	addGitFlags(vspherecreateCmd)
+	addExportFlags(vspherecreateCmd)
+
+	// vSphere Specific flags
+	vspherecreateCmd.Flags().String("vsphere-server", "", "The vCenter server to create the cluster with.")
+	vspherecreateCmd.Flags().String("vsphere-username", "", "Your vCenter username.")
+	vspherecreateCmd.Flags().String("vsphere-password", "", "Your vCenter password.")
+	vspherecreateCmd.Flags().String("vsphere-tls-thumbprint", "", "SHA1 thumbprint of the vCenter certificate, for self signed ones.")
+	vspherecreateCmd.Flags().String("vsphere-datacenter", "", "The datacenter to deploy to.")
+	vspherecreateCmd.Flags().String("vsphere-datastore", "", "The datastore for the machine disks.")
+	vspherecreateCmd.Flags().String("vsphere-network", "VM Network", "The network the machines are attached to.")
+	vspherecreateCmd.Flags().String("vsphere-resource-pool", "", "The resource pool for the machines. Defaults to the one of the datacenter.")
+	vspherecreateCmd.Flags().String("vsphere-folder", "", "The VM folder for the machines. Defaults to the one of the datacenter.")
+	vspherecreateCmd.Flags().String("vsphere-template", "", "The VM template the machines are cloned from.")
+	vspherecreateCmd.Flags().String("vsphere-ssh-key", "", "The SSH public key authorized on the machines.")
+	vspherecreateCmd.Flags().String("control-plane-endpoint-ip", "", "The free IP kube-vip serves the API server on.")
+
+	// require the following flags
+	vspherecreateCmd.MarkFlagRequired("cluster-name")
+	vspherecreateCmd.MarkFlagRequired("vsphere-server")
+	vspherecreateCmd.MarkFlagRequired("vsphere-username")
+	vspherecreateCmd.MarkFlagRequired("vsphere-password")
+	vspherecreateCmd.MarkFlagRequired("vsphere-datacenter")
+	vspherecreateCmd.MarkFlagRequired("vsphere-datastore")
+	vspherecreateCmd.MarkFlagRequired("vsphere-template")
+	vspherecreateCmd.MarkFlagRequired("control-plane-endpoint-ip")
+}
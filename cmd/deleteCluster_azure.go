@@ -4,6 +4,7 @@ import (
 	"os"
 
 	"github.com/christianh814/gokp/cmd/capi"
+	"github.com/christianh814/gokp/cmd/events"
 	"github.com/christianh814/gokp/cmd/kind"
 	"github.com/christianh814/gokp/cmd/utils"
 	log "github.com/sirupsen/logrus"
@@ -20,7 +21,11 @@ based on the kubeconfig file and name you pass it.
 This only deletes the cluster and not the git repo.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		// Create workdir and set variables
-		WorkDir, _ = utils.CreateWorkDir()
+		var err error
+		WorkDir, err = utils.CreateWorkDir()
+		if err != nil {
+			fail(events.CodeFilesystem, err)
+		}
 		KindCfg = WorkDir + "/" + "kind.kubeconfig"
 		tcpName := "gokp-bootstrapper"
 
@@ -33,31 +38,30 @@ This only deletes the cluster and not the git repo.`,
 
 		// Create KIND cluster
 		log.Info("Creating temporary control plane")
-		err := kind.CreateKindCluster(tcpName, KindCfg)
+		err = kind.CreateKindCluster(cmd.Context(), tcpName, KindCfg)
 		if err != nil {
-			log.Fatal(err)
+			failCommand(cmd, events.CodeCluster, err)
 		}
 
 		// Move Capi components to the KIND cluster
 		log.Info("Moving CAPI Artifacts to the tempoary control plane")
-		_, err = capi.MoveMgmtCluster(CapiCfg, KindCfg, "capz")
+		_, err = capi.MoveMgmtCluster(cmd.Context(), &capi.Azure{}, CapiCfg, KindCfg)
 		if err != nil {
-			log.Fatal(err)
-
+			failCommand(cmd, events.CodeCluster, err)
 		}
 
 		// Delete cluster
 		log.Info("Deleteing cluster: " + clusterName)
-		_, err = capi.DeleteCluster(KindCfg, clusterName)
+		_, err = capi.DeleteCluster(cmd.Context(), KindCfg, clusterName)
 		if err != nil {
-			log.Fatal(err)
+			failCommand(cmd, events.CodeCluster, err)
 		}
 
 		// Delete local Kind Cluster
 		log.Info("Deleting temporary control plane")
 		err = kind.DeleteKindCluster(tcpName, KindCfg)
 		if err != nil {
-			log.Fatal(err)
+			failCommand(cmd, events.CodeCluster, err)
 		}
 
 		// If we're here, the cluster should be deleted
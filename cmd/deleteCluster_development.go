@@ -3,6 +3,7 @@ package cmd
 import (
 	"os"
 
+	"github.com/christianh814/gokp/cmd/events"
 	"github.com/christianh814/gokp/cmd/kind"
 	"github.com/christianh814/gokp/cmd/utils"
 	log "github.com/sirupsen/logrus"
@@ -18,7 +19,11 @@ var developmentDeleteCmd = &cobra.Command{
 and name you pass it. This only deletes the local development cluster and not the git repo.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		// Create workdir and set variables
-		WorkDir, _ = utils.CreateWorkDir()
+		var err error
+		WorkDir, err = utils.CreateWorkDir()
+		if err != nil {
+			fail(events.CodeFilesystem, err)
+		}
 		defer os.RemoveAll(WorkDir)
 
 		// Grab flags
@@ -27,9 +32,9 @@ and name you pass it. This only deletes the local development cluster and not th
 
 		// Delete local Kind Cluster
 		log.Info("Deleting development cluster " + clusterName)
-		err := kind.DeleteKindCluster(clusterName, CapiCfg)
+		err = kind.DeleteKindCluster(clusterName, CapiCfg)
 		if err != nil {
-			log.Fatal(err)
+			failCommand(cmd, events.CodeCluster, err)
 		}
 
 		// If we're here, the cluster should be deleted
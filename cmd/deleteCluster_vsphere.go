@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/christianh814/gokp/cmd/capi"
+	"github.com/christianh814/gokp/cmd/events"
+	"github.com/christianh814/gokp/cmd/kind"
+	"github.com/christianh814/gokp/cmd/utils"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// vsphereDeleteCmd represents the vsphere delete command
+var vsphereDeleteCmd = &cobra.Command{
+	Use:   "vsphere",
+	Short: "Deletes a GOKP cluster running on vSphere",
+	Long: `This will delete your cluster that is running on vSphere
+based on the kubeconfig file and name you pass it.
+
+This only deletes the cluster and not the git repo.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Create workdir and set variables
+		var err error
+		WorkDir, err = utils.CreateWorkDir()
+		if err != nil {
+			fail(events.CodeFilesystem, err)
+		}
+		KindCfg = WorkDir + "/" + "kind.kubeconfig"
+		tcpName := "gokp-bootstrapper"
+
+		// cleanup workdir at the end
+		defer os.RemoveAll(WorkDir)
+
+		// Grab flags
+		clusterName, _ := cmd.Flags().GetString("cluster-name")
+		CapiCfg, _ := cmd.Flags().GetString("kubeconfig")
+
+		// Create KIND cluster
+		log.Info("Creating temporary control plane")
+		err = kind.CreateKindCluster(cmd.Context(), tcpName, KindCfg)
+		if err != nil {
+			failCommand(cmd, events.CodeCluster, err)
+		}
+
+		// Move Capi components to the KIND cluster
+		log.Info("Moving CAPI Artifacts to the tempoary control plane")
+		_, err = capi.MoveMgmtCluster(cmd.Context(), &capi.VSphere{}, CapiCfg, KindCfg)
+		if err != nil {
+			failVSphereDelete(cmd, err, tcpName, false)
+		}
+
+		// Delete cluster
+		log.Info("Deleteing cluster: " + clusterName)
+		_, err = capi.DeleteCluster(cmd.Context(), KindCfg, clusterName)
+		if err != nil {
+			failVSphereDelete(cmd, err, tcpName, true)
+		}
+
+		// Delete local Kind Cluster
+		log.Info("Deleting temporary control plane")
+		err = kind.DeleteKindCluster(tcpName, KindCfg)
+		if err != nil {
+			failCommand(cmd, events.CodeCluster, err)
+		}
+
+		// If we're here, the cluster should be deleted
+		log.Info("Cluster " + clusterName + " successfully deleted")
+
+	},
+}
+
+// failVSphereDelete fails the delete along with the temporary control plane. The cluster manages itself until
+// it's moved, after that the temporary control plane is what manages it so people are asked first.
+func failVSphereDelete(c *cobra.Command, err error, tcpName string, moved bool) {
+	if !moved || confirm(c, "Delete the temporary control plane? The cluster was moved into it, it's what manages it now") {
+		log.Info("Deleting temporary control plane")
+		if kindErr := kind.DeleteKindCluster(tcpName, KindCfg); kindErr != nil {
+			log.Warn("Unable to delete the temporary control plane: ", kindErr)
+		}
+	} else {
+		log.Warn("Kept the temporary control plane, delete it with: kind delete cluster --name ", tcpName)
+	}
+
+	// Failing exits without running the deferred cleanup
+	os.RemoveAll(WorkDir)
+	failCommand(c, events.CodeCluster, err)
+}
+
+func init() {
+	deleteClusterCmd.AddCommand(vsphereDeleteCmd)
+
+	// Define flags for delete-cluster
+	vsphereDeleteCmd.Flags().String("kubeconfig", "", "Path to the Kubeconfig file of the gokp cluster")
+	vsphereDeleteCmd.Flags().String("cluster-name", "", "Name of the gokp cluster.")
+
+	// all flags required
+	vsphereDeleteCmd.MarkFlagRequired("kubeconfig")
+	vsphereDeleteCmd.MarkFlagRequired("cluster-name")
+
+}
@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/christianh814/gokp/cmd/events"
+	"github.com/christianh814/gokp/cmd/export"
+	"github.com/christianh814/gokp/cmd/github"
+	"github.com/christianh814/gokp/cmd/utils"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// driftCmd represents the drift command
+var driftCmd = &cobra.Command{
+	Use:   "drift",
+	Short: "Reports how a gokp cluster drifted from its GitOps repo",
+	Long: `This will export the live cluster again and compare it with the
+checked out GitOps repo of the cluster, reporting the objects that were
+added, removed or changed outside of Git.
+
+With --commit the live state is written to the repo and a pull request
+is opened for it.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Grab flags
+		clusterName, _ := cmd.Flags().GetString("cluster-name")
+		kubeconfig, _ := cmd.Flags().GetString("kubeconfig")
+		repoDir, _ := cmd.Flags().GetString("repo-dir")
+		repoPath, _ := cmd.Flags().GetString("git-path")
+		gitOpsController, _ := cmd.Flags().GetString("gitops-controller")
+		format, _ := cmd.Flags().GetString("format")
+		commit, _ := cmd.Flags().GetBool("commit")
+		pull, _ := cmd.Flags().GetBool("pull")
+
+		if format != "text" && format != "json" {
+			fail(events.CodeInvalidInput, errors.New("unrecognized format: "+format))
+		}
+
+		// Everything defaults to where the cluster was installed to
+		gokpartifacts := os.Getenv("HOME") + "/.gokp/" + clusterName
+		if kubeconfig == "" {
+			kubeconfig = gokpartifacts + "/" + clusterName + ".kubeconfig"
+		}
+		if repoDir == "" {
+			repoDir = gokpartifacts + "/" + clusterName
+		}
+		clusterDir, err := driftClusterDir(repoDir, repoPath, clusterName)
+		if err != nil {
+			fail(events.CodeInvalidInput, err)
+		}
+
+		// The deploy key and known hosts are the ones the installer wrote
+		gitAuth := gitAuthFromFlags(cmd)
+		gitAuth.PrivateKeyFile = gokpartifacts + "/" + clusterName + "_rsa"
+		gitAuth.KnownHostsFile = gokpartifacts + "/known_hosts"
+		commitOpts := commitOptionsFromFlags(cmd, clusterName)
+		commitOpts.ViaPullRequest = true
+
+		// Opening a pull request needs everything a create does
+		if commit {
+			err := gitAuth.Validate(gitOpsController)
+			if err != nil {
+				fail(events.CodeInvalidInput, err)
+			}
+			err = commitOpts.Validate(gitOpsController)
+			if err != nil {
+				fail(events.CodeInvalidInput, err)
+			}
+		}
+
+		exportOpts, err := exportOptionsFromFlags(cmd)
+		if err != nil {
+			fail(events.CodeInvalidInput, err)
+		}
+
+		// Compare with what the GitOps controller sees, not a stale checkout
+		if pull {
+			err = github.SyncRepo(cmd.Context(), clusterDir, gitAuth, commitOpts.Branch)
+			if err != nil {
+				failCommand(cmd, events.CodeGit, err)
+			}
+		}
+
+		// Export the live cluster next to the repo
+		WorkDir, err = utils.CreateWorkDir()
+		if err != nil {
+			fail(events.CodeFilesystem, err)
+		}
+		defer os.RemoveAll(WorkDir)
+
+		// Failing exits without running the deferred cleanup, so the work dir goes first
+		failDrift := func(code string, err error) {
+			os.RemoveAll(WorkDir)
+			failCommand(cmd, code, err)
+		}
+
+		log.Info("Exporting the live state of cluster " + clusterName)
+		_, err = export.ExportClusterYaml(cmd.Context(), kubeconfig, WorkDir, gitOpsController, exportOpts)
+		if err != nil {
+			failDrift(events.CodeExport, err)
+		}
+
+		// Self managed clusters have their CAPI objects in the repo too
+		if _, err := os.Stat(clusterDir + "/cluster/capi"); err == nil {
+			_, err = export.ExportCapiYaml(cmd.Context(), kubeconfig, WorkDir, gitOpsController, exportOpts)
+			if err != nil {
+				failDrift(events.CodeExport, err)
+			}
+		}
+
+		report, err := export.DetectDrift(clusterDir, WorkDir, exportOpts.Secrets)
+		if err != nil {
+			failDrift(events.CodeExport, err)
+		}
+
+		// The report goes to stdout so it can be piped, logs go to stderr
+		if format == "json" {
+			// Keep to a line along with the events when they're on stdout too
+			var content []byte
+			if output, _ := cmd.Flags().GetString("output"); output == "json" {
+				content, err = json.Marshal(report)
+			} else {
+				content, err = json.MarshalIndent(report, "", "  ")
+			}
+			if err != nil {
+				failDrift(events.CodeExport, err)
+			}
+			fmt.Println(string(content))
+		} else {
+			fmt.Print(report.Text())
+		}
+
+		if !commit || report.Empty() {
+			return
+		}
+
+		// Write the live state to the repo and open a pull request for it
+		err = report.Apply(clusterDir, WorkDir)
+		if err != nil {
+			failDrift(events.CodeFilesystem, err)
+		}
+		_, err = github.CommitAndPush(cmd.Context(), clusterDir, gitAuth, commitOpts, "updating to the live state of the cluster")
+		if err != nil {
+			failDrift(events.CodeGit, err)
+		}
+		url, err := github.OpenPullRequest(cmd.Context(), clusterDir, gitAuth, commitOpts, "gokp: live state of cluster "+clusterName)
+		if err != nil {
+			failDrift(events.CodeGit, err)
+		}
+
+		log.Info("Opened pull request with the live state: " + url)
+	},
+}
+
+// driftClusterDir returns the dir of the cluster in the checkout of the repo. Without a path it's where the
+// installer puts it, the root of the repo or clusters/<cluster-name> for fleet repos.
+func driftClusterDir(repoDir string, repoPath string, clusterName string) (string, error) {
+	if repoPath != "" {
+		clusterDir := repoDir + "/" + strings.Trim(repoPath, "/")
+		if _, err := os.Stat(clusterDir + "/cluster"); err != nil {
+			return "", errors.New("no cluster directory in " + clusterDir + ", check --git-path")
+		}
+		return clusterDir, nil
+	}
+
+	for _, clusterDir := range []string{repoDir, repoDir + "/clusters/" + clusterName} {
+		if _, err := os.Stat(clusterDir + "/cluster"); err == nil {
+			return clusterDir, nil
+		}
+	}
+
+	return "", errors.New("no cluster directory in " + repoDir + " or its clusters/" + clusterName + ", set --git-path to where the cluster is in the repo")
+}
+
+func init() {
+	rootCmd.AddCommand(driftCmd)
+
+	// Define flags for drift
+	driftCmd.Flags().String("cluster-name", "", "Name of the gokp cluster.")
+	driftCmd.Flags().String("kubeconfig", "", "Path to the Kubeconfig file of the cluster. Defaults to the one in ~/.gokp/<cluster-name>.")
+	driftCmd.Flags().String("repo-dir", "", "Path to the checked out GitOps repo. Defaults to the one in ~/.gokp/<cluster-name>.")
+	driftCmd.Flags().String("git-path", "", "Path inside the repo the cluster is in. Defaults to the root of the repo, or clusters/<cluster-name> for fleet repos.")
+	driftCmd.Flags().String("gitops-controller", "argocd", "The GitOps Controller of the cluster.")
+	driftCmd.Flags().String("format", "text", "How to report the drift on stdout. Either text or json. Use --output for how progress is reported.")
+	driftCmd.Flags().BoolP("pull", "", true, "Pull --git-branch before comparing. Fails if the repo has local changes.")
+	driftCmd.Flags().BoolP("commit", "", false, "Write the live state to the repo and open a pull request for it.")
+	addExportFlags(driftCmd)
+	addGitCommitFlags(driftCmd)
+	addGitAuthFlags(driftCmd)
+
+	// required flags
+	driftCmd.MarkFlagRequired("cluster-name")
+}
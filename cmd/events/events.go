@@ -0,0 +1,168 @@
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The types of events
+const (
+	StepStarted     = "step_started"
+	StepFinished    = "step_finished"
+	ResourceWaiting = "resource_waiting"
+	Error           = "error"
+	Result          = "result"
+)
+
+// The error codes, so what drives gokp can tell failures apart without parsing messages
+const (
+	CodeInvalidInput  = "invalid_input"
+	CodePrerequisites = "prerequisites"
+	CodeCluster       = "cluster"
+	CodeGit           = "git"
+	CodeGitOps        = "gitops"
+	CodeExport        = "export"
+	CodeFilesystem    = "filesystem"
+	CodeCanceled      = "canceled"
+)
+
+// Event is something that happened while gokp was running
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Step     string    `json:"step,omitempty"`
+	Message  string    `json:"message,omitempty"`
+	Resource string    `json:"resource,omitempty"`
+	Status   string    `json:"status,omitempty"`
+	Code     string    `json:"code,omitempty"`
+
+	// Duration is how long the step took, in seconds
+	Duration float64 `json:"duration,omitempty"`
+
+	// Cluster is the installed cluster, only set on the result
+	Cluster *ClusterResult `json:"cluster,omitempty"`
+}
+
+// ClusterResult is what a create leaves behind
+type ClusterResult struct {
+	Name              string `json:"name"`
+	Provider          string `json:"provider"`
+	KubernetesVersion string `json:"kubernetesVersion"`
+	GitOpsController  string `json:"gitOpsController"`
+	RepoURL           string `json:"repoURL"`
+	RepoPath          string `json:"repoPath,omitempty"`
+	Branch            string `json:"branch"`
+	KubeconfigPath    string `json:"kubeconfigPath"`
+	ArtifactsDir      string `json:"artifactsDir"`
+}
+
+// Publisher gets every event
+type Publisher interface {
+	Publish(event Event)
+}
+
+// publisher is where the events go, logging them until told otherwise
+var publisher Publisher = LogPublisher{}
+var publisherLock sync.Mutex
+
+// SetPublisher sends the events to the publisher from now on
+func SetPublisher(p Publisher) {
+	publisherLock.Lock()
+	defer publisherLock.Unlock()
+	publisher = p
+}
+
+// Publish stamps the event with the time, if it doesn't have one, and publishes it
+func Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	publisherLock.Lock()
+	defer publisherLock.Unlock()
+	publisher.Publish(event)
+}
+
+// Step is a step of the pipeline that's running
+type Step struct {
+	name    string
+	started time.Time
+}
+
+// StartStep publishes that the step started
+func StartStep(name string, message string) *Step {
+	s := &Step{name: name, started: time.Now()}
+	Publish(Event{Type: StepStarted, Time: s.started, Step: name, Message: message})
+
+	return s
+}
+
+// Finish publishes that the step finished, along with how long it took
+func (s *Step) Finish() {
+	Publish(Event{Type: StepFinished, Step: s.name, Duration: time.Since(s.started).Seconds()})
+}
+
+// Fail publishes the error the step failed with
+func (s *Step) Fail(code string, err error) {
+	Publish(Event{Type: Error, Step: s.name, Code: code, Message: err.Error()})
+}
+
+// Fail publishes an error that didn't happen in a step
+func Fail(code string, err error) {
+	Publish(Event{Type: Error, Code: code, Message: err.Error()})
+}
+
+// Waiting publishes where a wait on a resource is at
+func Waiting(resource string, status string) {
+	Publish(Event{Type: ResourceWaiting, Resource: resource, Status: status})
+}
+
+// Done publishes the result of a create
+func Done(cluster ClusterResult) {
+	Publish(Event{Type: Result, Message: "Cluster Successfully installed!", Cluster: &cluster})
+}
+
+// LogPublisher logs the events for people to read
+type LogPublisher struct{}
+
+// Publish logs the event
+func (LogPublisher) Publish(event Event) {
+	switch event.Type {
+	case StepStarted:
+		log.Info(event.Message)
+	case StepFinished:
+		log.Debug("Finished ", event.Step, " in ", time.Duration(event.Duration*float64(time.Second)).Round(time.Second))
+	case ResourceWaiting:
+		log.Info(event.Resource + ": " + event.Status)
+	case Error:
+		log.Error(event.Message)
+	case Result:
+		log.Info(event.Message + " Everything you need is under: " + event.Cluster.ArtifactsDir)
+		log.Info("Kubeconfig: " + event.Cluster.KubeconfigPath)
+		log.Info("GitOps repo: " + event.Cluster.RepoURL)
+	default:
+		log.Info(event.Message)
+	}
+}
+
+// JSONPublisher writes every event as a line of JSON, for machines to read
+type JSONPublisher struct {
+	encoder *json.Encoder
+}
+
+// NewJSONPublisher returns a publisher writing to w
+func NewJSONPublisher(w io.Writer) *JSONPublisher {
+	return &JSONPublisher{encoder: json.NewEncoder(w)}
+}
+
+// Publish writes the event
+func (p *JSONPublisher) Publish(event Event) {
+	err := p.encoder.Encode(event)
+	if err != nil {
+		log.Warn("Unable to write event: ", err)
+	}
+}
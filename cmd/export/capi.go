@@ -0,0 +1,230 @@
+package export
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer/json"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// capiDir is where the CAPI objects go, relative to the cluster dir
+var capiDir = "cluster/capi"
+
+// capiGroupSuffix is the suffix of the Cluster API groups, the providers' ones included
+var capiGroupSuffix = "cluster.x-k8s.io"
+
+// capiSkippedGroups are about the management cluster rather than the cluster itself, clusterctl manages them
+var capiSkippedGroups = []string{
+	"clusterctl.cluster.x-k8s.io",
+}
+
+// capiGeneratedKinds are created by the CAPI controllers from the exported objects
+var capiGeneratedKinds = []string{
+	"Machine",
+	"MachineSet",
+	"ClusterResourceSetBinding",
+}
+
+// capiAnnotations are set by the CAPI controllers and clusterctl move.
+// Entries ending in / drop every annotation with that prefix.
+var capiAnnotations = []string{
+	"cluster.x-k8s.io/paused",
+	"machinedeployment.clusters.x-k8s.io/",
+}
+
+// ExportCapiYaml exports the Cluster API objects that define the cluster into cluster/capi of the directory.
+// It's meant for self managed clusters, once the objects were moved into the cluster. Objects the CAPI
+// controllers create from the exported ones are left out, and so are their owner references and status.
+func ExportCapiYaml(ctx context.Context, capicfg string, repodir string, gitOpsController string, opts *Options) (bool, error) {
+	client, err := newClient(capicfg)
+	if err != nil {
+		return false, err
+	}
+
+	dynamicClient, err := newDynamicClient(capicfg, opts.workers())
+	if err != nil {
+		return false, err
+	}
+
+	return exportCapi(ctx, client, dynamicClient, repodir, gitOpsController)
+}
+
+// exportCapi exports the CAPI objects of the cluster behind the clients into the directory
+func exportCapi(ctx context.Context, client kubernetes.Interface, dynamicClient dynamic.Interface, repodir string, gitOpsController string) (bool, error) {
+	e := json.NewYAMLSerializer(json.DefaultMetaFactory, nil, nil)
+
+	// Find the CAPI resources, cluster scoped ones first
+	resources := []GroupResource{}
+	for _, namespaced := range []bool{false, true} {
+		apiResources, err := getApiResources(client, namespaced)
+		if err != nil {
+			return false, err
+		}
+		for _, gr := range apiResources {
+			if isCapiResource(gr) {
+				resources = append(resources, gr)
+			}
+		}
+	}
+	if len(resources) == 0 {
+		return false, errors.New("no Cluster API resources found, the cluster doesn't manage itself")
+	}
+
+	// Everything goes in one dir, so the namespace is part of the file names
+	dir := repodir + "/" + capiDir
+	namer := newFileNamer(resources)
+	written := newExportedFiles()
+	for _, gr := range resources {
+		objects, err := listObjects(ctx, dynamicClient, gr)
+		if err != nil {
+			return false, err
+		}
+
+		for i := range objects {
+			obj := &objects[i]
+			if !sanitizeCapiObject(obj) {
+				continue
+			}
+
+			// Argo CD syncs what an object refers to before the object
+			if gitOpsController == "argocd" {
+				annotations := obj.GetAnnotations()
+				if annotations == nil {
+					annotations = map[string]string{}
+				}
+				annotations["argocd.argoproj.io/sync-wave"] = capiSyncWave(obj.GroupVersionKind().GroupKind())
+				obj.SetAnnotations(annotations)
+			}
+
+			content, err := encodeObject(obj, e)
+			if err != nil {
+				return false, err
+			}
+			err = written.write(exportedFile{
+				path:    dir + "/" + namer.fileName(gr, obj, gr.APIResource.Namespaced) + ".yaml",
+				object:  objectRef(gr, obj),
+				content: content,
+			})
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	capiYamls := written.yamlFiles(dir)
+	if len(capiYamls) == 0 {
+		return false, errors.New("no Cluster API objects found to export")
+	}
+	log.Info("Exported ", len(capiYamls), " CAPI objects")
+
+	// The kustomization keeps the GitOps controller from pruning them
+	ckf := struct {
+		CapiYamls        []string
+		GitOpsController string
+	}{
+		CapiYamls:        capiYamls,
+		GitOpsController: gitOpsController,
+	}
+	_, err := WriteTemplateWithFunc(CapiKustomizeFile, dir+"/kustomization.yaml", ckf, FuncMap)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// isCapiResource returns true if the API resource is one of Cluster API or its providers
+func isCapiResource(gr GroupResource) bool {
+	if !strings.HasSuffix(gr.APIGroup, capiGroupSuffix) || containsString(capiSkippedGroups, gr.APIGroup) {
+		return false
+	}
+
+	return !containsString(capiGeneratedKinds, gr.APIResource.Kind)
+}
+
+// listObjects lists every object of the API resource, a page at a time
+func listObjects(ctx context.Context, client dynamic.Interface, gr GroupResource) ([]unstructured.Unstructured, error) {
+	resource := client.Resource(schema.GroupVersionResource{Group: gr.APIGroup, Resource: gr.APIResource.Name, Version: gr.APIVersion})
+
+	objects := []unstructured.Unstructured{}
+	listOptions := metav1.ListOptions{Limit: exportPageSize}
+	for {
+		list, err := resource.List(ctx, listOptions)
+
+		// Start over if the list changed too much while paging through it
+		if apierrors.IsResourceExpired(err) && listOptions.Continue != "" {
+			log.Warn("Listing ", gr.APIResource.Name, " expired, starting over")
+			objects = []unstructured.Unstructured{}
+			listOptions.Continue = ""
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, list.Items...)
+
+		listOptions.Continue = list.GetContinue()
+		if listOptions.Continue == "" {
+			return objects, nil
+		}
+	}
+}
+
+// sanitizeCapiObject cleans up the CAPI object so it can be applied to a new management cluster.
+// It returns false for objects a CAPI controller created.
+func sanitizeCapiObject(obj *unstructured.Unstructured) bool {
+	// Machines, their bootstrap configs and infrastructure are made by the controllers
+	if metav1.GetControllerOf(obj) != nil {
+		return false
+	}
+
+	cleanMetadata(obj)
+	dropStatus(obj)
+
+	// The controllers set the owners again, with the new UIDs
+	obj.SetOwnerReferences(nil)
+
+	annotations := map[string]string{}
+	for key, value := range CleanAnnotations(obj.GetAnnotations()) {
+		if !matchesKey(capiAnnotations, key) {
+			annotations[key] = value
+		}
+	}
+	if len(annotations) == 0 {
+		unstructured.RemoveNestedField(obj.Object, "metadata", "annotations")
+	} else {
+		obj.SetAnnotations(annotations)
+	}
+
+	// The Cluster gets its endpoint from the infrastructure cluster
+	if obj.GroupVersionKind().GroupKind() == (schema.GroupKind{Group: "cluster.x-k8s.io", Kind: "Cluster"}) {
+		unstructured.RemoveNestedField(obj.Object, "spec", "controlPlaneEndpoint")
+	}
+
+	return true
+}
+
+// capiSyncWave returns the Argo CD sync wave of the CAPI kind. Templates and configs go first, then the
+// infrastructure cluster and control plane, then the Cluster, and the machines last.
+func capiSyncWave(gk schema.GroupKind) string {
+	switch {
+	case gk.Group == "cluster.x-k8s.io" && gk.Kind == "Cluster":
+		return "2"
+	case gk.Group == "cluster.x-k8s.io" && (gk.Kind == "MachineDeployment" || gk.Kind == "MachinePool" || gk.Kind == "MachineHealthCheck"):
+		return "3"
+	case strings.HasPrefix(gk.Group, "controlplane."):
+		return "1"
+	case strings.HasPrefix(gk.Group, "infrastructure.") && strings.HasSuffix(gk.Kind, "Cluster"):
+		return "1"
+	}
+
+	return "0"
+}
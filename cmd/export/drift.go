@@ -0,0 +1,601 @@
+package export
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/christianh814/gokp/cmd/utils"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+// gitOpsLabels and gitOpsAnnotations are set on live objects by the GitOps controllers, or by the kustomizations
+// they apply. They're ignored unless the repo has them too. Entries ending in / match every key with that prefix.
+var gitOpsLabels = []string{
+	"app.kubernetes.io/instance",
+	"kustomize.toolkit.fluxcd.io/",
+}
+var gitOpsAnnotations = []string{
+	"argocd.argoproj.io/",
+	"kustomize.toolkit.fluxcd.io/",
+}
+
+// trackingLabels and trackingAnnotations are what the GitOps controllers track the objects they apply by.
+// Generic labels like app.kubernetes.io/instance are set by Helm and others too, so they don't count.
+var trackingLabels = []string{
+	"argocd.argoproj.io/instance",
+	"kustomize.toolkit.fluxcd.io/name",
+}
+var trackingAnnotations = []string{
+	"argocd.argoproj.io/tracking-id",
+}
+
+// driftDirs are the dirs of the cluster dir the exporter writes to, everything else in the repo is left alone
+var driftDirs = []string{"cluster/core", "cluster/apps", capiDir}
+
+// ExportedDirs returns the dirs of the cluster dir an earlier export wrote to
+func ExportedDirs(dir string) []string {
+	found := []string{}
+	for _, driftDir := range driftDirs {
+		if _, err := os.Stat(dir + "/" + driftDir); err == nil {
+			found = append(found, dir+"/"+driftDir)
+		}
+	}
+
+	return found
+}
+
+// RemoveExport removes what an earlier export wrote to the cluster dir, the rest of it is left alone
+func RemoveExport(dir string) error {
+	for _, exported := range ExportedDirs(dir) {
+		err := os.RemoveAll(exported)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DriftReport is how the live cluster differs from its GitOps repo
+type DriftReport struct {
+	// Added are live objects the repo doesn't have
+	Added []DriftObject `json:"added"`
+
+	// Removed are objects in the repo the cluster doesn't have
+	Removed []DriftObject `json:"removed"`
+
+	// Changed are objects that differ between the repo and the cluster
+	Changed []DriftObject `json:"changed"`
+}
+
+// DriftObject is an object that was added, removed or changed
+type DriftObject struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+
+	// File is where the object is in the repo, or where it would be exported to, relative to the cluster dir
+	File string `json:"file"`
+
+	// Fields are the fields that differ, for changed objects
+	Fields []FieldDrift `json:"fields,omitempty"`
+
+	// exported is true if File is the file the object is exported to, so it can be rewritten as a whole
+	exported bool
+
+	// alone is true if the object is the only one in File
+	alone bool
+}
+
+// FieldDrift is a field that differs between the repo and the live cluster. A missing value means the field isn't set.
+type FieldDrift struct {
+	Path string      `json:"path"`
+	Repo interface{} `json:"repo,omitempty"`
+	Live interface{} `json:"live,omitempty"`
+}
+
+// manifestObject is an object read from a YAML file in a cluster dir
+type manifestObject struct {
+	file  string
+	obj   *unstructured.Unstructured
+	alone bool
+}
+
+// DetectDrift compares the objects in the GitOps repo with the ones exported from the live cluster, both given as
+// the dir the cluster lives in. Only the dirs the exporter writes to are compared, and only the kinds the secret
+// policy exports. Objects in the file the exporter writes them to are compared in full. Objects the repo has
+// somewhere else, like install manifests, are only compared on the fields the repo sets. Live objects the GitOps
+// controller manages but the repo doesn't have come from remote bases, so they aren't reported.
+func DetectDrift(repoDir string, liveDir string, secrets *SecretPolicy) (*DriftReport, error) {
+	repoObjects, err := readManifests(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	liveObjects, err := readManifests(liveDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Go through the objects in order so the report is always the same
+	keys := []string{}
+	for key := range repoObjects {
+		keys = append(keys, key)
+	}
+	for key := range liveObjects {
+		if _, ok := repoObjects[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	report := &DriftReport{Added: []DriftObject{}, Removed: []DriftObject{}, Changed: []DriftObject{}}
+	for _, key := range keys {
+		repo, inRepo := repoObjects[key]
+		live, isLive := liveObjects[key]
+
+		// What isn't exported can't be compared, it would look removed
+		obj := live
+		if inRepo {
+			obj = repo
+		}
+		if !secrets.exports(obj.obj) {
+			continue
+		}
+
+		switch {
+		case !inRepo:
+			if managedByGitOps(live.obj) {
+				continue
+			}
+			report.Added = append(report.Added, newDriftObject(live, true))
+		case !isLive:
+			report.Removed = append(report.Removed, newDriftObject(repo, repo.alone))
+		default:
+			exported := repo.file == live.file
+			fields := []FieldDrift{}
+			diffFields("", comparableObject(repo.obj, nil), comparableObject(live.obj, repo.obj), !exported, &fields)
+			if len(fields) == 0 {
+				continue
+			}
+			changed := newDriftObject(repo, exported)
+			changed.Fields = fields
+			report.Changed = append(report.Changed, changed)
+		}
+	}
+
+	return report, nil
+}
+
+// Empty returns true if the cluster matches the repo
+func (r *DriftReport) Empty() bool {
+	return len(r.Added) == 0 && len(r.Removed) == 0 && len(r.Changed) == 0
+}
+
+// Text returns the report the way people read it, one line per object with the changed fields under it
+func (r *DriftReport) Text() string {
+	if r.Empty() {
+		return "No drift, the cluster matches the repo\n"
+	}
+
+	text := strconv.Itoa(len(r.Added)) + " added, " + strconv.Itoa(len(r.Removed)) + " removed, " + strconv.Itoa(len(r.Changed)) + " changed\n"
+	for _, o := range r.Added {
+		text += "+ " + o.ref() + " (" + o.File + ")\n"
+	}
+	for _, o := range r.Removed {
+		text += "- " + o.ref() + " (" + o.File + ")\n"
+	}
+	for _, o := range r.Changed {
+		text += "~ " + o.ref() + " (" + o.File + ")\n"
+		for _, field := range o.Fields {
+			text += "    " + field.Path + ": " + driftValue(field.Repo) + " -> " + driftValue(field.Live) + "\n"
+		}
+	}
+
+	return text
+}
+
+// Apply writes the live state of the cluster, exported to liveDir, into the repo. Added objects and changed ones
+// in the file they're exported to are written as exported. Removed objects have their file deleted if they're
+// the only thing in it. Anything else is left alone, since it can't be rewritten without losing what's around it.
+// The kustomizations of the dirs are updated to match.
+func (r *DriftReport) Apply(repoDir string, liveDir string) error {
+	added := map[string][]string{}
+	removed := map[string][]string{}
+
+	write := append(append([]DriftObject{}, r.Added...), r.Changed...)
+	for i, o := range write {
+		if !o.exported {
+			log.Warn("Not updating ", o.ref(), ", it's not in the file it's exported to: ", o.File)
+			continue
+		}
+
+		// Don't overwrite something else that happens to have the same name
+		if _, err := os.Stat(repoDir + "/" + o.File); i < len(r.Added) && err == nil {
+			log.Warn("Not adding ", o.ref(), ", the repo already has something else in: ", o.File)
+			continue
+		}
+
+		dir, name := filepath.Split(o.File)
+		err := os.MkdirAll(repoDir+"/"+dir, 0755)
+		if err != nil {
+			return err
+		}
+		err = utils.CopyFile(liveDir+"/"+o.File, repoDir+"/"+o.File)
+		if err != nil {
+			return err
+		}
+		added[dir] = append(added[dir], name)
+	}
+
+	for _, o := range r.Removed {
+		if !o.alone {
+			log.Warn("Not removing ", o.ref(), ", there's more in its file: ", o.File)
+			continue
+		}
+
+		dir, name := filepath.Split(o.File)
+		err := os.Remove(repoDir + "/" + o.File)
+		if err != nil {
+			return err
+		}
+		removed[dir] = append(removed[dir], name)
+	}
+
+	dirs := []string{}
+	for dir := range added {
+		dirs = append(dirs, dir)
+	}
+	for dir := range removed {
+		if _, ok := added[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		err := updateKustomization(repoDir+"/"+dir, liveDir+"/"+dir, added[dir], removed[dir])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateKustomization adds and removes the files from the resources of the kustomization in the repo dir.
+// If the dir doesn't have one yet, the one the exporter wrote is used for everything but the resources.
+func updateKustomization(repoDir string, liveDir string, added []string, removed []string) error {
+	file := repoDir + "/kustomization.yaml"
+	content, err := ioutil.ReadFile(file)
+	fresh := os.IsNotExist(err)
+	if fresh {
+		content, err = ioutil.ReadFile(liveDir + "/kustomization.yaml")
+	}
+	if err != nil {
+		return err
+	}
+
+	kustomization := map[string]interface{}{}
+	err = yaml.Unmarshal(content, &kustomization)
+	if err != nil {
+		return errors.New("unable to read " + file + ": " + err.Error())
+	}
+
+	// Keep the resources that are still there
+	resources := []string{}
+	if !fresh {
+		list, _ := kustomization["resources"].([]interface{})
+		for _, resource := range list {
+			name, _ := resource.(string)
+			if !containsString(removed, name) {
+				resources = append(resources, name)
+			}
+		}
+	}
+	sorted := sort.StringsAreSorted(resources)
+
+	// Only YAML files are applied, redacted Secrets aren't
+	for _, name := range added {
+		if strings.HasSuffix(name, ".yaml") && !containsString(resources, name) {
+			resources = append(resources, name)
+		}
+	}
+	if sorted {
+		sort.Strings(resources)
+	}
+	kustomization["resources"] = resources
+
+	content, err = yaml.Marshal(kustomization)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, content, 0644)
+}
+
+// readManifests reads every object in the YAML files of the drift dirs of the cluster dir, keyed by group, kind,
+// namespace and name. Kustomizations aren't objects, so they're skipped.
+func readManifests(dir string) (map[string]*manifestObject, error) {
+	objects := map[string]*manifestObject{}
+	for _, driftDir := range driftDirs {
+		err := readManifestDir(dir, dir+"/"+driftDir, objects)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return objects, nil
+}
+
+// readManifestDir reads the objects in the YAML files under the dir into objects, by their file relative to clusterDir
+func readManifestDir(clusterDir string, dir string, objects map[string]*manifestObject) error {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isManifest(info.Name()) {
+			return nil
+		}
+
+		file, err := filepath.Rel(clusterDir, path)
+		if err != nil {
+			return err
+		}
+		found, err := readManifestFile(path)
+		if err != nil {
+			return errors.New("unable to read " + path + ": " + err.Error())
+		}
+
+		for _, obj := range found {
+			key := manifestKey(obj)
+			if _, ok := objects[key]; ok {
+				log.Warn("Found ", key, " more than once, using the first one")
+				continue
+			}
+			objects[key] = &manifestObject{file: filepath.ToSlash(file), obj: obj, alone: len(found) == 1}
+		}
+
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// readManifestFile returns the objects in the YAML file, which can have more than one document
+func readManifestFile(path string) ([]*unstructured.Unstructured, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	objects := []*unstructured.Unstructured{}
+	decoder := utilyaml.NewYAMLOrJSONDecoder(f, 4096)
+	for {
+		doc := map[string]interface{}{}
+		err = decoder.Decode(&doc)
+		if err == io.EOF {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Skip empty documents and anything that isn't an object
+		obj := &unstructured.Unstructured{Object: doc}
+		if obj.GetKind() == "" || obj.GetName() == "" {
+			continue
+		}
+		objects = append(objects, obj)
+	}
+}
+
+// isManifest returns true if the file holds objects to compare
+func isManifest(name string) bool {
+	if name == "kustomization.yaml" || name == "kustomization.yml" {
+		return false
+	}
+
+	return strings.HasSuffix(name, ".yaml") || strings.HasSuffix(name, ".yml") || strings.HasSuffix(name, ".yaml.redacted")
+}
+
+// manifestKey identifies the object regardless of the version it's written in
+func manifestKey(obj *unstructured.Unstructured) string {
+	gv, _ := schema.ParseGroupVersion(obj.GetAPIVersion())
+
+	return gv.Group + "/" + obj.GetKind() + "/" + obj.GetNamespace() + "/" + obj.GetName()
+}
+
+// managedByGitOps returns true if a GitOps controller tracks the object as one it applied
+func managedByGitOps(obj *unstructured.Unstructured) bool {
+	for key := range obj.GetLabels() {
+		if matchesKey(trackingLabels, key) {
+			return true
+		}
+	}
+	for key := range obj.GetAnnotations() {
+		if matchesKey(trackingAnnotations, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// comparableObject returns the object the way it should be compared. The values of encrypted Secrets are hidden,
+// since they're encrypted with a new key on every export, only their keys are compared. For live objects, the
+// GitOps metadata the repo object doesn't have is dropped.
+func comparableObject(obj *unstructured.Unstructured, repo *unstructured.Unstructured) map[string]interface{} {
+	c := obj.DeepCopy()
+
+	if _, sops := c.Object["sops"]; sops {
+		delete(c.Object, "sops")
+		hideValues(c.Object, "data")
+		hideValues(c.Object, "stringData")
+	}
+	if c.GetKind() == "SealedSecret" {
+		hideValues(c.Object, "spec", "encryptedData")
+	}
+
+	if repo != nil {
+		c.SetLabels(dropGitOpsKeys(c.GetLabels(), repo.GetLabels(), gitOpsLabels))
+		c.SetAnnotations(dropGitOpsKeys(c.GetAnnotations(), repo.GetAnnotations(), gitOpsAnnotations))
+	}
+
+	return c.Object
+}
+
+// hideValues replaces the values of the map at the path with empty strings, keeping the keys
+func hideValues(obj map[string]interface{}, fields ...string) {
+	values, found, _ := unstructured.NestedMap(obj, fields...)
+	if !found {
+		return
+	}
+	for key := range values {
+		values[key] = ""
+	}
+	unstructured.SetNestedMap(obj, values, fields...)
+}
+
+// dropGitOpsKeys returns the live labels or annotations without the GitOps ones the repo doesn't have
+func dropGitOpsKeys(live map[string]string, repo map[string]string, gitOpsKeys []string) map[string]string {
+	kept := map[string]string{}
+	for key, value := range live {
+		if _, inRepo := repo[key]; !inRepo && matchesKey(gitOpsKeys, key) {
+			continue
+		}
+		kept[key] = value
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+
+	return kept
+}
+
+// matchesKey returns true if the key is one of the keys, or starts with one of them ending in /
+func matchesKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if key == k || (strings.HasSuffix(k, "/") && strings.HasPrefix(key, k)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// diffFields adds the fields that differ between the repo and the live value under the path. With subset,
+// only the fields the repo sets are compared, so defaults filled in by the API server don't show up.
+func diffFields(path string, repo interface{}, live interface{}, subset bool, fields *[]FieldDrift) {
+	switch r := repo.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := []string{}
+		for key := range r {
+			keys = append(keys, key)
+		}
+		if !subset {
+			for key := range l {
+				if _, ok := r[key]; !ok {
+					keys = append(keys, key)
+				}
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			diffFields(fieldPath(path, key), r[key], l[key], subset, fields)
+		}
+		return
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(r) {
+			break
+		}
+
+		for i := range r {
+			diffFields(path+"["+strconv.Itoa(i)+"]", r[i], l[i], subset, fields)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(repo, live) {
+		*fields = append(*fields, FieldDrift{Path: path, Repo: repo, Live: live})
+	}
+}
+
+// fieldPath adds the key to the path, quoting keys with dots like the ones of labels
+func fieldPath(path string, key string) string {
+	if strings.ContainsAny(key, "./") {
+		return path + "[" + strconv.Quote(key) + "]"
+	}
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+// driftValue returns the value of a field the way it's shown in the text report
+func driftValue(value interface{}) string {
+	if value == nil {
+		return "<unset>"
+	}
+	content, err := json.Marshal(value)
+	if err != nil {
+		return "<unknown>"
+	}
+
+	return string(content)
+}
+
+// newDriftObject returns the DriftObject for the object read from a manifest
+func newDriftObject(m *manifestObject, exported bool) DriftObject {
+	return DriftObject{
+		APIVersion: m.obj.GetAPIVersion(),
+		Kind:       m.obj.GetKind(),
+		Namespace:  m.obj.GetNamespace(),
+		Name:       m.obj.GetName(),
+		File:       m.file,
+		exported:   exported,
+		alone:      m.alone,
+	}
+}
+
+// ref describes the object in messages, like <kind> [<namespace>/]<name>
+func (o *DriftObject) ref() string {
+	if o.Namespace != "" {
+		return o.Kind + " " + o.Namespace + "/" + o.Name
+	}
+
+	return o.Kind + " " + o.Name
+}
+
+// containsString returns true if the value is in the list
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
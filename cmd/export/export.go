@@ -1,14 +1,16 @@
 package export
 
 import (
+	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"html/template"
 	"os"
 	"path/filepath"
-	"strings"
 
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -24,8 +26,63 @@ var FuncMap = template.FuncMap{
 	"Myfp": Myfp,
 }
 
-// ExportClusterYaml exports the given clusters YAML into the directory
-func ExportClusterYaml(capicfg string, repodir string, gitOpsController string) (bool, error) {
+// exportPageSize is how many objects are listed at once
+var exportPageSize int64 = 500
+
+// defaultWorkers is how many resource types are exported at once when Options.Workers isn't set
+var defaultWorkers = 8
+
+// Options holds what gets exported and how
+type Options struct {
+	// Rules decide which resources are exported
+	Rules *Rules
+
+	// Secrets is how Secrets are written out
+	Secrets *SecretPolicy
+
+	// Workers is how many resource types are exported at once
+	Workers int
+
+	// Layout is how the files are laid out in dirs, see LayoutNamespace, LayoutApp and LayoutFlat
+	Layout string
+
+	// AppLabel is the label that names the app of an object with LayoutApp
+	AppLabel string
+}
+
+// workers returns how many resource types are exported at once
+func (o *Options) workers() int {
+	if o.Workers <= 0 {
+		return defaultWorkers
+	}
+
+	return o.Workers
+}
+
+// exportJob is a resource type to export
+type exportJob struct {
+	index int
+	gr    GroupResource
+}
+
+// exportedFile is a file to write for an exported object
+type exportedFile struct {
+	path    string
+	object  string
+	content []byte
+}
+
+// exportResult holds the files for a resource type, or why it couldn't be exported
+type exportResult struct {
+	index int
+	files []exportedFile
+	err   error
+}
+
+// ExportClusterYaml exports the given clusters YAML into the directory, the way the options say.
+// Each resource type is listed once, a page at a time, by a pool of workers. The files are written
+// in the order of the resource types so the result doesn't depend on which worker finishes first.
+func ExportClusterYaml(ctx context.Context, capicfg string, repodir string, gitOpsController string, opts *Options) (bool, error) {
 	/* repodir == workdir + clustername */
 
 	//Create client and dynamtic client
@@ -34,154 +91,109 @@ func ExportClusterYaml(capicfg string, repodir string, gitOpsController string)
 		return false, err
 	}
 
-	dynamicClient, err := newDynamicClient(capicfg)
+	dynamicClient, err := newDynamicClient(capicfg, opts.workers())
 	if err != nil {
 		return false, err
 	}
 
+	return exportCluster(ctx, client, dynamicClient, repodir, gitOpsController, opts)
+}
+
+// exportCluster exports the cluster behind the clients into the directory
+func exportCluster(ctx context.Context, client kubernetes.Interface, dynamicClient dynamic.Interface, repodir string, gitOpsController string, opts *Options) (bool, error) {
 	// Create a YAML serializer
 	e := json.NewYAMLSerializer(json.DefaultMetaFactory, nil, nil)
 
-	// First get the cluster scoped api resources
-	isNamespaced := false
-	clusterApiResouces, err := getApiResources(client, isNamespaced)
+	// Get the cluster scoped and namespaced api resources
+	clusterApiResouces, err := getApiResources(client, false)
 	if err != nil {
 		return false, err
 	}
-
-	// Loop through the cluster scoped API resources and export them to <repodir>/core/cluster dir
-	for _, car := range clusterApiResouces {
-		// Skip over things we won't or can't export
-		if car.APIResource.Name == "componentstatuses" ||
-			car.APIResource.Name == "namespaces" ||
-			car.APIResource.Name == "certificatesigningrequests" ||
-			car.APIResource.Name == "tokenreviews" ||
-			car.APIResource.Name == "selfsubjectaccessreviews" ||
-			car.APIResource.Name == "selfsubjectrulesreviews" ||
-			car.APIResource.Name == "subjectaccessreviews" ||
-			car.APIResource.Name == "ipamblocks" ||
-			car.APIResource.Name == "ipamhandles" ||
-			car.APIResource.Name == "ipamconfigs" ||
-			car.APIResource.Name == "podsecuritypolicies" {
-			continue
-		}
-		// export the yaml
-		_, err = exportClusterScopedYaml(dynamicClient, car, e, repodir+"/cluster"+"/core/cluster", "NOT-NAMESPACED")
-		if err != nil {
-			return false, err
-		}
-	}
-
-	// Create kustomize file based on the YAMLs created
-	dirGlob := repodir + "/cluster" + "/core/cluster/*.yaml"
-	clusterScopedYamlFiles, err := filepath.Glob(dirGlob)
+	namespacedApis, err := getApiResources(client, true)
 	if err != nil {
 		return false, err
 	}
 
-	// If there is no yaml files, error
-	if len(clusterScopedYamlFiles) == 0 {
-		return false, errors.New("no YAML Files found at: " + dirGlob)
-	}
-
-	// generate the kustomization.yaml file based on the template
-	cskf := struct {
-		ClusterScopedYamls []string
-		GitOpsController   string
-	}{
-		ClusterScopedYamls: clusterScopedYamlFiles,
-		GitOpsController:   gitOpsController,
-	}
-	_, err = WriteTemplateWithFunc(ClusterScopedKustomizeFile, repodir+"/cluster/core/cluster/kustomization.yaml", cskf, FuncMap)
-	if err != nil {
-		return false, err
+	// Cluster scoped resources go first, namespaces are written along with what's in them
+	jobs := []exportJob{}
+	for _, car := range clusterApiResouces {
+		if car.APIResource.Name == "namespaces" || opts.Rules.SkipsResource(car) {
+			continue
+		}
+		jobs = append(jobs, exportJob{index: len(jobs), gr: car})
 	}
-
-	// Second, export namespaced scoped api resources
-	isItNamespaced := true
-	namespacedApis, err := getApiResources(client, isItNamespaced)
-	if err != nil {
-		return false, err
+	clusterJobs := len(jobs)
+	for _, nc := range namespacedApis {
+		if opts.Rules.SkipsResource(nc) {
+			continue
+		}
+		jobs = append(jobs, exportJob{index: len(jobs), gr: nc})
 	}
 
-	namespaces, err := client.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
-	if err != nil {
-		return false, err
-	}
+	// Files are named the same way for every export of the cluster, and tracked so nothing overwrites anything
+	namer := newFileNamer(append(append([]GroupResource{}, clusterApiResouces...), namespacedApis...))
+	written := newExportedFiles()
 
-	// range through every namespace and extract the YAML
-	for _, ns := range namespaces.Items {
-		outdir := repodir + "/cluster/core/" + ns.Name
-		// Get each namespaced api component
-		for _, nc := range namespacedApis {
-			// get the namespace object for later writing to YAML
-			thens, err := client.CoreV1().Namespaces().Get(context.TODO(), ns.Name, metav1.GetOptions{})
-			if err != nil {
-				return false, err
-			}
-			thens.SetResourceVersion("")
-			thens.SetUID("")
-			thens.SetAnnotations(map[string]string{})
-			thens.CreationTimestamp.Reset()
-			thens.SetSelfLink("")
-			thens.SetManagedFields([]metav1.ManagedFieldsEntry{})
-			thens.SetFinalizers([]string{})
-			thens.SetOwnerReferences([]metav1.OwnerReference{})
-			thens.SetGeneration(0)
-			thens.Status.Reset()
-			addTypeInformationToObject(thens)
-			encodeNs := json.NewYAMLSerializer(json.DefaultMetaFactory, nil, nil)
-
-			// skip unneeded resources
-			if nc.APIResource.Name == "bindings" ||
-				nc.APIResource.Name == "pods" ||
-				nc.APIResource.Name == "endpoints" ||
-				nc.APIResource.Name == "replicasets" ||
-				nc.APIResource.Name == "localsubjectaccessreviews" ||
-				nc.APIResource.Name == "selfsubjectrulesreviews" ||
-				nc.APIResource.Name == "events" ||
-				nc.APIResource.Name == "endpointslices" {
+	// Write out the namespaces we export things from, skipping the ones the rules leave out entirely
+	namespaces := map[string]bool{}
+	if len(jobs) > clusterJobs {
+		nsList, err := listNamespaces(ctx, client)
+		if err != nil {
+			return false, err
+		}
+		for _, ns := range nsList {
+			if opts.Rules.SkipsNamespace(ns.Name) {
 				continue
 			}
-			// export every namespaced resource in the namespace
-			_, err = exportClusterScopedYaml(dynamicClient, nc, e, outdir, ns.Name)
-			if err != nil {
-				return false, err
-			}
+			namespaces[ns.Name] = true
 
-			// write out the namespace YAML
-			tnf, err := os.Create(outdir + "/namespace-" + ns.Name + ".yaml")
+			// The namespace goes along with what's in it
+			_, err = writeNamespace(ns, repodir+"/"+opts.objectDir(ns.Labels, ns.Name), e, written)
 			if err != nil {
 				return false, err
 			}
-			err = encodeNs.Encode(thens, tnf)
-			if err != nil {
-				return false, err
-			}
-			tnf.Close()
 		}
+	}
 
-		// Create kustomize file based on the YAMLs created
-		dirGlob := repodir + "/cluster" + "/core/" + ns.Name + "/*.yaml"
-		nsScopedYamlFiles, err := filepath.Glob(dirGlob)
+	// Export every resource type
+	err = runExportJobs(ctx, jobs, opts, written, func(ctx context.Context, job exportJob) ([]exportedFile, error) {
+		return exportResource(ctx, dynamicClient, job.gr, repodir, namespaces, namer, opts)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// Create a kustomize file in every dir based on the YAMLs created
+	for _, dir := range written.dirNames() {
+		yamlFiles := written.yamlFiles(dir)
+		if len(yamlFiles) == 0 {
+			continue
+		}
+		rel, err := filepath.Rel(repodir, dir)
 		if err != nil {
 			return false, err
 		}
 
-		// If there is no yaml files, error
-		if len(nsScopedYamlFiles) == 0 {
-			return false, errors.New("no YAML Files found at: " + dirGlob)
-		}
-
-		// generate the kustomization.yaml file based on the template
-		nskf := struct {
-			NsScopedYamls    []string
-			GitOpsController string
-		}{
-			NsScopedYamls:    nsScopedYamlFiles,
-			GitOpsController: gitOpsController,
+		// Dirs with a single namespace get the namespaced kustomize file, the rest can have anything in them
+		if namespaces[filepath.Base(rel)] && opts.namespaceDir(filepath.ToSlash(rel), filepath.Base(rel)) {
+			nskf := struct {
+				NsScopedYamls    []string
+				GitOpsController string
+			}{
+				NsScopedYamls:    yamlFiles,
+				GitOpsController: gitOpsController,
+			}
+			_, err = WriteTemplateWithFunc(NameSpacedScopedKustomizeFile, dir+"/kustomization.yaml", nskf, FuncMap)
+		} else {
+			cskf := struct {
+				ClusterScopedYamls []string
+				GitOpsController   string
+			}{
+				ClusterScopedYamls: yamlFiles,
+				GitOpsController:   gitOpsController,
+			}
+			_, err = WriteTemplateWithFunc(ClusterScopedKustomizeFile, dir+"/kustomization.yaml", cskf, FuncMap)
 		}
-		_, err = WriteTemplateWithFunc(NameSpacedScopedKustomizeFile, repodir+"/cluster/core/"+ns.Name+"/kustomization.yaml", nskf, FuncMap)
 		if err != nil {
 			return false, err
 		}
@@ -191,85 +203,234 @@ func ExportClusterYaml(capicfg string, repodir string, gitOpsController string)
 	return true, nil
 }
 
-// exportClusterScopedYaml exports all the cluster scoped yaml into the given directory
-func exportClusterScopedYaml(client dynamic.Interface, gr GroupResource, e *json.Serializer, dir string, ns string) (bool, error) {
-	//fmt.Printf(fmt.Sprintf("Querying for %s in %s group\n", gr.APIResource.Name, gr.APIGroupVersion))
-	//list, err := client.Resource(schema.GroupVersionResource{Group: gr.APIGroup, Resource: gr.APIResource.Name, Version: gr.APIGroupVersion}).List(context.TODO(), metav1.ListOptions{})
+// runExportJobs runs the jobs on a pool of workers and writes their files in the order of the jobs.
+// It stops at the first error, cancelling the exports that are still running.
+func runExportJobs(ctx context.Context, jobs []exportJob, opts *Options, written *exportedFiles, export func(ctx context.Context, job exportJob) ([]exportedFile, error)) error {
+	workers := opts.workers()
+
+	// Everything still running is cancelled once we return
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Hand out the jobs until we're done or something failed
+	queue := make(chan exportJob)
+	results := make(chan exportResult)
+	go func() {
+		defer close(queue)
+		for _, job := range jobs {
+			select {
+			case queue <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for job := range queue {
+				files, err := export(ctx, job)
+				select {
+				case results <- exportResult{index: job.index, files: files, err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
 
-	/* list, err = client.Resource(schema.GroupVersionResource{Group: gr.APIGroup, Resource: gr.APIResource.Name, Version: gr.APIVersion}).List(context.TODO(), metav1.ListOptions{}) */
+	// Results can come back in any order, hold on to them until it's their turn
+	pending := map[int]exportResult{}
+	next := 0
+	reported := 0
+	for next < len(jobs) {
+		var result exportResult
+		select {
+		case result = <-results:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if result.err != nil {
+			return result.err
+		}
+		pending[result.index] = result
 
-	// set up variables for the conditional to follow
-	var list *unstructured.UnstructuredList
-	var err error
+		for {
+			result, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+
+			for _, file := range result.files {
+				err := written.write(file)
+				if err != nil {
+					return err
+				}
+			}
+		}
 
-	// filter by namespace
-	if ns == "NOT-NAMESPACED" {
-		list, err = client.Resource(schema.GroupVersionResource{Group: gr.APIGroup, Resource: gr.APIResource.Name, Version: gr.APIVersion}).List(context.TODO(), metav1.ListOptions{})
-		if err != nil {
-			return false, err
+		// Report every 10% done
+		if done := next * 10 / len(jobs); done > reported {
+			reported = done
+			log.Info("Exported ", next, " of ", len(jobs), " resource types")
+		}
+	}
+
+	return nil
+}
+
+// exportResource lists every object of the resource type and returns the files to write for them.
+// Namespaced objects are only exported from the given namespaces.
+func exportResource(ctx context.Context, client dynamic.Interface, gr GroupResource, repodir string, namespaces map[string]bool, namer *fileNamer, opts *Options) ([]exportedFile, error) {
+	// Every worker has its own serializer
+	e := json.NewYAMLSerializer(json.DefaultMetaFactory, nil, nil)
+	resource := client.Resource(schema.GroupVersionResource{Group: gr.APIGroup, Resource: gr.APIResource.Name, Version: gr.APIVersion})
+
+	files := []exportedFile{}
+	listOptions := metav1.ListOptions{Limit: exportPageSize}
+	for {
+		list, err := resource.List(ctx, listOptions)
+
+		// Start over if the list changed too much while paging through it
+		if apierrors.IsResourceExpired(err) && listOptions.Continue != "" {
+			log.Warn("Listing ", gr.APIResource.Name, " expired, starting over")
+			files = []exportedFile{}
+			listOptions.Continue = ""
+			continue
 		}
-	} else {
-		list, err = client.Resource(schema.GroupVersionResource{Group: gr.APIGroup, Resource: gr.APIResource.Name, Version: gr.APIVersion}).List(context.TODO(), metav1.ListOptions{FieldSelector: "metadata.namespace=" + ns})
 		if err != nil {
-			return false, err
+			return nil, err
 		}
-	}
 
-	os.MkdirAll(dir, 0755)
+		for _, listItem := range list.Items {
+			namespace := ""
+			if gr.APIResource.Namespaced {
+				if !namespaces[listItem.GetNamespace()] {
+					continue
+				}
+				namespace = listItem.GetNamespace()
+			}
 
-	for _, listItem := range list.Items {
-		//listItem.SetGroupVersionKind(schema.GroupVersionKind{Group: gr.APIResource.Group, Kind: gr.APIResource.Kind, Version: gr.APIVersion})
-		listItem.SetGroupVersionKind(schema.GroupVersionKind{Group: gr.APIResource.Group, Kind: gr.APIResource.Kind, Version: gr.APIGroupVersion})
-		metadata := listItem.Object["metadata"].(map[string]interface{})
+			// The layout decides where the object goes. Outside of its namespace's dir, the namespace is part of the name
+			dir := opts.objectDir(listItem.GetLabels(), namespace)
+			withNamespace := namespace != "" && !opts.namespaceDir(dir, namespace)
 
-		itemName := listItem.GetName()
+			file, err := exportObject(listItem, gr, repodir+"/"+dir, withNamespace, e, namer, opts)
+			if err != nil {
+				return nil, err
+			}
+			if file != nil {
+				files = append(files, *file)
+			}
+		}
 
-		// We will skip certian objects as they are managed by something else
-		if strings.Contains(itemName, "bootstrap-token") ||
-			itemName == "cluster-info" ||
-			itemName == "calico-config" {
-			continue
+		listOptions.Continue = list.GetContinue()
+		if listOptions.Continue == "" {
+			return files, nil
 		}
+	}
+}
 
-		// "Generalize" YAML
-		delete(metadata, "resourceVersion")
-		delete(metadata, "uid")
-		delete(metadata, "annotations")
-		delete(metadata, "creationTimestamp")
-		delete(metadata, "selfLink")
-		delete(metadata, "managedFields")
-		delete(metadata, "finalizers")
-		delete(metadata, "ownerReferences")
-		delete(metadata, "generation")
-		delete(listItem.Object, "status")
-
-		// Removing because we're just skipping this now, but leaving it in as a comment because it's useful to know
-		/*
-			if listItem.GetName() == "cluster-info" {
-				listItem.SetAnnotations(map[string]string{"argocd.argoproj.io/compare-options": "IgnoreExtraneous"})
-			}
-		*/
+// exportObject returns the file to write for the object into the dir, or nil if it isn't exported
+func exportObject(listItem unstructured.Unstructured, gr GroupResource, dir string, withNamespace bool, e *json.Serializer, namer *fileNamer, opts *Options) (*exportedFile, error) {
+	//listItem.SetGroupVersionKind(schema.GroupVersionKind{Group: gr.APIResource.Group, Kind: gr.APIResource.Kind, Version: gr.APIVersion})
+	listItem.SetGroupVersionKind(schema.GroupVersionKind{Group: gr.APIResource.Group, Kind: gr.APIResource.Kind, Version: gr.APIGroupVersion})
 
-		obj := listItem.DeepCopyObject()
+	// We will skip certian objects as they are managed by something else
+	if opts.Rules.Excludes(gr, &listItem) {
+		return nil, nil
+	}
 
-		fileName := fmt.Sprintf("%s-%s", strings.ReplaceAll(strings.ToLower(listItem.GetKind()), ":", "-"), strings.ReplaceAll(strings.ToLower(listItem.GetName()), ":", "-"))
-		y, err := os.Create(dir + "/" + fileName + ".yaml")
-		if err != nil {
-			return false, err
+	// "Generalize" YAML, skipping objects that are generated or owned by something else
+	if !Sanitize(&listItem) {
+		return nil, nil
+	}
+
+	// Removing because we're just skipping this now, but leaving it in as a comment because it's useful to know
+	/*
+		if listItem.GetName() == "cluster-info" {
+			listItem.SetAnnotations(map[string]string{"argocd.argoproj.io/compare-options": "IgnoreExtraneous"})
 		}
-		defer y.Close()
+	*/
 
-		err = addTypeInformationToObject(obj)
-		if err != nil {
-			return false, err
+	fileName := namer.fileName(gr, &listItem, withNamespace)
+
+	// Secrets are never written as they are, the policy decides what to do with them
+	if listItem.GroupVersionKind().GroupKind() == secretGroupKind {
+		path, content, err := opts.Secrets.encodeSecret(&listItem, dir+"/"+fileName, e)
+		if err != nil || path == "" {
+			return nil, err
 		}
+		return &exportedFile{path: path, object: objectRef(gr, &listItem), content: content}, nil
+	}
+
+	content, err := encodeObject(&listItem, e)
+	if err != nil {
+		return nil, err
+	}
+
+	return &exportedFile{path: dir + "/" + fileName + ".yaml", object: objectRef(gr, &listItem), content: content}, nil
+}
+
+// encodeObject returns the object as YAML
+func encodeObject(obj runtime.Object, e *json.Serializer) ([]byte, error) {
+	err := addTypeInformationToObject(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	err = e.Encode(obj, &b)
+	if err != nil {
+		return nil, err
+	}
 
-		err = e.Encode(obj, y)
+	return b.Bytes(), nil
+}
+
+// listNamespaces lists every namespace, a page at a time
+func listNamespaces(ctx context.Context, client kubernetes.Interface) ([]corev1.Namespace, error) {
+	namespaces := []corev1.Namespace{}
+	listOptions := metav1.ListOptions{Limit: exportPageSize}
+	for {
+		list, err := client.CoreV1().Namespaces().List(ctx, listOptions)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
+		namespaces = append(namespaces, list.Items...)
 
+		listOptions.Continue = list.GetContinue()
+		if listOptions.Continue == "" {
+			return namespaces, nil
+		}
 	}
+}
+
+// writeNamespace writes the "generalized" namespace YAML into its dir
+func writeNamespace(ns corev1.Namespace, dir string, e *json.Serializer, written *exportedFiles) (bool, error) {
+	ns.SetResourceVersion("")
+	ns.SetUID("")
+	ns.SetAnnotations(CleanAnnotations(ns.GetAnnotations()))
+	ns.CreationTimestamp.Reset()
+	ns.SetSelfLink("")
+	ns.SetManagedFields([]metav1.ManagedFieldsEntry{})
+	ns.SetFinalizers([]string{})
+	ns.SetOwnerReferences([]metav1.OwnerReference{})
+	ns.SetGeneration(0)
+	ns.Status.Reset()
+
+	content, err := encodeObject(&ns, e)
+	if err != nil {
+		return false, err
+	}
+
+	err = written.write(exportedFile{path: dir + "/namespace-" + ns.Name + ".yaml", object: "Namespace " + ns.Name, content: content})
+	if err != nil {
+		return false, err
+	}
+
 	return true, nil
 }
 
@@ -304,13 +465,17 @@ func newClient(kubeConfigPath string) (kubernetes.Interface, error) {
 	return kubernetes.NewForConfig(kubeConfig)
 }
 
-// newDynamicClient returns a dyamnic kubernetes interface
-func newDynamicClient(kubeConfigPath string) (dynamic.Interface, error) {
+// newDynamicClient returns a dyamnic kubernetes interface, rate limited so the given number of workers can list at once
+func newDynamicClient(kubeConfigPath string, workers int) (dynamic.Interface, error) {
 	// build the dynamic client and return it
 	kubeConfig, err := clientcmd.BuildConfigFromFlags("", kubeConfigPath)
 	if err != nil {
 		return nil, err
 	}
+
+	// The client-go defaults would have the workers waiting on each other
+	kubeConfig.QPS = float32(5 * workers)
+	kubeConfig.Burst = 10 * workers
 	return dynamic.NewForConfig(kubeConfig)
 }
 
@@ -0,0 +1,346 @@
+package export
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// preferredDiscovery serves its resources as the preferred ones, the fake discovery doesn't
+type preferredDiscovery struct {
+	*fakediscovery.FakeDiscovery
+}
+
+func (d *preferredDiscovery) ServerPreferredResources() ([]*metav1.APIResourceList, error) {
+	return d.Resources, nil
+}
+
+// fakeClientset is a fake clientset with preferredDiscovery
+type fakeClientset struct {
+	*fake.Clientset
+	discovery *preferredDiscovery
+}
+
+func (c *fakeClientset) Discovery() discovery.DiscoveryInterface {
+	return c.discovery
+}
+
+// exportTestNamespaces are the namespaces of the test cluster
+var exportTestNamespaces = []string{"team-a", "team-b", "team-c"}
+
+// newExportTestCluster returns clients for a cluster with enough resource types and objects that the workers
+// finish in a different order than they start
+func newExportTestCluster() (kubernetes.Interface, *dynamicfake.FakeDynamicClient) {
+	// Like discovery, the group is only in the group version of the list
+	resources := []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "namespaces", Kind: "Namespace", Verbs: metav1.Verbs{"list"}},
+				{Name: "configmaps", Kind: "ConfigMap", Namespaced: true, Verbs: metav1.Verbs{"list"}},
+				{Name: "services", Kind: "Service", Namespaced: true, Verbs: metav1.Verbs{"list"}},
+			},
+		},
+		{
+			GroupVersion: "rbac.authorization.k8s.io/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "clusterroles", Kind: "ClusterRole", Verbs: metav1.Verbs{"list"}},
+			},
+		},
+	}
+
+	// Plenty of custom resource types so there's more jobs than workers
+	widgets := &metav1.APIResourceList{GroupVersion: "example.com/v1"}
+	for i := 0; i < 12; i++ {
+		widgets.APIResources = append(widgets.APIResources, metav1.APIResource{
+			Name:       fmt.Sprintf("widget%ds", i),
+			Kind:       fmt.Sprintf("Widget%d", i),
+			Namespaced: true,
+			Verbs:      metav1.Verbs{"list"},
+		})
+	}
+	resources = append(resources, widgets)
+
+	listKinds := map[schema.GroupVersionResource]string{
+		{Version: "v1", Resource: "configmaps"}:                                       "ConfigMapList",
+		{Version: "v1", Resource: "services"}:                                         "ServiceList",
+		{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"}: "ClusterRoleList",
+	}
+	objects := []runtime.Object{}
+	clientObjects := []runtime.Object{}
+	for _, ns := range exportTestNamespaces {
+		clientObjects = append(clientObjects, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns}})
+		for i := 0; i < 5; i++ {
+			labels := map[string]interface{}{}
+			if i%2 == 0 {
+				labels[defaultAppLabel] = fmt.Sprintf("app-%d", i)
+			}
+			objects = append(objects,
+				exportTestObject("v1", "ConfigMap", ns, fmt.Sprintf("config-%d", i), labels),
+				exportTestObject("v1", "Service", ns, fmt.Sprintf("service-%d", i), labels),
+			)
+		}
+		for _, widget := range widgets.APIResources {
+			listKinds[schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: widget.Name}] = widget.Kind + "List"
+			objects = append(objects, exportTestObject("example.com/v1", widget.Kind, ns, "my-"+widget.Name, map[string]interface{}{}))
+		}
+	}
+	for i := 0; i < 5; i++ {
+		objects = append(objects, exportTestObject("rbac.authorization.k8s.io/v1", "ClusterRole", "", fmt.Sprintf("role-%d", i), map[string]interface{}{}))
+	}
+
+	client := fake.NewSimpleClientset(clientObjects...)
+	client.Resources = resources
+	clientset := &fakeClientset{
+		Clientset: client,
+		discovery: &preferredDiscovery{FakeDiscovery: &fakediscovery.FakeDiscovery{Fake: &client.Fake}},
+	}
+
+	return clientset, dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+}
+
+// exportTestObject returns an object with the given labels
+func exportTestObject(apiVersion string, kind string, namespace string, name string, labels map[string]interface{}) *unstructured.Unstructured {
+	metadata := map[string]interface{}{
+		"name":   name,
+		"labels": labels,
+	}
+	if namespace != "" {
+		metadata["namespace"] = namespace
+	}
+
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+		"metadata":   metadata,
+		"data":       map[string]interface{}{"name": name},
+	}}
+}
+
+// readTree returns the contents of every file under the dir, by their path relative to it
+func readTree(t *testing.T, dir string) map[string]string {
+	tree := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		tree[filepath.ToSlash(rel)] = string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tree
+}
+
+func TestExportSameForAnyWorkers(t *testing.T) {
+	for _, layout := range []string{LayoutNamespace, LayoutApp, LayoutFlat} {
+		t.Run(layout, func(t *testing.T) {
+			trees := []map[string]string{}
+			for _, workers := range []int{1, 8} {
+				rules, err := LoadRules("")
+				if err != nil {
+					t.Fatal(err)
+				}
+				opts := &Options{Rules: rules, Secrets: &SecretPolicy{}, Workers: workers, Layout: layout}
+
+				client, dynamicClient := newExportTestCluster()
+				dir := t.TempDir()
+				_, err = exportCluster(context.Background(), client, dynamicClient, dir, "argocd", opts)
+				if err != nil {
+					t.Fatalf("%d workers: %v", workers, err)
+				}
+				trees = append(trees, readTree(t, dir))
+			}
+
+			serial, parallel := trees[0], trees[1]
+			if len(serial) == 0 {
+				t.Fatal("nothing was exported")
+			}
+			for path, content := range serial {
+				other, ok := parallel[path]
+				if !ok {
+					t.Errorf("%s was only exported by 1 worker", path)
+					continue
+				}
+				if other != content {
+					t.Errorf("%s differs between 1 and 8 workers:\n%s\n---\n%s", path, content, other)
+				}
+			}
+			for path := range parallel {
+				if _, ok := serial[path]; !ok {
+					t.Errorf("%s was only exported by 8 workers", path)
+				}
+			}
+		})
+	}
+}
+
+func TestRunExportJobsCancelsOnError(t *testing.T) {
+	jobs := []exportJob{}
+	for i := 0; i < 10; i++ {
+		jobs = append(jobs, exportJob{index: i})
+	}
+	failed := errors.New("list failed")
+
+	cancelled := make(chan struct{}, len(jobs))
+	done := make(chan error)
+	go func() {
+		done <- runExportJobs(context.Background(), jobs, &Options{Workers: 4}, newExportedFiles(), func(ctx context.Context, job exportJob) ([]exportedFile, error) {
+			if job.index == 0 {
+				return nil, failed
+			}
+
+			// The rest only finish once they're cancelled
+			<-ctx.Done()
+			cancelled <- struct{}{}
+			return nil, ctx.Err()
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err != failed {
+			t.Fatalf("got %v, want %v", err, failed)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("runExportJobs didn't return after a job failed")
+	}
+
+	// The jobs that were running when it failed were cancelled
+	select {
+	case <-cancelled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("running jobs weren't cancelled")
+	}
+}
+
+func TestRunExportJobsStopsWhenCancelled(t *testing.T) {
+	jobs := []exportJob{{index: 0}, {index: 1}}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
+	go func() {
+		done <- runExportJobs(ctx, jobs, &Options{Workers: 1}, newExportedFiles(), func(ctx context.Context, job exportJob) ([]exportedFile, error) {
+			cancel()
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("got %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("runExportJobs didn't return once cancelled")
+	}
+}
+
+func TestRemoveExport(t *testing.T) {
+	dir := t.TempDir()
+	for _, file := range []string{
+		"cluster/core/cluster/namespace.yaml",
+		"cluster/apps/shop/deployment.yaml",
+		"cluster/capi/cluster.yaml",
+		"cluster/tenants/team-a/kustomization.yaml",
+		"cluster/kustomization.yaml",
+		"README.md",
+	} {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(dir, file)), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, file), []byte("kind: Test\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := RemoveExport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only what the exporter writes is gone
+	for file, kept := range map[string]bool{
+		"cluster/core": false,
+		"cluster/apps": false,
+		"cluster/capi": false,
+		"cluster/tenants/team-a/kustomization.yaml": true,
+		"cluster/kustomization.yaml":                true,
+		"README.md":                                 true,
+	} {
+		if _, err := os.Stat(filepath.Join(dir, file)); (err == nil) != kept {
+			t.Errorf("%s: got kept %v, want %v", file, err == nil, kept)
+		}
+	}
+	if exported := ExportedDirs(dir); len(exported) != 0 {
+		t.Errorf("got %v still exported", exported)
+	}
+}
+
+func TestExportNamespaceNamedLikeClusterDir(t *testing.T) {
+	old := exportTestNamespaces
+	exportTestNamespaces = append([]string{"cluster", "cluster-extras"}, old...)
+	defer func() {
+		exportTestNamespaces = old
+	}()
+
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{Rules: rules, Secrets: &SecretPolicy{}, Workers: 1, Layout: LayoutNamespace}
+	client, dynamicClient := newExportTestCluster()
+	dir := t.TempDir()
+	_, err = exportCluster(context.Background(), client, dynamicClient, dir, "argocd", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := readTree(t, dir)
+
+	// Cluster scoped objects keep their dir to themselves
+	for path := range tree {
+		if strings.HasPrefix(path, "cluster/core/cluster/") && !strings.HasPrefix(path, "cluster/core/cluster/clusterrole-") && path != "cluster/core/cluster/kustomization.yaml" {
+			t.Errorf("%s is in the dir of cluster scoped objects", path)
+		}
+	}
+	for _, ns := range []string{"cluster", "cluster-extras"} {
+		for _, file := range []string{"namespace-" + ns + ".yaml", "configmap-config-0.yaml", "kustomization.yaml"} {
+			if _, ok := tree["cluster/core/"+ns+".namespace/"+file]; !ok {
+				t.Errorf("%s: %s wasn't exported to cluster/core/%s.namespace", ns, file, ns)
+			}
+		}
+	}
+	if strings.Contains(tree["cluster/core/cluster/kustomization.yaml"], "configmap-") {
+		t.Errorf("the objects of the cluster namespace are in the kustomization of cluster scoped objects:\n%s", tree["cluster/core/cluster/kustomization.yaml"])
+	}
+}
@@ -17,7 +17,7 @@ commonAnnotations:
 
 resources:
 {{- range $ClusterScopedYaml := .ClusterScopedYamls }}
-- {{ Myfp $ClusterScopedYaml -}}
+- {{ $ClusterScopedYaml -}}
 {{ end }}
 `
 
@@ -32,10 +32,60 @@ commonAnnotations:
 
 resources:
 {{- range $NsScopedYaml := .NsScopedYamls }}
-- {{ Myfp $NsScopedYaml -}}
+- {{ $NsScopedYaml -}}
 {{ end }}
 `
 
+// CapiKustomizeFile keeps the GitOps controllers from ever pruning the CAPI objects, that would delete the cluster
+var CapiKustomizeFile string = `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+
+commonAnnotations:
+{{- if eq .GitOpsController "argocd"}}
+    argocd.argoproj.io/sync-options: Prune=false
+{{- else }}
+    kustomize.toolkit.fluxcd.io/prune: disabled
+{{- end }}
+
+resources:
+{{- range $CapiYaml := .CapiYamls }}
+- {{ $CapiYaml -}}
+{{ end }}
+`
+
+// DefaultExportRules are the resources we never export, either because they can't be applied back
+// or because something in the cluster manages them. Rules passed by the user are added to these.
+var DefaultExportRules string = `exclude:
+# Not real objects, or read only
+- resource: componentstatuses
+- resource: bindings
+- resource: tokenreviews
+- resource: selfsubjectaccessreviews
+- resource: selfsubjectrulesreviews
+- resource: subjectaccessreviews
+- resource: localsubjectaccessreviews
+# Created by controllers from other objects
+- resource: pods
+- resource: replicasets
+- resource: controllerrevisions
+- resource: endpoints
+- resource: endpointslices
+- resource: events
+- resource: leases
+- resource: certificatesigningrequests
+# Deprecated
+- resource: podsecuritypolicies
+# Managed by Calico IPAM
+- group: crd.projectcalico.org
+  resource: ipam*
+# Exported on their own into cluster/capi
+- group: "*cluster.x-k8s.io"
+# Managed by kubeadm and the CNI
+- name: "*bootstrap-token*"
+- name: cluster-info
+- name: calico-config
+`
+
 type GroupResource struct {
 	APIGroup        string
 	APIGroupVersion string
@@ -0,0 +1,82 @@
+package export
+
+import (
+	"errors"
+)
+
+// The layouts an export can be written in
+const (
+	// LayoutNamespace writes cluster scoped objects to cluster/core/cluster and the rest to cluster/core/<namespace>.
+	// Namespaces named like a dir that isn't a namespace's, like cluster, go to cluster/core/<namespace>.namespace.
+	LayoutNamespace = "namespace"
+
+	// LayoutApp writes the objects of an app, found by its AppLabel, to cluster/apps/<app>. Objects without
+	// the label are written the way LayoutNamespace does.
+	LayoutApp = "app"
+
+	// LayoutFlat writes every object to cluster/core/cluster
+	LayoutFlat = "flat"
+)
+
+// reservedDirs are the dirs of cluster/core that aren't a namespace's, like the one of cluster scoped objects
+var reservedDirs = map[string]bool{
+	"cluster":        true,
+	"cluster-extras": true,
+}
+
+// defaultAppLabel is the label apps are found by when Options.AppLabel isn't set
+var defaultAppLabel = "app.kubernetes.io/part-of"
+
+// Validate checks the options and loads what they need, so bad ones fail before anything is exported
+func (o *Options) Validate() error {
+	switch o.Layout {
+	case "", LayoutNamespace, LayoutApp, LayoutFlat:
+	default:
+		return errors.New("unrecognized export layout: " + o.Layout)
+	}
+
+	return o.Secrets.Validate()
+}
+
+// objectDir returns the dir, relative to the cluster dir, an object with the labels is exported to.
+// The namespace is empty for cluster scoped objects.
+func (o *Options) objectDir(labels map[string]string, namespace string) string {
+	switch o.Layout {
+	case LayoutFlat:
+		return "cluster/core/cluster"
+	case LayoutApp:
+		if app := labels[o.appLabel()]; app != "" {
+			return "cluster/apps/" + cleanFileName(app)
+		}
+	}
+
+	if namespace == "" {
+		return "cluster/core/cluster"
+	}
+
+	return "cluster/core/" + namespaceDirName(namespace)
+}
+
+// namespaceDirName returns the name of the dir of the namespace under cluster/core. Namespaces named like a
+// reserved dir get a suffix with a dot in it, namespace names can't have one so it's not another namespace's.
+func namespaceDirName(namespace string) string {
+	if reservedDirs[namespace] {
+		return namespace + ".namespace"
+	}
+
+	return namespace
+}
+
+// namespaceDir returns true if the dir, relative to the cluster dir, only has objects of the namespace
+func (o *Options) namespaceDir(dir string, namespace string) bool {
+	return o.Layout != LayoutFlat && dir == "cluster/core/"+namespaceDirName(namespace)
+}
+
+// appLabel returns the label apps are found by
+func (o *Options) appLabel() string {
+	if o.AppLabel == "" {
+		return defaultAppLabel
+	}
+
+	return o.AppLabel
+}
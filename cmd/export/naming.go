@@ -0,0 +1,166 @@
+package export
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// exportExtensions are the extensions of the exported files, longest first
+var exportExtensions = []string{".yaml.redacted", ".yaml"}
+
+// fileNamer names the exported files <kind>-<name>. When more than one API group has the kind, the
+// group is added to it, like <kind>.<group>-<name>, so their files can't overwrite each other.
+// The core group never gets one, so the usual kinds keep their names.
+type fileNamer struct {
+	groupedKinds map[string]bool
+}
+
+// newFileNamer returns a fileNamer for the API resources of the cluster
+func newFileNamer(resources []GroupResource) *fileNamer {
+	groups := map[string]map[string]bool{}
+	for _, gr := range resources {
+		kind := strings.ToLower(gr.APIResource.Kind)
+		if groups[kind] == nil {
+			groups[kind] = map[string]bool{}
+		}
+		groups[kind][gr.APIGroup] = true
+	}
+
+	n := &fileNamer{groupedKinds: map[string]bool{}}
+	for kind, g := range groups {
+		if len(g) > 1 {
+			n.groupedKinds[kind] = true
+		}
+	}
+
+	return n
+}
+
+// fileName returns the file name, without extension, for the object of the API resource. With withNamespace,
+// the namespace goes between the kind and the name, for dirs with objects from more than one namespace.
+func (n *fileNamer) fileName(gr GroupResource, obj *unstructured.Unstructured, withNamespace bool) string {
+	kind := strings.ToLower(gr.APIResource.Kind)
+	if gr.APIGroup != "" && n.groupedKinds[kind] {
+		kind += "." + gr.APIGroup
+	}
+	if withNamespace {
+		kind += "-" + obj.GetNamespace()
+	}
+
+	return cleanFileName(kind) + "-" + cleanFileName(obj.GetName())
+}
+
+// cleanFileName lowercases the name and replaces anything but letters, digits, dots and dashes with a dash
+func cleanFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' || r == '-' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(name))
+}
+
+// objectRef describes the object of the API resource in messages, like <kind>[.<group>] [<namespace>/]<name>
+func objectRef(gr GroupResource, obj *unstructured.Unstructured) string {
+	ref := gr.APIResource.Kind
+	if gr.APIGroup != "" {
+		ref += "." + gr.APIGroup
+	}
+	if obj.GetNamespace() != "" {
+		return ref + " " + obj.GetNamespace() + "/" + obj.GetName()
+	}
+
+	return ref + " " + obj.GetName()
+}
+
+// exportedFiles writes the exported files and keeps track of them per dir, so the kustomization of
+// each dir lists what was written by this export and nothing else
+type exportedFiles struct {
+	dirs map[string]map[string]string
+}
+
+// newExportedFiles returns an empty exportedFiles
+func newExportedFiles() *exportedFiles {
+	return &exportedFiles{dirs: map[string]map[string]string{}}
+}
+
+// write writes the file. If another object was already written to the same file, a hash of the object
+// is added to the name so neither gets lost.
+func (f *exportedFiles) write(file exportedFile) error {
+	dir, name := filepath.Split(file.path)
+	dir = filepath.Clean(dir)
+	if f.dirs[dir] == nil {
+		f.dirs[dir] = map[string]string{}
+	}
+
+	if other, ok := f.dirs[dir][name]; ok {
+		hash := sha256.Sum256([]byte(file.object))
+		renamed := insertBeforeExtension(name, "-"+hex.EncodeToString(hash[:])[:8])
+		if _, ok := f.dirs[dir][renamed]; ok {
+			return errors.New("unable to find a file name for " + file.object + " in " + dir)
+		}
+		log.Warn(file.object + " would overwrite " + other + " in " + dir + "/" + name + ", writing it to " + renamed)
+		name = renamed
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	y, err := os.Create(dir + "/" + name)
+	if err != nil {
+		return err
+	}
+	defer y.Close()
+
+	_, err = y.Write(file.content)
+	if err != nil {
+		return err
+	}
+	f.dirs[dir][name] = file.object
+
+	return nil
+}
+
+// dirNames returns the dirs files were written to, sorted
+func (f *exportedFiles) dirNames() []string {
+	dirs := []string{}
+	for dir := range f.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	return dirs
+}
+
+// yamlFiles returns the sorted names of the YAML files written to the dir, the files kustomize should apply
+func (f *exportedFiles) yamlFiles(dir string) []string {
+	files := []string{}
+	for name := range f.dirs[filepath.Clean(dir)] {
+		if strings.HasSuffix(name, ".yaml") {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+
+	return files
+}
+
+// insertBeforeExtension adds the suffix to the file name, before its export extension
+func insertBeforeExtension(name string, suffix string) string {
+	for _, ext := range exportExtensions {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext) + suffix + ext
+		}
+	}
+
+	return name + suffix
+}
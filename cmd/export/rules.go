@@ -0,0 +1,243 @@
+package export
+
+import (
+	"errors"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// Rule matches resources to export. Every field is a glob, except Labels which is a label selector.
+// Empty fields match anything. Use "core" for the core API group.
+type Rule struct {
+	Group     string `json:"group,omitempty"`
+	Resource  string `json:"resource,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Labels    string `json:"labels,omitempty"`
+
+	// selector is the parsed Labels
+	selector labels.Selector
+}
+
+// Rules decides what gets exported. Anything matching an Exclude rule is skipped, unless it matches an Include rule.
+// If there are Only rules, anything not matching one of them is skipped as well.
+type Rules struct {
+	Only    []Rule `json:"only,omitempty"`
+	Include []Rule `json:"include,omitempty"`
+	Exclude []Rule `json:"exclude,omitempty"`
+}
+
+// LoadRules returns the default export rules, extended with the ones in the given file if it's not empty
+func LoadRules(file string) (*Rules, error) {
+	rules, err := parseRules([]byte(DefaultExportRules))
+	if err != nil {
+		return nil, err
+	}
+	if file == "" {
+		return rules, nil
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	extra, err := parseRules(content)
+	if err != nil {
+		return nil, errors.New("unable to read export rules from " + file + ": " + err.Error())
+	}
+	rules.Only = append(rules.Only, extra.Only...)
+	rules.Include = append(rules.Include, extra.Include...)
+	rules.Exclude = append(rules.Exclude, extra.Exclude...)
+
+	return rules, nil
+}
+
+// parseRules parses the YAML rules and checks the globs and label selectors in them
+func parseRules(content []byte) (*Rules, error) {
+	rules := &Rules{}
+	err := yaml.UnmarshalStrict(content, rules)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, list := range [][]Rule{rules.Only, rules.Include, rules.Exclude} {
+		for i := range list {
+			err = list[i].compile()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// compile checks the globs of the rule and parses its label selector
+func (r *Rule) compile() error {
+	for _, glob := range []string{r.Group, r.Resource, r.Kind, r.Namespace, r.Name} {
+		if _, err := path.Match(glob, ""); err != nil {
+			return errors.New("bad glob in export rule: " + glob)
+		}
+	}
+
+	selector, err := labels.Parse(r.Labels)
+	if err != nil {
+		return err
+	}
+	r.selector = selector
+
+	return nil
+}
+
+// matchesResource returns true if the rule can match objects of the API resource
+func (r *Rule) matchesResource(gr GroupResource) bool {
+	group := gr.APIGroup
+	if group == "" {
+		group = "core"
+	}
+
+	// Rules for a namespace never match cluster scoped objects
+	if r.Namespace != "" && !gr.APIResource.Namespaced {
+		return false
+	}
+
+	return globMatch(r.Group, group) && globMatch(r.Resource, gr.APIResource.Name) && globMatch(r.Kind, gr.APIResource.Kind)
+}
+
+// matchesObject returns true if the rule matches the object of the API resource
+func (r *Rule) matchesObject(gr GroupResource, obj *unstructured.Unstructured) bool {
+	if !r.matchesResource(gr) || !globMatch(r.Namespace, obj.GetNamespace()) || !globMatch(r.Name, obj.GetName()) {
+		return false
+	}
+
+	return r.selector == nil || r.selector.Matches(labels.Set(obj.GetLabels()))
+}
+
+// objectScoped returns true if the rule looks at individual objects rather than whole API resources
+func (r *Rule) objectScoped() bool {
+	return r.Namespace != "" || r.Name != "" || r.Labels != ""
+}
+
+// namespaceOnly returns true if the rule matches everything in a namespace
+func (r *Rule) namespaceOnly() bool {
+	return r.Namespace != "" && r.Group == "" && r.Resource == "" && r.Kind == "" && r.Name == "" && r.Labels == ""
+}
+
+// Limit adds Only rules so just the given namespaces and resources are exported. Resources are
+// given as <resource>[.<group>], like kubectl does. Cluster scoped resources are skipped when limiting namespaces.
+func (rs *Rules) Limit(namespaces []string, resources []string) {
+	if len(namespaces) == 0 && len(resources) == 0 {
+		return
+	}
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+	if len(resources) == 0 {
+		resources = []string{""}
+	}
+
+	for _, ns := range namespaces {
+		for _, resource := range resources {
+			rule := Rule{Namespace: ns, Resource: resource}
+			if i := strings.Index(resource, "."); i > 0 {
+				rule.Resource, rule.Group = resource[:i], resource[i+1:]
+			}
+			rs.Only = append(rs.Only, rule)
+		}
+	}
+}
+
+// outOfScope returns true if there are Only rules and none of them match
+func (rs *Rules) outOfScope(match func(r *Rule) bool) bool {
+	if len(rs.Only) == 0 {
+		return false
+	}
+	for i := range rs.Only {
+		if match(&rs.Only[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SkipsNamespace returns true if nothing in the namespace is exported, so it doesn't need to be looked at
+func (rs *Rules) SkipsNamespace(ns string) bool {
+	if rs.outOfScope(func(r *Rule) bool { return globMatch(r.Namespace, ns) }) {
+		return true
+	}
+
+	// Some objects in it could be included back
+	for i := range rs.Include {
+		if globMatch(rs.Include[i].Namespace, ns) {
+			return false
+		}
+	}
+
+	for i := range rs.Exclude {
+		if rs.Exclude[i].namespaceOnly() && globMatch(rs.Exclude[i].Namespace, ns) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SkipsResource returns true if no object of the API resource is exported, so it doesn't need to be listed
+func (rs *Rules) SkipsResource(gr GroupResource) bool {
+	if rs.outOfScope(func(r *Rule) bool { return r.matchesResource(gr) }) {
+		return true
+	}
+
+	// Some objects of it could be included back
+	for i := range rs.Include {
+		if rs.Include[i].matchesResource(gr) {
+			return false
+		}
+	}
+
+	for i := range rs.Exclude {
+		if !rs.Exclude[i].objectScoped() && rs.Exclude[i].matchesResource(gr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Excludes returns true if the object of the API resource shouldn't be exported
+func (rs *Rules) Excludes(gr GroupResource, obj *unstructured.Unstructured) bool {
+	if rs.outOfScope(func(r *Rule) bool { return r.matchesObject(gr, obj) }) {
+		return true
+	}
+
+	for i := range rs.Include {
+		if rs.Include[i].matchesObject(gr, obj) {
+			return false
+		}
+	}
+
+	for i := range rs.Exclude {
+		if rs.Exclude[i].matchesObject(gr, obj) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// globMatch matches the value against the glob, an empty glob matches anything
+func globMatch(glob string, value string) bool {
+	if glob == "" {
+		return true
+	}
+	matched, _ := path.Match(glob, value)
+
+	return matched
+}
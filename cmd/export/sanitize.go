@@ -0,0 +1,230 @@
+package export
+
+import (
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Sanitizer cleans up an exported object so it can be applied back as is.
+// It returns false if the object shouldn't be exported at all.
+type Sanitizer func(obj *unstructured.Unstructured) bool
+
+// sanitizers run on every exported object, before the ones for its kind
+var sanitizers = []Sanitizer{
+	skipOwned,
+	cleanMetadata,
+	cleanObjectAnnotations,
+	dropStatus,
+	cleanPodTemplate,
+}
+
+// kindSanitizers run on the objects of a kind, after the common ones
+var kindSanitizers = map[schema.GroupKind][]Sanitizer{
+	{Group: "", Kind: "Service"}:        {cleanService},
+	{Group: "", Kind: "Secret"}:         {skipGeneratedSecret},
+	{Group: "", Kind: "ConfigMap"}:      {skipGeneratedConfigMap},
+	{Group: "", Kind: "ServiceAccount"}: {cleanServiceAccount},
+	{Group: "batch", Kind: "Job"}:       {cleanJob},
+}
+
+// systemMetadata are the metadata fields the API server sets
+var systemMetadata = []string{
+	"resourceVersion",
+	"uid",
+	"creationTimestamp",
+	"deletionTimestamp",
+	"deletionGracePeriodSeconds",
+	"selfLink",
+	"managedFields",
+	"finalizers",
+	"generation",
+	"generateName",
+}
+
+// systemAnnotations are the annotations tools and controllers set, anything else is kept.
+// Entries ending in / drop every annotation with that prefix.
+var systemAnnotations = []string{
+	"kubectl.kubernetes.io/last-applied-configuration",
+	"deployment.kubernetes.io/",
+	"control-plane.alpha.kubernetes.io/leader",
+	"endpoints.kubernetes.io/last-change-trigger-time",
+	"pv.kubernetes.io/",
+	"volume.beta.kubernetes.io/storage-provisioner",
+	"volume.kubernetes.io/",
+	"kubernetes.io/service-account.uid",
+	"autoscaling.alpha.kubernetes.io/",
+}
+
+// generatedConfigMaps are the ConfigMaps the control plane creates and keeps up to date
+var generatedConfigMaps = []string{
+	"kube-root-ca.crt",
+	"extension-apiserver-authentication",
+}
+
+// Sanitize runs the sanitizers for the object on it. It returns false if the object shouldn't be exported.
+func Sanitize(obj *unstructured.Unstructured) bool {
+	for _, sanitize := range sanitizers {
+		if !sanitize(obj) {
+			return false
+		}
+	}
+
+	for _, sanitize := range kindSanitizers[obj.GroupVersionKind().GroupKind()] {
+		if !sanitize(obj) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CleanAnnotations returns the annotations without the ones set by tools and controllers
+func CleanAnnotations(annotations map[string]string) map[string]string {
+	cleaned := map[string]string{}
+	for key, value := range annotations {
+		if !isSystemAnnotation(key) {
+			cleaned[key] = value
+		}
+	}
+
+	return cleaned
+}
+
+// isSystemAnnotation returns true if the annotation is set by tools or controllers
+func isSystemAnnotation(key string) bool {
+	for _, system := range systemAnnotations {
+		if key == system || (strings.HasSuffix(system, "/") && strings.HasPrefix(key, system)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// skipOwned skips objects owned by another object, they are recreated by their owner
+func skipOwned(obj *unstructured.Unstructured) bool {
+	return len(obj.GetOwnerReferences()) == 0
+}
+
+// cleanMetadata drops the metadata the API server sets
+func cleanMetadata(obj *unstructured.Unstructured) bool {
+	for _, field := range systemMetadata {
+		unstructured.RemoveNestedField(obj.Object, "metadata", field)
+	}
+
+	return true
+}
+
+// cleanObjectAnnotations drops the annotations set by tools and controllers, keeping the user's
+func cleanObjectAnnotations(obj *unstructured.Unstructured) bool {
+	annotations := CleanAnnotations(obj.GetAnnotations())
+	if len(annotations) == 0 {
+		unstructured.RemoveNestedField(obj.Object, "metadata", "annotations")
+		return true
+	}
+	obj.SetAnnotations(annotations)
+
+	return true
+}
+
+// dropStatus drops the status, it's written by controllers
+func dropStatus(obj *unstructured.Unstructured) bool {
+	unstructured.RemoveNestedField(obj.Object, "status")
+
+	return true
+}
+
+// cleanPodTemplate drops the empty creationTimestamp in the pod template of workloads
+func cleanPodTemplate(obj *unstructured.Unstructured) bool {
+	unstructured.RemoveNestedField(obj.Object, "spec", "template", "metadata", "creationTimestamp")
+	unstructured.RemoveNestedField(obj.Object, "spec", "jobTemplate", "metadata", "creationTimestamp")
+	unstructured.RemoveNestedField(obj.Object, "spec", "jobTemplate", "spec", "template", "metadata", "creationTimestamp")
+
+	return true
+}
+
+// cleanService drops the allocated IPs and the fields the API server defaults.
+// Headless services keep their clusterIP since it's what makes them headless.
+func cleanService(obj *unstructured.Unstructured) bool {
+	clusterIP, _, _ := unstructured.NestedString(obj.Object, "spec", "clusterIP")
+	if clusterIP != "None" {
+		unstructured.RemoveNestedField(obj.Object, "spec", "clusterIP")
+		unstructured.RemoveNestedField(obj.Object, "spec", "clusterIPs")
+	}
+	unstructured.RemoveNestedField(obj.Object, "spec", "ipFamilies")
+	unstructured.RemoveNestedField(obj.Object, "spec", "ipFamilyPolicy")
+
+	// Only drop the defaults, someone could have set something else
+	defaults := map[string]string{
+		"sessionAffinity":       "None",
+		"internalTrafficPolicy": "Cluster",
+	}
+	for field, value := range defaults {
+		if current, _, _ := unstructured.NestedString(obj.Object, "spec", field); current == value {
+			unstructured.RemoveNestedField(obj.Object, "spec", field)
+		}
+	}
+
+	return true
+}
+
+// skipGeneratedSecret skips the ServiceAccount token secrets, like the default-token ones, and bootstrap tokens
+func skipGeneratedSecret(obj *unstructured.Unstructured) bool {
+	secretType, _, _ := unstructured.NestedString(obj.Object, "type")
+
+	return secretType != "kubernetes.io/service-account-token" && secretType != "bootstrap.kubernetes.io/token"
+}
+
+// skipGeneratedConfigMap skips the ConfigMaps the control plane creates
+func skipGeneratedConfigMap(obj *unstructured.Unstructured) bool {
+	for _, name := range generatedConfigMaps {
+		if obj.GetName() == name {
+			return false
+		}
+	}
+
+	return true
+}
+
+// cleanServiceAccount drops the references to the token secrets created for the ServiceAccount
+func cleanServiceAccount(obj *unstructured.Unstructured) bool {
+	secrets, found, _ := unstructured.NestedSlice(obj.Object, "secrets")
+	if !found {
+		return true
+	}
+
+	kept := []interface{}{}
+	for _, secret := range secrets {
+		ref, _ := secret.(map[string]interface{})
+		name, _ := ref["name"].(string)
+		if strings.HasPrefix(name, obj.GetName()+"-token-") {
+			continue
+		}
+		kept = append(kept, secret)
+	}
+
+	if len(kept) == 0 {
+		unstructured.RemoveNestedField(obj.Object, "secrets")
+		return true
+	}
+	unstructured.SetNestedSlice(obj.Object, kept, "secrets")
+
+	return true
+}
+
+// cleanJob drops the selector and labels generated for the Job, it can't be applied back with them
+func cleanJob(obj *unstructured.Unstructured) bool {
+	manualSelector, _, _ := unstructured.NestedBool(obj.Object, "spec", "manualSelector")
+	if manualSelector {
+		return true
+	}
+
+	unstructured.RemoveNestedField(obj.Object, "spec", "selector")
+	for _, label := range []string{"controller-uid", "job-name", "batch.kubernetes.io/controller-uid", "batch.kubernetes.io/job-name"} {
+		unstructured.RemoveNestedField(obj.Object, "spec", "template", "metadata", "labels", label)
+	}
+
+	return true
+}
@@ -0,0 +1,257 @@
+package export
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer/json"
+)
+
+// secretGroupKind is what the secret policy applies to
+var secretGroupKind = schema.GroupKind{Group: "", Kind: "Secret"}
+
+// redactedValue replaces the values of redacted Secrets
+var redactedValue = "REDACTED"
+
+// SecretPolicy is how Secrets are exported. Raw Secret data is never written.
+// Encrypted Secrets change on every export, sops and sealed-secrets use a new random key each time.
+type SecretPolicy struct {
+	// Mode is one of:
+	//  skip: Secrets aren't exported (the default)
+	//  redact: Secrets are written with placeholder values to <file>.yaml.redacted, which isn't applied
+	//  sops: Secrets are encrypted with sops for the AgeRecipients, the GitOps controller has to decrypt them
+	//  sealed-secrets: Secrets are converted to SealedSecrets with the SealedSecretsCert of the controller
+	Mode string
+
+	// AgeRecipients are the age public keys sops encrypts for
+	AgeRecipients []string
+
+	// SealedSecretsCert is the PEM certificate of the sealed-secrets controller
+	SealedSecretsCert string
+
+	// sealingKey is the public key in SealedSecretsCert
+	sealingKey *rsa.PublicKey
+}
+
+// Validate checks the policy and loads what it needs, so a bad policy fails before anything is exported
+func (p *SecretPolicy) Validate() error {
+	switch p.Mode {
+	case "", "skip", "redact":
+		return nil
+	case "sops":
+		if len(p.AgeRecipients) == 0 {
+			return errors.New("the sops secret policy requires at least one age recipient")
+		}
+		_, err := exec.LookPath("sops")
+		if err != nil {
+			return errors.New("the sops secret policy requires sops in your PATH: " + err.Error())
+		}
+		return nil
+	case "sealed-secrets":
+		if p.SealedSecretsCert == "" {
+			return errors.New("the sealed-secrets secret policy requires the certificate of the controller")
+		}
+		key, err := readSealingKey(p.SealedSecretsCert)
+		if err != nil {
+			return err
+		}
+		p.sealingKey = key
+		return nil
+	}
+
+	return errors.New("unrecognized secret policy: " + p.Mode)
+}
+
+// exports returns false for Secrets if the policy doesn't write them as Secrets, everything else is exported
+func (p *SecretPolicy) exports(obj *unstructured.Unstructured) bool {
+	gv, _ := schema.ParseGroupVersion(obj.GetAPIVersion())
+	if (schema.GroupKind{Group: gv.Group, Kind: obj.GetKind()}) != secretGroupKind {
+		return true
+	}
+
+	return p.Mode == "redact" || p.Mode == "sops"
+}
+
+// encodeSecret returns the file, from the given one without the .yaml extension, and the content to write
+// for the Secret the way the policy says. The file is empty if nothing should be written.
+func (p *SecretPolicy) encodeSecret(secret *unstructured.Unstructured, file string, e *json.Serializer) (string, []byte, error) {
+	switch p.Mode {
+	case "redact":
+		redactSecret(secret)
+		content, err := encodeObject(secret, e)
+		return file + ".yaml.redacted", content, err
+	case "sops":
+		content, err := p.sopsEncrypt(secret, e)
+		return file + ".yaml", content, err
+	case "sealed-secrets":
+		sealed, err := p.sealSecret(secret)
+		if err != nil {
+			return "", nil, err
+		}
+		content, err := encodeObject(sealed, e)
+		return strings.Replace(file, "secret-", "sealedsecret-", 1) + ".yaml", content, err
+	}
+
+	// Anything else is skipped
+	return "", nil, nil
+}
+
+// redactSecret replaces every value of the Secret with a placeholder, keeping the keys
+func redactSecret(secret *unstructured.Unstructured) {
+	data, _, _ := unstructured.NestedMap(secret.Object, "data")
+	stringData := map[string]interface{}{}
+	for key := range data {
+		stringData[key] = redactedValue
+	}
+
+	unstructured.RemoveNestedField(secret.Object, "data")
+	if len(stringData) > 0 {
+		unstructured.SetNestedMap(secret.Object, stringData, "stringData")
+	}
+}
+
+// sopsEncrypt encrypts the data of the Secret with sops and returns the encrypted YAML
+func (p *SecretPolicy) sopsEncrypt(secret *unstructured.Unstructured, e *json.Serializer) ([]byte, error) {
+	plain, err := encodeObject(secret, e)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the values are encrypted so the Secret can still be reviewed. The plain YAML goes through stdin,
+	// it never touches the disk
+	cmd := exec.Command("sops", "--encrypt",
+		"--age", strings.Join(p.AgeRecipients, ","),
+		"--encrypted-regex", "^(data|stringData)$",
+		"--input-type", "yaml", "--output-type", "yaml",
+		"/dev/stdin")
+	cmd.Stdin = bytes.NewReader(plain)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	encrypted, err := cmd.Output()
+	if err != nil {
+		return nil, errors.New("unable to encrypt secret " + secret.GetNamespace() + "/" + secret.GetName() + " with sops: " + strings.TrimSpace(stderr.String()))
+	}
+
+	return encrypted, nil
+}
+
+// sealSecret converts the Secret to a strictly scoped SealedSecret, encrypted the same way kubeseal does
+func (p *SecretPolicy) sealSecret(secret *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	// Strict scope binds the value to the name and namespace of the Secret
+	label := []byte(secret.GetNamespace() + "/" + secret.GetName())
+
+	data, _, _ := unstructured.NestedStringMap(secret.Object, "data")
+	encryptedData := map[string]interface{}{}
+	for key, value := range data {
+		plain, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := hybridEncrypt(p.sealingKey, plain, label)
+		if err != nil {
+			return nil, err
+		}
+		encryptedData[key] = base64.StdEncoding.EncodeToString(sealed)
+	}
+
+	// The template is what the controller creates the Secret from
+	template := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":      secret.GetName(),
+			"namespace": secret.GetNamespace(),
+		},
+	}
+	if labels := secret.GetLabels(); len(labels) > 0 {
+		unstructured.SetNestedStringMap(template, labels, "metadata", "labels")
+	}
+	if annotations := secret.GetAnnotations(); len(annotations) > 0 {
+		unstructured.SetNestedStringMap(template, annotations, "metadata", "annotations")
+	}
+	if secretType, _, _ := unstructured.NestedString(secret.Object, "type"); secretType != "" {
+		template["type"] = secretType
+	}
+
+	sealed := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "bitnami.com/v1alpha1",
+		"kind":       "SealedSecret",
+		"metadata": map[string]interface{}{
+			"name":      secret.GetName(),
+			"namespace": secret.GetNamespace(),
+		},
+		"spec": map[string]interface{}{
+			"encryptedData": encryptedData,
+			"template":      template,
+		},
+	}}
+
+	return sealed, nil
+}
+
+// hybridEncrypt encrypts the plaintext with a random AES-GCM session key, which is itself encrypted
+// with RSA-OAEP. The output is the length of the encrypted session key, the key, then the ciphertext.
+func hybridEncrypt(key *rsa.PublicKey, plaintext []byte, label []byte) ([]byte, error) {
+	sessionKey := make([]byte, 32)
+	_, err := rand.Read(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaCiphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, sessionKey, label)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := make([]byte, 2)
+	binary.BigEndian.PutUint16(ciphertext, uint16(len(rsaCiphertext)))
+	ciphertext = append(ciphertext, rsaCiphertext...)
+
+	// The session key is only ever used once, so a zero nonce is fine
+	zeroNonce := make([]byte, aead.NonceSize())
+	return aead.Seal(ciphertext, zeroNonce, plaintext, nil), nil
+}
+
+// readSealingKey reads the RSA public key from the PEM certificate of the sealed-secrets controller
+func readSealingKey(certFile string) (*rsa.PublicKey, error) {
+	content, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM certificate found in: " + certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("sealed-secrets certificate doesn't have an RSA key: " + certFile)
+	}
+
+	return key, nil
+}
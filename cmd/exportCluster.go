@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/christianh814/gokp/cmd/events"
+	"github.com/christianh814/gokp/cmd/export"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Exports an existing cluster into a GitOps repo layout",
+	Long: `This will export the YAML of an existing cluster, based on the kubeconfig
+file you pass it, into the same kustomize layout gokp uses for its clusters.
+The output dir can then be pushed to Git to onboard the cluster to GitOps.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Grab flags
+		kubeconfig, _ := cmd.Flags().GetString("kubeconfig")
+		outputDir, _ := cmd.Flags().GetString("output-dir")
+		gitOpsController, _ := cmd.Flags().GetString("controller")
+		namespaces, _ := cmd.Flags().GetStringSlice("namespace")
+		resources, _ := cmd.Flags().GetStringSlice("resource")
+		overwrite, _ := cmd.Flags().GetBool("overwrite")
+
+		// The kustomize files differ between controllers
+		if gitOpsController != "argocd" && gitOpsController != "fluxcd" && gitOpsController != "flux" {
+			fail(events.CodeInvalidInput, errors.New("unrecognized controller: "+gitOpsController))
+		}
+
+		// Load the export options and narrow them down to what was asked for
+		exportOpts, err := exportOptionsFromFlags(cmd)
+		if err != nil {
+			fail(events.CodeInvalidInput, err)
+		}
+		exportOpts.Rules.Limit(namespaces, resources)
+
+		// Don't mix a new export with an old one, but keep what the export doesn't write, like cluster/tenants
+		if exported := export.ExportedDirs(outputDir); len(exported) != 0 {
+			if !overwrite {
+				fail(events.CodeInvalidInput, errors.New(strings.Join(exported, ", ")+" already exist, use --overwrite to replace them"))
+			}
+			log.Info("Removing previous export at " + strings.Join(exported, ", "))
+			err = export.RemoveExport(outputDir)
+			if err != nil {
+				fail(events.CodeFilesystem, err)
+			}
+		}
+
+		err = os.MkdirAll(outputDir, 0755)
+		if err != nil {
+			fail(events.CodeFilesystem, err)
+		}
+
+		// Export the YAML
+		log.Info("Exporting Cluster YAML to " + outputDir)
+		_, err = export.ExportClusterYaml(cmd.Context(), kubeconfig, outputDir, gitOpsController, exportOpts)
+		if err != nil {
+			failCommand(cmd, events.CodeExport, err)
+		}
+
+		// If we're here, the export should be done
+		log.Info("Cluster successfully exported to " + outputDir + "/cluster")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+
+	// Define flags for export
+	exportCmd.Flags().String("kubeconfig", "", "Path to the Kubeconfig file of the cluster to export.")
+	exportCmd.Flags().String("output-dir", "", "Directory to export the cluster into. The YAML goes in its cluster dir.")
+	exportCmd.Flags().String("controller", "argocd", "The GitOps Controller the export is for. Either argocd or fluxcd.")
+	exportCmd.Flags().StringSlice("namespace", []string{}, "Only export these namespaces. Cluster scoped resources are skipped when set.")
+	exportCmd.Flags().StringSlice("resource", []string{}, "Only export these resources, as <resource>[.<group>] like deployments.apps.")
+	addExportFlags(exportCmd)
+	exportCmd.Flags().BoolP("overwrite", "", false, "Replace the exported dirs of the cluster dir if the output dir already has them. The rest of it is kept.")
+
+	// required flags
+	exportCmd.MarkFlagRequired("kubeconfig")
+	exportCmd.MarkFlagRequired("output-dir")
+}
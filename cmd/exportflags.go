@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"github.com/christianh814/gokp/cmd/export"
+	"github.com/spf13/cobra"
+)
+
+// addExportFlags adds the flags for what gets exported, and how, to the given command
+func addExportFlags(c *cobra.Command) {
+	c.Flags().String("export-rules", "", "Path to a YAML file with include/exclude rules for what gets exported, added to the defaults.")
+	c.Flags().Int("export-workers", 8, "How many resource types are exported at once.")
+	c.Flags().String("export-layout", "namespace", "How exported files are laid out. One of namespace, app (cluster/apps/<app> by --export-app-label) or flat.")
+	c.Flags().String("export-app-label", "app.kubernetes.io/part-of", "Label that names the app of an object with --export-layout app, like app.kubernetes.io/instance.")
+
+	// Secret flags
+	c.Flags().String("secret-policy", "skip", "How Secrets are exported. One of skip, redact, sops or sealed-secrets. Raw Secret data is never written.")
+	c.Flags().StringSlice("sops-age-recipients", []string{}, "age public keys to encrypt Secrets for with --secret-policy sops.")
+	c.Flags().String("sealed-secrets-cert", "", "Path to the certificate of the sealed-secrets controller for --secret-policy sealed-secrets.")
+}
+
+// exportOptionsFromFlags returns the export options set on the given command, loading and checking them
+func exportOptionsFromFlags(c *cobra.Command) (*export.Options, error) {
+	exportRulesFile, _ := c.Flags().GetString("export-rules")
+	exportWorkers, _ := c.Flags().GetInt("export-workers")
+	exportLayout, _ := c.Flags().GetString("export-layout")
+	exportAppLabel, _ := c.Flags().GetString("export-app-label")
+	secretPolicy, _ := c.Flags().GetString("secret-policy")
+	ageRecipients, _ := c.Flags().GetStringSlice("sops-age-recipients")
+	sealedSecretsCert, _ := c.Flags().GetString("sealed-secrets-cert")
+
+	rules, err := export.LoadRules(exportRulesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &export.Options{
+		Rules: rules,
+		Secrets: &export.SecretPolicy{
+			Mode:              secretPolicy,
+			AgeRecipients:     ageRecipients,
+			SealedSecretsCert: sealedSecretsCert,
+		},
+		Workers:  exportWorkers,
+		Layout:   exportLayout,
+		AppLabel: exportAppLabel,
+	}
+	err = opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
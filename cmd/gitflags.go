@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/christianh814/gokp/cmd/github"
+	"github.com/spf13/cobra"
+)
+
+// addGitFlags adds the flags for the GitOps repo to the given create command
+func addGitFlags(c *cobra.Command) {
+	// Repo specific flags
+	c.Flags().BoolP("private-repo", "", true, "Create a private repo.")
+	c.Flags().String("git-known-hosts", "", "Path to a known_hosts file for the Git server. The host keys are scanned if not set.")
+	c.Flags().String("git-repo-url", "", "Existing GitHub repo to use instead of creating a new one.")
+	c.Flags().String("git-path", "", "Path inside the repo to put the cluster in. Defaults to clusters/<cluster-name> with --git-repo-url.")
+	addGitCommitFlags(c)
+
+	// Verification flags
+	c.Flags().BoolP("flux-verify-commits", "", false, "Make Flux only reconcile commits signed by the OpenPGP --git-signing-key or --flux-verify-keys.")
+	c.Flags().String("flux-verify-keys", "", "Path to armored OpenPGP public keys Flux trusts as well, like GitHub's for merged pull requests.")
+
+	// Organization flags
+	c.Flags().String("git-org", "", "GitHub organization to create the repo in. Defaults to the token owner's account, required with a GitHub App.")
+	c.Flags().String("git-team", "", "Slug of the org team to give access to the repo. Its reviews are required for what it owns on --git-branch.")
+	c.Flags().String("git-team-permission", "write", "Permission to give the team on the repo. Either write or admin.")
+	c.Flags().BoolP("git-codeowners-core", "", false, "Make the team code owner of cluster/core, cluster/apps and cluster/capi as well as cluster/tenants.")
+
+	// Pull request flags
+	c.Flags().BoolP("via-pull-request", "", false, "Push changes to a feature branch and open a pull request instead of pushing to --git-branch.")
+	c.Flags().BoolP("wait-for-merge", "", false, "Wait for the pull request to be merged before bootstrapping the GitOps controller.")
+	c.Flags().Duration("merge-timeout", time.Hour, "How long to wait for the pull request to be merged.")
+
+	addGitAuthFlags(c)
+}
+
+// addGitCommitFlags adds the flags for how to commit to the GitOps repo to the given command
+func addGitCommitFlags(c *cobra.Command) {
+	c.Flags().String("git-branch", "main", "Branch the GitOps controller tracks. It is created if the repo doesn't have it.")
+	c.Flags().String("git-author-name", "gokp-bootstrapper", "Name to commit to the repo as.")
+	c.Flags().String("git-author-email", "", "Email to commit to the repo as.")
+
+	// Signing flags
+	c.Flags().String("git-signing-key", "", "Path to an armored OpenPGP or an ssh private key to sign commits with.")
+	c.Flags().String("git-signing-key-passphrase", "", "Passphrase of --git-signing-key, if it's encrypted.")
+}
+
+// addGitAuthFlags adds the flags for authenticating to GitHub to the given command
+func addGitAuthFlags(c *cobra.Command) {
+	c.Flags().String("github-token", "", "GitHub token to use.")
+	c.Flags().String("git-transport", "ssh", "How the installer and the GitOps controller talk to Git. Either ssh (deploy keys) or https.")
+	c.Flags().Int64("github-app-id", 0, "GitHub App ID to use instead of a GitHub token.")
+	c.Flags().Int64("github-app-installation-id", 0, "GitHub App installation ID to use with --github-app-id.")
+	c.Flags().String("github-app-private-key", "", "Path to the GitHub App private key to use with --github-app-id.")
+}
+
+// gitAuthFromFlags returns the git auth settings set on the given command
+func gitAuthFromFlags(c *cobra.Command) *github.GitAuth {
+	ghToken, _ := c.Flags().GetString("github-token")
+	gitTransport, _ := c.Flags().GetString("git-transport")
+	appID, _ := c.Flags().GetInt64("github-app-id")
+	appInstallationID, _ := c.Flags().GetInt64("github-app-installation-id")
+	appPrivateKey, _ := c.Flags().GetString("github-app-private-key")
+
+	return &github.GitAuth{
+		Transport:         gitTransport,
+		Token:             ghToken,
+		AppID:             appID,
+		AppInstallationID: appInstallationID,
+		AppPrivateKeyFile: appPrivateKey,
+	}
+}
+
+// repoOptionsFromFlags returns where and how to create the repo from the flags of the given create command
+func repoOptionsFromFlags(c *cobra.Command) *github.RepoOptions {
+	knownHosts, _ := c.Flags().GetString("git-known-hosts")
+	repoUrl, _ := c.Flags().GetString("git-repo-url")
+	repoPath, _ := c.Flags().GetString("git-path")
+	org, _ := c.Flags().GetString("git-org")
+	team, _ := c.Flags().GetString("git-team")
+	teamPermission, _ := c.Flags().GetString("git-team-permission")
+	codeOwnersCore, _ := c.Flags().GetBool("git-codeowners-core")
+
+	return &github.RepoOptions{
+		KnownHosts:     knownHosts,
+		URL:            repoUrl,
+		Path:           repoPath,
+		Org:            org,
+		Team:           team,
+		TeamPermission: teamPermission,
+		CodeOwnersCore: codeOwnersCore,
+	}
+}
+
+// commitOptionsFromFlags returns how to commit to the repo from the flags of the given command
+func commitOptionsFromFlags(c *cobra.Command, clusterName string) *github.CommitOptions {
+	branch, _ := c.Flags().GetString("git-branch")
+	authorName, _ := c.Flags().GetString("git-author-name")
+	authorEmail, _ := c.Flags().GetString("git-author-email")
+	signingKey, _ := c.Flags().GetString("git-signing-key")
+	signingKeyPassphrase, _ := c.Flags().GetString("git-signing-key-passphrase")
+	verifyCommits, _ := c.Flags().GetBool("flux-verify-commits")
+	verifyKeys, _ := c.Flags().GetString("flux-verify-keys")
+	viaPullRequest, _ := c.Flags().GetBool("via-pull-request")
+	waitForMerge, _ := c.Flags().GetBool("wait-for-merge")
+	mergeTimeout, _ := c.Flags().GetDuration("merge-timeout")
+
+	return &github.CommitOptions{
+		Branch:               branch,
+		AuthorName:           authorName,
+		AuthorEmail:          authorEmail,
+		SigningKeyFile:       signingKey,
+		SigningKeyPassphrase: signingKeyPassphrase,
+		VerifyCommits:        verifyCommits,
+		VerifyKeysFile:       verifyKeys,
+		ViaPullRequest:       viaPullRequest,
+		FeatureBranch:        fmt.Sprintf("gokp/%s-%d", clusterName, time.Now().Unix()),
+		WaitForMerge:         waitForMerge,
+		MergeTimeout:         mergeTimeout,
+	}
+}
@@ -0,0 +1,203 @@
+package github
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	plumbinghttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/google/go-github/v39/github"
+	"golang.org/x/oauth2"
+)
+
+// GitAuth holds how the installer and the in-cluster GitOps controllers authenticate to the Git server
+type GitAuth struct {
+	// Transport is either "ssh" (deploy keys) or "https" (token or GitHub App)
+	Transport string
+
+	// Token is a GitHub personal access token. It is used for the API and, over https, for Git itself
+	Token string
+
+	// AppID, AppInstallationID and AppPrivateKeyFile are set to use a GitHub App instead of a token
+	AppID             int64
+	AppInstallationID int64
+	AppPrivateKeyFile string
+
+	// PrivateKeyFile and KnownHostsFile are set by CreateRepo when using ssh
+	PrivateKeyFile string
+	KnownHostsFile string
+
+	// installationToken caches the GitHub App installation token until it expires
+	installationToken  string
+	installationExpiry time.Time
+}
+
+// IsSSH returns true if deploy keys over ssh are used
+func (a *GitAuth) IsSSH() bool {
+	return a.Transport == "" || a.Transport == "ssh"
+}
+
+// IsGitHubApp returns true if a GitHub App is used instead of a token
+func (a *GitAuth) IsGitHubApp() bool {
+	return a.AppID != 0
+}
+
+// Validate checks that the auth settings make sense for the chosen GitOps controller
+func (a *GitAuth) Validate(gitOpsController string) error {
+	if a.Transport != "" && a.Transport != "ssh" && a.Transport != "https" {
+		return errors.New("unrecognized git transport: " + a.Transport)
+	}
+
+	// We need either a token or a complete set of GitHub App settings
+	if a.IsGitHubApp() {
+		if a.AppInstallationID == 0 || a.AppPrivateKeyFile == "" {
+			return errors.New("github app auth requires an app id, installation id and private key")
+		}
+	} else if a.Token == "" {
+		return errors.New("either a github token or a github app is required")
+	}
+
+	// Flux can only use a static username/password, and app installation tokens expire after an hour
+	if a.IsGitHubApp() && !a.IsSSH() && (gitOpsController == "fluxcd" || gitOpsController == "flux") {
+		return errors.New("github app auth over https is not supported with flux, use a token or ssh")
+	}
+
+	return nil
+}
+
+// APIToken returns the token to use against the GitHub API, minting an installation token for GitHub Apps
+func (a *GitAuth) APIToken() (string, error) {
+	if !a.IsGitHubApp() {
+		return a.Token, nil
+	}
+
+	// Reuse the installation token until it's close to expiring
+	if a.installationToken != "" && time.Now().Add(5*time.Minute).Before(a.installationExpiry) {
+		return a.installationToken, nil
+	}
+
+	token, expiry, err := appInstallationToken(a.AppID, a.AppInstallationID, a.AppPrivateKeyFile)
+	if err != nil {
+		return "", err
+	}
+	a.installationToken = token
+	a.installationExpiry = expiry
+
+	return token, nil
+}
+
+// transportAuth returns the go-git auth method for the chosen transport
+func (a *GitAuth) transportAuth() (transport.AuthMethod, error) {
+	if a.IsSSH() {
+		return newSSHAuth(a.PrivateKeyFile, a.KnownHostsFile)
+	}
+
+	token, err := a.APIToken()
+	if err != nil {
+		return nil, err
+	}
+
+	// GitHub ignores the username for tokens, but installation tokens require this one
+	return &plumbinghttp.BasicAuth{
+		Username: "x-access-token",
+		Password: token,
+	}, nil
+}
+
+// newGitHubClient returns a GitHub API client using the token or the GitHub App
+func newGitHubClient(ctx context.Context, auth *GitAuth) (*github.Client, error) {
+	token, err := auth.APIToken()
+	if err != nil {
+		return nil, err
+	}
+
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
+	tc := oauth2.NewClient(ctx, ts)
+	return github.NewClient(tc), nil
+}
+
+// appInstallationToken exchanges a signed GitHub App JWT for an installation token
+func appInstallationToken(appID int64, installationID int64, privateKeyFile string) (string, time.Time, error) {
+	jwt, err := appJWT(appID, privateKeyFile)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	// The JWT is only good to talk to the app endpoints
+	ctx := context.Background()
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: jwt, TokenType: "Bearer"})
+	client := github.NewClient(&http.Client{Transport: &oauth2.Transport{Source: ts}})
+
+	token, _, err := client.Apps.CreateInstallationToken(ctx, installationID, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token.GetToken(), token.GetExpiresAt(), nil
+}
+
+// appJWT creates the RS256 signed JWT used to authenticate as a GitHub App
+func appJWT(appID int64, privateKeyFile string) (string, error) {
+	key, err := readAppPrivateKey(privateKeyFile)
+	if err != nil {
+		return "", err
+	}
+
+	// Backdate a bit to allow for clock drift, GitHub allows up to 10 minutes of validity
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": strconv.FormatInt(appID, 10),
+	})
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hashed := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// readAppPrivateKey reads the PEM encoded private key GitHub generates for an App
+func readAppPrivateKey(privateKeyFile string) (*rsa.PrivateKey, error) {
+	content, err := ioutil.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("no PEM data found in: " + privateKeyFile)
+	}
+
+	// GitHub hands out PKCS1 keys, but accept PKCS8 too
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("github app private key is not an RSA key: " + privateKeyFile)
+	}
+
+	return key, nil
+}
@@ -6,98 +6,168 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"io/ioutil"
 	"os"
-	"time"
+	"path/filepath"
+	"strings"
 
 	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
 	plumbingssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	"github.com/google/go-github/v39/github"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/oauth2"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
-// CreateRepo taks a name, token, and a private request and creates a repository on GitHub
-func CreateRepo(name *string, token string, private *bool, workdir string) (bool, string, error) {
+// CreateRepo taks a name, auth settings, and a private request and creates a repository on GitHub.
+// Over ssh a deploy key is created and the host keys of the remote are pinned from opts.KnownHosts if given, otherwise they are scanned.
+// If opts.Org is set the repo is created in that organization, and opts.Team is given access and made code owner.
+// If opts.URL is set that repo is used instead, and the cluster is put under opts.Path in it.
+// The clone is switched to commitOpts.Branch, which is created if the repo doesn't have it.
+func CreateRepo(ctx context.Context, name *string, auth *GitAuth, private *bool, workdir string, opts *RepoOptions, commitOpts *CommitOptions) (bool, string, error) {
 	desc := "GitOps repo Cluster " + *name
 	description := &desc
 	autoInit := true
-	log.Info("Creating repo for: ", *name)
-
-	// display if a private repo was requested
-	if *private {
-		log.Info("Private repo requested")
-	}
 
 	// create the repo with the options passed
 	//	Name: The name of the repo (in this case we use the name of the cluster passed)
 	//	Private: If a private repo should be created
 	//	Description: Description as it will appear on GitHub
 	//	AutoInit: Initialize the repo with the default Readme
-	ctx := context.Background()
-	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
-	tc := oauth2.NewClient(ctx, ts)
-	client := github.NewClient(tc)
-
-	r := &github.Repository{Name: name, Private: private, Description: description, AutoInit: &autoInit}
-	repo, _, err := client.Repositories.Create(ctx, "", r)
+	client, err := newGitHubClient(ctx, auth)
 	if err != nil {
 		return false, "", err
 	}
 
-	// Create an SSHKeypair for the repo.
-	publicKeyBytes, err := generateSSHKeypair(*name, workdir)
-	if err != nil {
-		return false, "", err
+	// Use the existing repo if one was given, otherwise create one
+	var repo *github.Repository
+	if opts.URL != "" {
+		log.Info("Using existing repo: ", opts.URL)
+		repo, err = getExistingRepo(ctx, client, opts.URL, auth)
+		if err != nil {
+			return false, "", err
+		}
+	} else {
+		log.Info("Creating repo for: ", *name)
+
+		// display if a private repo was requested
+		if *private {
+			log.Info("Private repo requested")
+		}
+
+		r := &github.Repository{Name: name, Private: private, Description: description, AutoInit: &autoInit}
+		repo, _, err = client.Repositories.Create(ctx, opts.Org, r)
+		if err != nil {
+			return false, "", err
+		}
 	}
 
-	// upload public sshkey as a deploy key
-	err = uploadDeployKey(publicKeyBytes, repo.GetOwner().GetLogin(), *name, client)
-	if err != nil {
-		return false, "", err
+	// Give the team access if one was requested
+	if opts.Team != "" {
+		err = grantTeamAccess(ctx, client, opts, *name)
+		if err != nil {
+			return false, "", err
+		}
 	}
 
 	// Get the remote URL and set the name of the local copy
-	//repoUrl := repo.GetCloneURL()
-	repoUrl := repo.GetSSHURL()
+	repoUrl := repo.GetCloneURL()
+	if auth.IsSSH() {
+		repoUrl = repo.GetSSHURL()
+	}
+	if opts.URL != "" {
+		repoUrl = opts.URL
+	}
 	localRepo := workdir + "/" + *name
 
+	// Deploy keys are only needed when using ssh
+	if auth.IsSSH() {
+
+		// Create an SSHKeypair for the repo.
+		publicKeyBytes, err := generateSSHKeypair(*name, workdir)
+		if err != nil {
+			return false, "", err
+		}
+
+		// upload public sshkey as a deploy key
+		err = uploadDeployKey(ctx, publicKeyBytes, repo.GetOwner().GetLogin(), repo.GetName(), "gokp-"+*name, client)
+		if err != nil {
+			return false, "", err
+		}
+
+		// Pin the host keys of the remote so we only ever talk to the right server
+		knownHostsFile, err := WriteKnownHosts(repoUrl, opts.KnownHosts, workdir)
+		if err != nil {
+			return false, "", err
+		}
+
+		auth.PrivateKeyFile = workdir + "/" + *name + "_rsa"
+		auth.KnownHostsFile = knownHostsFile
+	}
+
 	// Maksure the localRepo is there
 	os.MkdirAll(localRepo, 0755)
 
-	// Read sshkey to do the clone
-	privateKeyFile := workdir + "/" + *name + "_rsa"
-	authKey, err := plumbingssh.NewPublicKeysFromFile("git", privateKeyFile, "")
+	// Get the auth method for the transport we use
+	authMethod, err := auth.transportAuth()
 	if err != nil {
 		return false, "", err
 	}
 
 	// Clone the repo locally in the working dir (as localRepo)
-	_, err = git.PlainClone(localRepo, false, &git.CloneOptions{
+	clonedRepo, err := git.PlainCloneContext(ctx, localRepo, false, &git.CloneOptions{
 		URL:  repoUrl,
-		Auth: authKey,
-		/*
-			Auth: &http.BasicAuth{
-				Username: "unused",
-				Password: token,
-			},
-		*/
+		Auth: authMethod,
 	})
 
 	if err != nil {
 		return false, "", err
 	}
 
+	// Work on the branch the controllers will track
+	if commitOpts.Branch != "" {
+		err = checkoutBranch(clonedRepo, commitOpts.Branch)
+		if err != nil {
+			return false, "", err
+		}
+	}
+
+	// Don't clobber a cluster that is already in the repo
+	clusterDir := opts.ClusterDir(workdir, *name)
+	if _, err := os.Stat(clusterDir + "/cluster"); err == nil {
+		return false, "", errors.New("repo already has a cluster at: " + opts.ClusterPath(*name))
+	}
+
+	// Make the team code owner so its review is required once the branch is protected
+	if opts.Team != "" {
+		err = writeCodeOwners(localRepo, opts, *name)
+		if err != nil {
+			return false, "", err
+		}
+		_, err = commitAndPushPaths(ctx, localRepo, auth, commitOpts, "adding code owners", ".github")
+		if err != nil {
+			return false, "", err
+		}
+	}
+
 	log.Info("Successfully created new repo: ", repoUrl)
 	return true, repoUrl, nil
 }
 
-// CommitAndPush commits and pushes changes to a github repo that has been changed locally
-func CommitAndPush(dir string, privateKeyFile string, msg string) (bool, error) {
-	// Open the dir for commiting
-	repo, err := git.PlainOpen(dir)
+// CommitAndPush commits and pushes changes to a github repo that has been changed locally.
+// The dir is where the cluster lives, which can be a subdirectory of the repo.
+// In pull request mode the commit goes to the feature branch instead, see OpenPullRequest.
+func CommitAndPush(ctx context.Context, dir string, auth *GitAuth, opts *CommitOptions, msg string) (bool, error) {
+	return commitAndPushPaths(ctx, dir, auth, opts, msg, "cluster")
+}
+
+// commitAndPushPaths commits the given paths, relative to dir, and pushes them
+func commitAndPushPaths(ctx context.Context, dir string, auth *GitAuth, opts *CommitOptions, msg string, paths ...string) (bool, error) {
+	// Open the dir for commiting, looking up for the root of the repo
+	repo, err := git.PlainOpenWithOptions(dir, &git.PlainOpenOptions{DetectDotGit: true})
 	if err != nil {
 		return false, err
 	}
@@ -108,47 +178,77 @@ func CommitAndPush(dir string, privateKeyFile string, msg string) (bool, error)
 		return false, err
 	}
 
-	// Add all you did to the worktree
-	_, err = worktree.Add("cluster")
+	// In pull request mode everything goes to the feature branch
+	if opts.ViaPullRequest {
+		err = checkoutFeatureBranch(repo, worktree, opts.FeatureBranch)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// Paths are added relative to the root of the repo
+	prefix, err := filepath.Rel(worktree.Filesystem.Root(), dir)
 	if err != nil {
 		return false, err
 	}
 
-	// verify status
-	_, err = worktree.Status()
+	// Only what's under the paths is committed, other changes in the repo, like other clusters', are left alone
+	status, err := worktree.Status()
 	if err != nil {
 		return false, err
 	}
+	for _, path := range paths {
+		path = filepath.ToSlash(filepath.Join(prefix, path))
+
+		// Add doesn't see removed files, they're removed from the index instead
+		for file, fileStatus := range status {
+			if fileStatus.Worktree == git.Deleted && (file == path || strings.HasPrefix(file, path+"/")) {
+				_, err = worktree.Remove(file)
+				if err != nil {
+					return false, err
+				}
+			}
+		}
+		if _, err := worktree.Filesystem.Lstat(path); os.IsNotExist(err) {
+			continue
+		}
+		_, err = worktree.Add(path)
+		if err != nil {
+			return false, err
+		}
+	}
 
 	//Commit
-	_, err = worktree.Commit(msg, &git.CommitOptions{
-		Author: &object.Signature{
-			Name: "gokp-bootstrapper",
-			When: time.Now(),
-		},
-		All: true,
+	hash, err := worktree.Commit(msg, &git.CommitOptions{
+		Author:  opts.author(),
+		SignKey: opts.pgpKey,
 	})
 	if err != nil {
 		return false, err
 	}
 
-	// Read sshkey to do the clone
-	authKey, err := plumbingssh.NewPublicKeysFromFile("git", privateKeyFile, "")
+	// go-git only signs with OpenPGP keys, ssh signatures are added afterwards
+	_, err = opts.signCommit(repo, hash)
 	if err != nil {
 		return false, err
 	}
 
-	//Push to repo
-	err = repo.Push(&git.PushOptions{
+	// Get the auth method for the transport we use
+	authMethod, err := auth.transportAuth()
+	if err != nil {
+		return false, err
+	}
+
+	//Push to repo, only pushing the branch we commit to
+	pushOptions := &git.PushOptions{
 		RemoteName: "origin",
-		Auth:       authKey,
-		/*
-			Auth: &http.BasicAuth{
-				Username: "unused",
-				Password: token,
-			},
-		*/
-	})
+		Auth:       authMethod,
+	}
+	if branch := opts.pushBranch(); branch != "" {
+		branchRef := plumbing.NewBranchReferenceName(branch)
+		pushOptions.RefSpecs = []config.RefSpec{config.RefSpec(branchRef + ":" + branchRef)}
+	}
+	err = repo.PushContext(ctx, pushOptions)
 
 	if err != nil {
 		return false, err
@@ -160,6 +260,23 @@ func CommitAndPush(dir string, privateKeyFile string, msg string) (bool, error)
 	return true, nil
 }
 
+// newSSHAuth returns the ssh auth method for go-git, verifying the remote against the known_hosts file
+func newSSHAuth(privateKeyFile string, knownHostsFile string) (*plumbingssh.PublicKeys, error) {
+	authKey, err := plumbingssh.NewPublicKeysFromFile("git", privateKeyFile, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Only trust the keys we pinned at install time
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	authKey.HostKeyCallback = hostKeyCallback
+
+	return authKey, nil
+}
+
 // generateSSHKeypair generates an sshkeypair to use as a deploykey on Github
 func generateSSHKeypair(clustername string, workdir string) ([]byte, error) {
 	key := workdir + "/" + clustername + "_rsa"
@@ -249,15 +366,18 @@ func writeKeyToFile(keyBytes []byte, saveFileTo string) error {
 }
 
 // uploadDeployKey uploads deploykey to GitHub
-func uploadDeployKey(publicKeyBytes []byte, repoOwner string, name string, client *github.Client) error {
+func uploadDeployKey(ctx context.Context, publicKeyBytes []byte, repoOwner string, name string, title string, client *github.Client) error {
 	// Set up the github key object based on the key given to use as a []byte
 	mykey := string(publicKeyBytes)
+	readOnly := false
 	key := &github.Key{
-		Key: &mykey,
+		Key:      &mykey,
+		Title:    &title,
+		ReadOnly: &readOnly,
 	}
 
 	// upload the deploykey to the repo
-	_, _, err := client.Repositories.CreateKey(context.TODO(), repoOwner, name, key)
+	_, _, err := client.Repositories.CreateKey(ctx, repoOwner, name, key)
 	if err != nil {
 		return err
 	}
@@ -265,3 +385,43 @@ func uploadDeployKey(publicKeyBytes []byte, repoOwner string, name string, clien
 	// if we're here we should be okay
 	return nil
 }
+
+// getExistingRepo looks up an existing GitHub repo by its URL, making sure its form matches the transport
+func getExistingRepo(ctx context.Context, client *github.Client, repoUrl string, auth *GitAuth) (*github.Repository, error) {
+	isHttps := strings.HasPrefix(repoUrl, "https://")
+	if auth.IsSSH() == isHttps {
+		return nil, errors.New("git repo url doesn't match the git transport " + auth.Transport + ": " + repoUrl)
+	}
+
+	owner, name, err := ownerAndRepoFromURL(repoUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, _, err := client.Repositories.Get(ctx, owner, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+// ownerAndRepoFromURL returns the owner and name of a GitHub repo from its https, ssh:// or scp-like URL
+func ownerAndRepoFromURL(repoUrl string) (string, string, error) {
+	path := repoUrl
+	if i := strings.Index(path, "://"); i >= 0 {
+		// drop the scheme and the host
+		path = path[i+3:]
+		path = path[strings.Index(path, "/")+1:]
+	} else if i := strings.Index(path, ":"); i >= 0 {
+		// drop the user and the host
+		path = path[i+1:]
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimSuffix(path, ".git"), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("unable to find the owner and repo in: " + repoUrl)
+	}
+
+	return parts[0], parts[1], nil
+}
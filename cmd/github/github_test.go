@@ -0,0 +1,140 @@
+package github
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// newFleetRepo returns a clone of a repo with two clusters in it, and the repo it's cloned from
+func newFleetRepo(t *testing.T) (string, *git.Repository) {
+	origin := t.TempDir()
+	originRepo, err := git.PlainInit(origin, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{
+		"clusters/a/cluster/core/app.yaml":  "a",
+		"clusters/a/cluster/core/old.yaml":  "old",
+		"clusters/a/cluster/gone/last.yaml": "last",
+		"clusters/b/cluster/core/app.yaml":  "b",
+	} {
+		writeTestFile(t, origin, path, content)
+	}
+	worktree, err := originRepo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = worktree.AddGlob("clusters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = worktree.Commit("fleet", &git.CommitOptions{Author: &object.Signature{Name: "fleet", When: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pushing to a checked out branch is refused, so the clone pushes to one of its own
+	clone := t.TempDir()
+	_, err = git.PlainClone(clone, false, &git.CloneOptions{URL: origin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return clone, originRepo
+}
+
+func writeTestFile(t *testing.T, dir string, path string, content string) {
+	err := os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, path), []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommitAndPushOnlyCommitsTheCluster(t *testing.T) {
+	clone, origin := newFleetRepo(t)
+
+	// The cluster changes, and so does another one that isn't ours to commit
+	writeTestFile(t, clone, "clusters/a/cluster/core/app.yaml", "a changed")
+	writeTestFile(t, clone, "clusters/a/cluster/core/new.yaml", "new")
+	os.Remove(filepath.Join(clone, "clusters/a/cluster/core/old.yaml"))
+	os.RemoveAll(filepath.Join(clone, "clusters/a/cluster/gone"))
+	writeTestFile(t, clone, "clusters/b/cluster/core/app.yaml", "b changed")
+	writeTestFile(t, clone, "clusters/b/cluster/core/new.yaml", "b new")
+
+	opts := &CommitOptions{ViaPullRequest: true, FeatureBranch: "gokp-a"}
+	_, err := CommitAndPush(context.Background(), filepath.Join(clone, "clusters/a"), &GitAuth{Transport: "https", Token: "token"}, opts, "updating a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The pushed commit only has cluster a's changes
+	ref, err := origin.Reference("refs/heads/gokp-a", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := origin.CommitObject(ref.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	err = tree.Files().ForEach(func(f *object.File) error {
+		content, err := f.Contents()
+		files[f.Name] = content
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"clusters/a/cluster/core/app.yaml": "a changed",
+		"clusters/a/cluster/core/new.yaml": "new",
+		"clusters/b/cluster/core/app.yaml": "b",
+	}
+	got := []string{}
+	for name := range files {
+		got = append(got, name)
+	}
+	sort.Strings(got)
+	if len(files) != len(want) {
+		t.Errorf("got files %s, want %d", strings.Join(got, ", "), len(want))
+	}
+	for name, content := range want {
+		if files[name] != content {
+			t.Errorf("%s: got %q, want %q", name, files[name], content)
+		}
+	}
+
+	// The other cluster's changes are still there to commit
+	repo, err := git.PlainOpen(clone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := worktree.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.File("clusters/b/cluster/core/app.yaml").Worktree != git.Modified || status.File("clusters/b/cluster/core/new.yaml").Worktree != git.Untracked {
+		t.Errorf("the other cluster's changes were touched:\n%s", status)
+	}
+}
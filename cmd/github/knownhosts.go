@@ -0,0 +1,151 @@
+package github
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// hostKeyAlgos are the host key types we ask the remote for when scanning its keys
+var hostKeyAlgos = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoRSASHA512,
+}
+
+// errHostKeyCaptured is returned from the scan callback to stop the handshake once we have the key
+var errHostKeyCaptured = errors.New("host key captured")
+
+// WriteKnownHosts writes the known_hosts file for the given repo into the workdir and returns its path.
+// If knownHosts is set, that file is used as-is. Otherwise the host keys are scanned from the remote.
+func WriteKnownHosts(repoUrl string, knownHosts string, workdir string) (string, error) {
+	knownHostsFile := workdir + "/" + "known_hosts"
+
+	// Use the user supplied file if one was given, making sure it parses
+	var lines []string
+	var err error
+	if knownHosts != "" {
+		log.Info("Using known hosts from: ", knownHosts)
+		lines, err = ReadKnownHosts(knownHosts)
+	} else {
+		lines, err = ScanKnownHosts(repoUrl)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Write the file out so both go-git and the templates can use it
+	err = writeKeyToFile([]byte(strings.Join(lines, "\n")+"\n"), knownHostsFile)
+	if err != nil {
+		return "", err
+	}
+
+	return knownHostsFile, nil
+}
+
+// ScanKnownHosts connects to the SSH server behind the repo URL and returns its host keys in known_hosts format
+func ScanKnownHosts(repoUrl string) ([]string, error) {
+	addr, err := sshAddrFromURL(repoUrl)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Scanning host keys for: ", addr)
+
+	// Ask for each key type in turn, since a handshake only ever presents one
+	lines := []string{}
+	for _, algo := range hostKeyAlgos {
+		var hostKey ssh.PublicKey
+		config := &ssh.ClientConfig{
+			User:              "git",
+			HostKeyAlgorithms: []string{algo},
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				hostKey = key
+				return errHostKeyCaptured
+			},
+			Timeout: 15 * time.Second,
+		}
+
+		// The dial always fails since we abort the handshake, we only care about the key
+		conn, err := ssh.Dial("tcp", addr, config)
+		if err == nil {
+			conn.Close()
+		}
+		if hostKey == nil {
+			continue
+		}
+		lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostKey))
+	}
+
+	// If we didn't get anything, we can't pin the remote
+	if len(lines) == 0 {
+		return nil, errors.New("unable to scan host keys for: " + addr)
+	}
+
+	return lines, nil
+}
+
+// ReadKnownHosts reads and validates a known_hosts file, returning the entries in it
+func ReadKnownHosts(knownHostsFile string) ([]string, error) {
+	content, err := ioutil.ReadFile(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Make sure the line is something ssh understands
+		_, _, _, _, _, err := ssh.ParseKnownHosts([]byte(line))
+		if err != nil {
+			return nil, errors.New("invalid known_hosts entry in " + knownHostsFile + ": " + err.Error())
+		}
+		lines = append(lines, line)
+	}
+
+	if len(lines) == 0 {
+		return nil, errors.New("no known_hosts entries found in: " + knownHostsFile)
+	}
+
+	return lines, nil
+}
+
+// sshAddrFromURL returns the host:port of an SSH git URL. Both scp-like (git@host:path) and ssh:// URLs are supported
+func sshAddrFromURL(repoUrl string) (string, error) {
+	// ssh://[user@]host[:port]/path
+	if strings.Contains(repoUrl, "://") {
+		u, err := url.Parse(repoUrl)
+		if err != nil {
+			return "", err
+		}
+		if u.Scheme != "ssh" {
+			return "", errors.New("not an ssh url: " + repoUrl)
+		}
+		port := u.Port()
+		if port == "" {
+			port = "22"
+		}
+		return net.JoinHostPort(u.Hostname(), port), nil
+	}
+
+	// [user@]host:path
+	hostPart := strings.SplitN(repoUrl, ":", 2)[0]
+	if i := strings.LastIndex(hostPart, "@"); i >= 0 {
+		hostPart = hostPart[i+1:]
+	}
+	if hostPart == "" || hostPart == repoUrl {
+		return "", errors.New("unable to parse ssh url: " + repoUrl)
+	}
+
+	return net.JoinHostPort(hostPart, "22"), nil
+}
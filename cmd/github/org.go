@@ -0,0 +1,165 @@
+package github
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-github/v39/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// RepoOptions holds where and how the GitOps repo is created on GitHub
+type RepoOptions struct {
+	// KnownHosts is the path to a known_hosts file for the Git server. The host keys are scanned if empty
+	KnownHosts string
+
+	// URL is an existing repo to use instead of creating a new one
+	URL string
+
+	// Path is the subdirectory of the repo the cluster lives in. Defaults to clusters/<name> for an existing repo
+	Path string
+
+	// Org is the GitHub organization to create the repo in. The token owner's account is used if empty
+	Org string
+
+	// Team is the slug of the org team that is granted TeamPermission on the repo
+	Team           string
+	TeamPermission string
+
+	// CodeOwnersCore makes the team code owner of cluster/core, cluster/apps and cluster/capi as well as cluster/tenants
+	CodeOwnersCore bool
+}
+
+// teamPermissions maps the permissions we accept to the ones the GitHub API expects
+var teamPermissions = map[string]string{
+	"write": "push",
+	"admin": "admin",
+}
+
+// Validate checks that the repo options are consistent, and work with the auth
+func (o *RepoOptions) Validate(auth *GitAuth) error {
+	if o.Team != "" && o.Org == "" {
+		return errors.New("a git team can only be used together with a git org")
+	}
+
+	if o.Team != "" {
+		if _, ok := teamPermissions[o.TeamPermission]; !ok {
+			return errors.New("unrecognized git team permission: " + o.TeamPermission)
+		}
+	}
+
+	if o.CodeOwnersCore && o.Team == "" {
+		return errors.New("code owners for cluster/core require a git team")
+	}
+
+	// An installation token can only create repos in the org the app is installed in
+	if o.URL == "" && o.Org == "" && auth != nil && auth.IsGitHubApp() {
+		return errors.New("github app auth requires a git org to create the repo in")
+	}
+
+	// We don't change the settings of repos we didn't create
+	if o.URL != "" && (o.Org != "" || o.Team != "") {
+		return errors.New("a git org or team can't be used with an existing repo")
+	}
+
+	// The path has to stay inside the repo
+	if o.Path != "" && (filepath.IsAbs(o.Path) || strings.HasPrefix(filepath.Clean(o.Path), "..")) {
+		return errors.New("git path must be relative to the root of the repo: " + o.Path)
+	}
+
+	return nil
+}
+
+// ClusterPath returns the path of the cluster inside the repo, relative to its root. Empty means the root
+func (o *RepoOptions) ClusterPath(name string) string {
+	if o.Path != "" {
+		return strings.Trim(filepath.ToSlash(filepath.Clean(o.Path)), "/")
+	}
+
+	// Fleet repos hold many clusters so keep them apart
+	if o.URL != "" {
+		return "clusters/" + name
+	}
+
+	return ""
+}
+
+// ClusterDir returns the local directory the cluster lives in, under the clone of the repo in the workdir
+func (o *RepoOptions) ClusterDir(workdir string, name string) string {
+	repoDir := workdir + "/" + name
+	if path := o.ClusterPath(name); path != "" {
+		repoDir = repoDir + "/" + path
+	}
+
+	return repoDir
+}
+
+// grantTeamAccess gives the team of the org access to the repo
+func grantTeamAccess(ctx context.Context, client *github.Client, opts *RepoOptions, name string) error {
+	log.Info("Granting team ", opts.Team, " ", opts.TeamPermission, " access to ", opts.Org, "/", name)
+	_, err := client.Teams.AddTeamRepoBySlug(ctx, opts.Org, opts.Team, opts.Org, name, &github.TeamAddTeamRepoOptions{
+		Permission: teamPermissions[opts.TeamPermission],
+	})
+
+	return err
+}
+
+// writeCodeOwners writes a CODEOWNERS file into the local repo making the team owner of the cluster dirs
+func writeCodeOwners(localRepo string, opts *RepoOptions, name string) error {
+	owner := "@" + opts.Org + "/" + opts.Team
+	clusterPath := "/cluster/"
+	if path := opts.ClusterPath(name); path != "" {
+		clusterPath = "/" + path + "/cluster/"
+	}
+
+	// The team owns CODEOWNERS too, or its reviews could be dropped without one
+	codeOwners := "# Managed by gokp\n/.github/CODEOWNERS " + owner + "\n" + clusterPath + "tenants/ " + owner + "\n"
+	if opts.CodeOwnersCore {
+		codeOwners += clusterPath + "core/ " + owner + "\n"
+		codeOwners += clusterPath + "apps/ " + owner + "\n"
+		codeOwners += clusterPath + "capi/ " + owner + "\n"
+	}
+
+	// GitHub looks for CODEOWNERS in the .github dir
+	err := os.MkdirAll(localRepo+"/.github", 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(localRepo+"/.github/CODEOWNERS", []byte(codeOwners), 0644)
+}
+
+// ProtectRepo protects the given branch of the repo so changes need a pull request, and the ones to what the team
+// owns in CODEOWNERS need its review. This has to run after the installer is done pushing, since the deploy key
+// can't bypass it.
+func ProtectRepo(ctx context.Context, name string, auth *GitAuth, opts *RepoOptions, branch string) (bool, error) {
+	// Only org repos with a team get protected, someone has to be able to review
+	if opts.URL != "" || opts.Org == "" || opts.Team == "" {
+		return true, nil
+	}
+	log.Info("Protecting the ", branch, " branch of ", opts.Org, "/", name)
+
+	client, err := newGitHubClient(ctx, auth)
+	if err != nil {
+		return false, err
+	}
+
+	// Only the code owners' review is required, for the paths they own
+	_, _, err = client.Repositories.UpdateBranchProtection(ctx, opts.Org, name, branch, &github.ProtectionRequest{
+		RequiredPullRequestReviews: &github.PullRequestReviewsEnforcementRequest{
+			DismissStaleReviews:          true,
+			RequireCodeOwnerReviews:      true,
+			RequiredApprovingReviewCount: 0,
+		},
+		EnforceAdmins: false,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,466 @@
+package github
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/utils/merkletrie"
+	"github.com/google/go-github/v39/github"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"sigs.k8s.io/yaml"
+)
+
+// maxPullRequestFiles is how many changed files we list in a pull request description before summarizing
+var maxPullRequestFiles = 500
+
+// CommitOptions holds how changes are committed and pushed to the GitOps repo
+type CommitOptions struct {
+	// Branch is the branch the GitOps controllers track. The repo's current branch is used if empty
+	Branch string
+
+	// AuthorName and AuthorEmail are who the commits are made as
+	AuthorName  string
+	AuthorEmail string
+
+	// SigningKeyFile is an OpenPGP or ssh private key to sign commits with, see Validate
+	SigningKeyFile       string
+	SigningKeyPassphrase string
+
+	// VerifyCommits makes Flux only reconcile commits signed by the OpenPGP signing key or the keys in VerifyKeysFile
+	VerifyCommits  bool
+	VerifyKeysFile string
+
+	// ViaPullRequest pushes to FeatureBranch instead of Branch so a pull request can be opened for it
+	ViaPullRequest bool
+	FeatureBranch  string
+
+	// WaitForMerge waits up to MergeTimeout for the pull request to be merged
+	WaitForMerge bool
+	MergeTimeout time.Duration
+
+	// pgpKey and sshSigner are loaded from SigningKeyFile by Validate
+	pgpKey    *openpgp.Entity
+	sshSigner ssh.Signer
+}
+
+// author returns the signature to commit as, falling back to the installer's name
+func (o *CommitOptions) author() *object.Signature {
+	name := o.AuthorName
+	if name == "" {
+		name = "gokp-bootstrapper"
+	}
+
+	return &object.Signature{
+		Name:  name,
+		Email: o.AuthorEmail,
+		When:  time.Now(),
+	}
+}
+
+// pushBranch returns the branch commits are pushed to. Empty means whatever is checked out
+func (o *CommitOptions) pushBranch() string {
+	if o.ViaPullRequest {
+		return o.FeatureBranch
+	}
+
+	return o.Branch
+}
+
+// checkoutFeatureBranch switches the local repo to the feature branch, creating it from HEAD if needed.
+// Local changes are kept so they can be committed on the branch.
+func checkoutFeatureBranch(repo *git.Repository, worktree *git.Worktree, branch string) error {
+	branchRef := plumbing.NewBranchReferenceName(branch)
+
+	// Nothing to do if we're already on it
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	if head.Name() == branchRef {
+		return nil
+	}
+
+	// Only create the branch if it's not there yet
+	_, err = repo.Reference(branchRef, false)
+	create := err == plumbing.ErrReferenceNotFound
+
+	log.Info("Switching to branch: ", branch)
+	return worktree.Checkout(&git.CheckoutOptions{
+		Branch: branchRef,
+		Create: create,
+		Keep:   true,
+	})
+}
+
+// OpenPullRequest opens a pull request for the feature branch of the repo the dir is in, and returns its URL.
+// The pull request targets opts.Branch, or the repo's default branch if that's empty. The description lists
+// the manifests that changed. If opts.WaitForMerge is set it waits until it's merged, and the local repo is
+// moved to the merged base branch.
+func OpenPullRequest(ctx context.Context, dir string, auth *GitAuth, opts *CommitOptions, title string) (string, error) {
+	// Open the dir, looking up for the root of the repo
+	repo, err := git.PlainOpenWithOptions(dir, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return "", err
+	}
+
+	// Find which GitHub repo we're talking about
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return "", err
+	}
+	owner, name, err := ownerAndRepoFromURL(remote.Config().URLs[0])
+	if err != nil {
+		return "", err
+	}
+
+	client, err := newGitHubClient(ctx, auth)
+	if err != nil {
+		return "", err
+	}
+
+	// Target the branch the controllers track
+	base := opts.Branch
+	if base == "" {
+		ghRepo, _, err := client.Repositories.Get(ctx, owner, name)
+		if err != nil {
+			return "", err
+		}
+		base = ghRepo.GetDefaultBranch()
+	}
+
+	// The base branch has to be on GitHub to open a pull request against it
+	_, resp, err := client.Repositories.GetBranch(ctx, owner, name, base, false)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return "", errors.New("base branch " + base + " does not exist on " + owner + "/" + name + ", push it before opening a pull request against it")
+		}
+		return "", err
+	}
+
+	// And fetched, so the changes can be described against it
+	err = fetchOrigin(ctx, repo, auth)
+	if err != nil {
+		return "", err
+	}
+
+	// Reuse the pull request if one is already open for the branch
+	prs, _, err := client.PullRequests.List(ctx, owner, name, &github.PullRequestListOptions{
+		Head:  owner + ":" + opts.FeatureBranch,
+		Base:  base,
+		State: "open",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var pr *github.PullRequest
+	if len(prs) > 0 {
+		pr = prs[0]
+		log.Info("Pull request already open: ", pr.GetHTMLURL())
+	} else {
+		// Describe what changed between the default branch and the feature branch
+		body, err := describeChanges(repo, base, opts.FeatureBranch)
+		if err != nil {
+			return "", err
+		}
+
+		pr, _, err = client.PullRequests.Create(ctx, owner, name, &github.NewPullRequest{
+			Title: &title,
+			Head:  &opts.FeatureBranch,
+			Base:  &base,
+			Body:  &body,
+		})
+		if err != nil {
+			return "", err
+		}
+		log.Info("Opened pull request: ", pr.GetHTMLURL())
+	}
+
+	if !opts.WaitForMerge {
+		return pr.GetHTMLURL(), nil
+	}
+
+	// Wait for someone to review and merge it
+	err = waitForMerge(ctx, client, owner, name, pr.GetNumber(), opts.MergeTimeout)
+	if err != nil {
+		return pr.GetHTMLURL(), err
+	}
+
+	// Move the local repo to what was merged
+	err = syncBranch(ctx, repo, auth, base)
+	if err != nil {
+		return pr.GetHTMLURL(), err
+	}
+
+	return pr.GetHTMLURL(), nil
+}
+
+// waitForMerge polls the pull request until it's merged, closed, or the timeout is reached
+func waitForMerge(ctx context.Context, client *github.Client, owner string, name string, number int, timeout time.Duration) error {
+	log.Info("Waiting for pull request #", number, " to be merged")
+	deadline := time.Now().Add(timeout)
+	for {
+		pr, _, err := client.PullRequests.Get(ctx, owner, name, number)
+		if err != nil {
+			return err
+		}
+		if pr.GetMerged() {
+			log.Info("Pull request #", number, " was merged")
+			return nil
+		}
+		if pr.GetState() == "closed" {
+			return fmt.Errorf("pull request #%d was closed without being merged", number)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("pull request #%d was not merged after %s", number, timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for pull request #%d: %w", number, ctx.Err())
+		case <-time.After(30 * time.Second):
+		}
+	}
+}
+
+// checkoutBranch switches the freshly cloned repo to the branch, starting it from origin if it's there
+// and from HEAD otherwise. Pushing then creates it on origin.
+func checkoutBranch(repo *git.Repository, branch string) error {
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	branchRef := plumbing.NewBranchReferenceName(branch)
+
+	// Nothing to do if the clone is already on it
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	if head.Name() == branchRef {
+		return nil
+	}
+
+	hash := head.Hash()
+	remoteRef, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", branch), true)
+	if err == nil {
+		hash = remoteRef.Hash()
+	} else {
+		log.Info("Branch ", branch, " is not on origin yet, starting it from ", head.Name().Short())
+	}
+
+	err = repo.Storer.SetReference(plumbing.NewHashReference(branchRef, hash))
+	if err != nil {
+		return err
+	}
+
+	log.Info("Switching to branch: ", branch)
+	return worktree.Checkout(&git.CheckoutOptions{Branch: branchRef})
+}
+
+// syncBranch checks out the branch and pulls it from origin
+func syncBranch(ctx context.Context, repo *git.Repository, auth *GitAuth, branch string) error {
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	// Fetch first so we can create the local branch from origin if it's not there
+	err = fetchOrigin(ctx, repo, auth)
+	if err != nil {
+		return err
+	}
+	remoteRef, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", branch), true)
+	if err != nil {
+		return err
+	}
+
+	// Point the local branch at what's on origin
+	branchRef := plumbing.NewBranchReferenceName(branch)
+	err = repo.Storer.SetReference(plumbing.NewHashReference(branchRef, remoteRef.Hash()))
+	if err != nil {
+		return err
+	}
+
+	return worktree.Checkout(&git.CheckoutOptions{
+		Branch: branchRef,
+		Force:  true,
+	})
+}
+
+// fetchOrigin fetches the branches of origin into the repo
+func fetchOrigin(ctx context.Context, repo *git.Repository, auth *GitAuth) error {
+	authMethod, err := auth.transportAuth()
+	if err != nil {
+		return err
+	}
+
+	err = repo.FetchContext(ctx, &git.FetchOptions{RemoteName: "origin", Auth: authMethod})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+
+	return nil
+}
+
+// SyncRepo checks out the branch of the repo the dir is in and pulls it from origin, so it's what the GitOps
+// controller sees. It refuses to if the repo has local changes, since they would be lost.
+func SyncRepo(ctx context.Context, dir string, auth *GitAuth, branch string) error {
+	// Open the dir, looking up for the root of the repo
+	repo, err := git.PlainOpenWithOptions(dir, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return err
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	status, err := worktree.Status()
+	if err != nil {
+		return err
+	}
+	if !status.IsClean() {
+		return errors.New("the repo at " + worktree.Filesystem.Root() + " has local changes, commit or discard them first")
+	}
+
+	log.Info("Pulling branch ", branch, " from origin")
+	return syncBranch(ctx, repo, auth, branch)
+}
+
+// describeChanges returns a markdown description of the manifests changed on branch compared to origin/base
+func describeChanges(repo *git.Repository, base string, branch string) (string, error) {
+	baseRef, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", base), true)
+	if err == plumbing.ErrReferenceNotFound {
+		return "", errors.New("base branch " + base + " was not fetched from origin, can't describe the changes against it")
+	}
+	if err != nil {
+		return "", err
+	}
+	branchRef, err := repo.Reference(plumbing.NewBranchReferenceName(branch), true)
+	if err != nil {
+		return "", err
+	}
+
+	baseTree, err := commitTree(repo, baseRef.Hash())
+	if err != nil {
+		return "", err
+	}
+	branchTree, err := commitTree(repo, branchRef.Hash())
+	if err != nil {
+		return "", err
+	}
+
+	changes, err := object.DiffTree(baseTree, branchTree)
+	if err != nil {
+		return "", err
+	}
+
+	// Group the changed files by what happened to them
+	sections := map[merkletrie.Action][]string{}
+	for _, change := range changes {
+		action, err := change.Action()
+		if err != nil {
+			return "", err
+		}
+		from, to, err := change.Files()
+		if err != nil {
+			return "", err
+		}
+
+		// Deleted files only exist in the base
+		file, path := to, change.To.Name
+		if action == merkletrie.Delete {
+			file, path = from, change.From.Name
+		}
+		sections[action] = append(sections[action], describeFile(file, path))
+	}
+
+	body := "Changes generated by gokp.\n"
+	listed := 0
+	for _, section := range []struct {
+		action merkletrie.Action
+		title  string
+	}{
+		{merkletrie.Insert, "Added"},
+		{merkletrie.Modify, "Changed"},
+		{merkletrie.Delete, "Removed"},
+	} {
+		lines := sections[section.action]
+		if len(lines) == 0 {
+			continue
+		}
+		sort.Strings(lines)
+
+		body += fmt.Sprintf("\n### %s (%d)\n\n", section.title, len(lines))
+		for i, line := range lines {
+			// GitHub limits the size of the description, so don't list everything on big exports
+			if listed >= maxPullRequestFiles {
+				body += fmt.Sprintf("- ...and %d more\n", len(lines)-i)
+				break
+			}
+			body += "- " + line + "\n"
+			listed++
+		}
+	}
+
+	if len(changes) == 0 {
+		return "", errors.New("no changes found between " + base + " and " + branch)
+	}
+
+	return body, nil
+}
+
+// commitTree returns the tree of the given commit
+func commitTree(repo *git.Repository, hash plumbing.Hash) (*object.Tree, error) {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return commit.Tree()
+}
+
+// describeFile returns the path of the file, along with the kind and name of the manifest if it's one
+func describeFile(file *object.File, path string) string {
+	line := "`" + path + "`"
+	ext := filepath.Ext(path)
+	if ext != ".yaml" && ext != ".yml" {
+		return line
+	}
+
+	// Only look at the first document, that's all the exporter writes
+	contents, err := file.Contents()
+	if err != nil {
+		return line
+	}
+	manifest := struct {
+		Kind     string `json:"kind"`
+		Metadata struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"metadata"`
+	}{}
+	err = yaml.Unmarshal([]byte(strings.SplitN(contents, "\n---", 2)[0]), &manifest)
+	if err != nil || manifest.Kind == "" || manifest.Metadata.Name == "" {
+		return line
+	}
+
+	name := manifest.Metadata.Name
+	if manifest.Metadata.Namespace != "" {
+		name = manifest.Metadata.Namespace + "/" + name
+	}
+
+	return line + " " + manifest.Kind + " " + name
+}
@@ -0,0 +1,246 @@
+package github
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshSigNamespace is the namespace git uses for ssh signatures on commits
+var sshSigNamespace = "git"
+
+// Validate checks the commit options and loads the signing key, so a bad key fails before anything is built
+func (o *CommitOptions) Validate(gitOpsController string) error {
+	if o.SigningKeyFile != "" {
+		err := o.loadSigningKey()
+		if err != nil {
+			return err
+		}
+	}
+
+	if !o.VerifyCommits {
+		return nil
+	}
+
+	// Flux only verifies OpenPGP signatures, and the commits it tracks have to be signed
+	if gitOpsController != "fluxcd" && gitOpsController != "flux" {
+		return errors.New("commit verification is only supported with flux")
+	}
+	if o.pgpKey == nil {
+		return errors.New("commit verification requires an OpenPGP signing key")
+	}
+
+	return nil
+}
+
+// VerificationKeys returns the armored OpenPGP public keys the GitOps controller should trust.
+// That's the signing key plus the ones in VerifyKeysFile.
+func (o *CommitOptions) VerificationKeys() (string, error) {
+	if o.pgpKey == nil {
+		return "", errors.New("no OpenPGP signing key loaded")
+	}
+
+	var b bytes.Buffer
+	w, err := armor.Encode(&b, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return "", err
+	}
+	err = o.pgpKey.Serialize(w)
+	if err != nil {
+		return "", err
+	}
+	err = w.Close()
+	if err != nil {
+		return "", err
+	}
+	keys := b.String() + "\n"
+
+	// Add the extra keys as they are, after making sure they parse
+	if o.VerifyKeysFile != "" {
+		extra, err := ioutil.ReadFile(o.VerifyKeysFile)
+		if err != nil {
+			return "", err
+		}
+		_, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(extra))
+		if err != nil {
+			return "", errors.New("unable to read OpenPGP keys from " + o.VerifyKeysFile + ": " + err.Error())
+		}
+		keys += string(extra)
+	}
+
+	return keys, nil
+}
+
+// loadSigningKey reads the private key in SigningKeyFile, which is either an armored OpenPGP key or an ssh key
+func (o *CommitOptions) loadSigningKey() error {
+	content, err := ioutil.ReadFile(o.SigningKeyFile)
+	if err != nil {
+		return err
+	}
+
+	if strings.Contains(string(content), "BEGIN PGP PRIVATE KEY BLOCK") {
+		o.pgpKey, err = readPGPSigningKey(content, o.SigningKeyPassphrase)
+		return err
+	}
+
+	// Anything else has to be an ssh key
+	if o.SigningKeyPassphrase != "" {
+		o.sshSigner, err = ssh.ParsePrivateKeyWithPassphrase(content, []byte(o.SigningKeyPassphrase))
+	} else {
+		o.sshSigner, err = ssh.ParsePrivateKey(content)
+	}
+	if err != nil {
+		return errors.New("unable to read signing key " + o.SigningKeyFile + ": " + err.Error())
+	}
+
+	return nil
+}
+
+// readPGPSigningKey returns the first entity with a private key in the armored key ring, decrypting it if needed
+func readPGPSigningKey(content []byte, passphrase string) (*openpgp.Entity, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entity := range entities {
+		if entity.PrivateKey == nil {
+			continue
+		}
+
+		// The primary key and the subkeys can all be encrypted
+		keys := []*openpgp.Key{{PrivateKey: entity.PrivateKey}}
+		for i := range entity.Subkeys {
+			keys = append(keys, &openpgp.Key{PrivateKey: entity.Subkeys[i].PrivateKey})
+		}
+		for _, key := range keys {
+			if key.PrivateKey == nil || !key.PrivateKey.Encrypted {
+				continue
+			}
+			if passphrase == "" {
+				return nil, errors.New("the OpenPGP signing key is encrypted and no passphrase was given")
+			}
+			err = key.PrivateKey.Decrypt([]byte(passphrase))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return entity, nil
+	}
+
+	return nil, errors.New("no OpenPGP private key found")
+}
+
+// signCommitSSH replaces the commit at HEAD with a copy signed by the ssh key, the way git does with gpg.format=ssh.
+// go-git can only sign with OpenPGP keys itself.
+func signCommitSSH(repo *git.Repository, hash plumbing.Hash, signer ssh.Signer) (plumbing.Hash, error) {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	// The signature covers the commit as it is without one
+	unsigned := &plumbing.MemoryObject{}
+	err = commit.EncodeWithoutSignature(unsigned)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	reader, err := unsigned.Reader()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	commit.PGPSignature, err = sshSign(signer, data)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	// Store the signed commit and move the branch to it
+	signed := repo.Storer.NewEncodedObject()
+	err = commit.Encode(signed)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	signedHash, err := repo.Storer.SetEncodedObject(signed)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	err = repo.Storer.SetReference(plumbing.NewHashReference(head.Name(), signedHash))
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return signedHash, nil
+}
+
+// sshSign returns the armored SSHSIG signature of the data, as described in PROTOCOL.sshsig of OpenSSH
+func sshSign(signer ssh.Signer, data []byte) (string, error) {
+	hash := sha512.Sum512(data)
+	signedData := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{sshSigNamespace, "", "sha512", hash[:]})...)
+
+	// RSA keys have to use a SHA-2 signature, the SHA-1 default is rejected by git
+	var signature *ssh.Signature
+	var err error
+	if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		signature, err = algorithmSigner.SignWithAlgorithm(rand.Reader, signedData, ssh.SigAlgoRSASHA2512)
+	} else {
+		signature, err = signer.Sign(rand.Reader, signedData)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	blob := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}{1, signer.PublicKey().Marshal(), sshSigNamespace, "", "sha512", ssh.Marshal(signature)})...)
+
+	// Armor it the way ssh-keygen does, 70 characters a line
+	encoded := base64.StdEncoding.EncodeToString(blob)
+	armored := "-----BEGIN SSH SIGNATURE-----\n"
+	for len(encoded) > 70 {
+		armored += encoded[:70] + "\n"
+		encoded = encoded[70:]
+	}
+	armored += encoded + "\n-----END SSH SIGNATURE-----\n"
+
+	return armored, nil
+}
+
+// signCommit signs the commit with the ssh key if one is used. OpenPGP keys are handled by go-git when committing
+func (o *CommitOptions) signCommit(repo *git.Repository, hash plumbing.Hash) (plumbing.Hash, error) {
+	if o.sshSigner == nil {
+		return hash, nil
+	}
+
+	return signCommitSSH(repo, hash, o.sshSigner)
+}
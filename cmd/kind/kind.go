@@ -1,6 +1,8 @@
 package kind
 
 import (
+	"context"
+
 	"github.com/christianh814/gokp/cmd/utils"
 	"sigs.k8s.io/kind/pkg/cluster"
 )
@@ -14,8 +16,13 @@ nodes:
       containerPath: /var/run/docker.sock
 `
 
-// CreateKindCluster creates KIND cluster to use as the temp cluster manager
-func CreateKindCluster(name string, cfg string) error {
+// CreateKindCluster creates KIND cluster to use as the temp cluster manager.
+// KIND can't be stopped half way, so the context only keeps it from starting.
+func CreateKindCluster(ctx context.Context, name string, cfg string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
 	/* trying to quiet down KIND*/
 	/*
 		klogger := kindcmd.NewLogger()
@@ -66,7 +73,11 @@ func DeleteKindCluster(name string, cfg string) error {
 }
 
 // CreateCAPDKindClsuter creates KIND cluster to use as the temp cluster manager for a CAPD deployment
-func CreateCAPDKindCluster(name string, cfg string, dir string) error {
+func CreateCAPDKindCluster(ctx context.Context, name string, cfg string, dir string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
 	// Writeout the KIND config for CAPD
 	kindcfg := dir + "/kindconfig.yaml"
 	//dummy vars since we don't need them
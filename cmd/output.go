@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+
+	"github.com/christianh814/gokp/cmd/events"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// setOutput sends the events where the --output flag says. In json mode the events are written
+// to stdout a line at a time, and the logs go to stderr as JSON too.
+func setOutput(cmd *cobra.Command) error {
+	output, _ := cmd.Flags().GetString("output")
+	switch output {
+	case "text":
+		events.SetPublisher(events.LogPublisher{})
+	case "json":
+		events.SetPublisher(events.NewJSONPublisher(os.Stdout))
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return errors.New("unrecognized output: " + output)
+	}
+
+	return nil
+}
+
+// fail publishes the error and exits
+func fail(code string, err error) {
+	events.Fail(code, err)
+	os.Exit(1)
+}
+
+// failCommand fails with the code, or as canceled if the command was interrupted
+func failCommand(cmd *cobra.Command, code string, err error) {
+	if cmd.Context().Err() != nil {
+		code = events.CodeCanceled
+	}
+	fail(code, err)
+}
@@ -1,9 +1,13 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	"github.com/spf13/viper"
@@ -25,6 +29,9 @@ meant to be a GitOps native Kubernetes cluster ready to use.
 At day 0, GOKP is meant to be GitOps enabled at install.
 This utility is a "Proof of Concept" build and shoud not
 be used at all.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return setOutput(cmd)
+	},
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	// Run: func(cmd *cobra.Command, args []string) { },
@@ -32,8 +39,21 @@ be used at all.`,
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// The commands run with a context that's done on the first Ctrl-C, a second one exits right away.
 func Execute() {
-	cobra.CheckErr(rootCmd.Execute())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Warn("Interrupted, stopping. Press Ctrl-C again to exit right away")
+		signal.Stop(signals)
+		cancel()
+	}()
+
+	cobra.CheckErr(rootCmd.ExecuteContext(ctx))
 }
 
 func init() {
@@ -44,6 +64,7 @@ func init() {
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.gokp.yaml)")
+	rootCmd.PersistentFlags().String("output", "text", "How to report progress. Either text, or json for a stream of events on stdout.")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -1,20 +1,28 @@
 package templates
 
 import (
+	"context"
 	"encoding/base64"
+	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/christianh814/gokp/cmd/export"
 	"github.com/christianh814/gokp/cmd/github"
 	"github.com/christianh814/gokp/cmd/utils"
 )
 
 // CreateArgoRepoSkel creates the skeleton repo structure at the given place
-func CreateArgoRepoSkel(name *string, workdir string, ghtoken string, gitopsrepo string, private *bool) (bool, error) {
-	// Repo Dir should be our workdir + the name of our cluster
-	repoDir := workdir + "/" + *name
+func CreateArgoRepoSkel(ctx context.Context, name *string, workdir string, auth *github.GitAuth, gitopsrepo string, private *bool, repoPath string, commitOpts *github.CommitOptions, layout string) (bool, error) {
+	// Repo Dir should be our workdir + the name of our cluster, plus the path of the cluster inside the repo
+	cloneDir := workdir + "/" + *name
+	repoDir := cloneDir
+	if repoPath != "" {
+		repoDir = cloneDir + "/" + repoPath
+	}
 	directories := []string{
 		repoDir + "/" + "cluster/bootstrap/base/",
 		repoDir + "/" + "cluster/bootstrap/overlays/",
@@ -25,8 +33,8 @@ func CreateArgoRepoSkel(name *string, workdir string, ghtoken string, gitopsrepo
 		repoDir + "/" + "cluster/tenants/kuard/",
 	}
 
-	// check if the dir is there. If not, error out
-	if _, err := os.Stat(repoDir); os.IsNotExist(err) {
+	// check if the clone is there. If not, error out
+	if _, err := os.Stat(cloneDir); os.IsNotExist(err) {
 		return false, err
 	}
 
@@ -62,57 +70,66 @@ func CreateArgoRepoSkel(name *string, workdir string, ghtoken string, gitopsrepo
 
 		//	Check to see if I need to install the ArgoCD Overlays
 		if strings.Contains(dir, "bootstrap") && strings.Contains(dir, "overlays") && strings.Contains(dir, "default") {
-			// setup dummy values because the func needs it
-			dummyVars := struct {
-				Dummykey string
+			// The known hosts patch is only needed when using ssh
+			overlayVars := struct {
+				SSHTransport bool
 			}{
-				Dummykey: "unused",
+				SSHTransport: auth.IsSSH(),
 			}
 
 			// Write out the kustomization file based on the vars and the template
-			_, err := utils.WriteTemplate(ArgoCdOverlayDefaultKustomize, dir+"/"+"kustomization.yaml", dummyVars)
+			_, err := utils.WriteTemplate(ArgoCdOverlayDefaultKustomize, dir+"/"+"kustomization.yaml", overlayVars)
 			if err != nil {
 				return false, err
 			}
 
 			// Write out the argocd configmap based on the vars and template
-			_, err = utils.WriteTemplate(ArgoCdOverlayDefaultConfigMap, dir+"/"+"argocd-cm.yaml", dummyVars)
+			_, err = utils.WriteTemplate(ArgoCdOverlayDefaultConfigMap, dir+"/"+"argocd-cm.yaml", overlayVars)
 			if err != nil {
 				return false, err
 			}
 
-			// Write out the argocd secret of the repo based on the vars and template
-			sshKeyFile, err := utils.B64EncodeFile(workdir + "/" + *name + "_rsa")
-			if err != nil {
-				return false, err
+			// Write out the argocd secret of the repo based on the vars and template. Only the deploy key is
+			// committed, tokens and app keys are applied to the cluster from outside the repo
+			secretFile := dir + "/" + "repo-secret.yaml"
+			if !auth.IsSSH() {
+				secretFile = GitCredentialsFile(workdir)
 			}
-			githubInfo := struct {
-				ClusterGitOpsRepo string
-				SSHPrivateKey     string
-				//IsPrivate         bool
-			}{
-				ClusterGitOpsRepo: base64.StdEncoding.EncodeToString([]byte(gitopsrepo)),
-				SSHPrivateKey:     sshKeyFile,
-				//GitHubToken:       ghtoken,
-				//IsPrivate:         *private,
-			}
-			_, err = utils.WriteTemplate(ArgoCdOverlayDefaultRepoSecret, dir+"/"+"repo-secret.yaml", githubInfo)
+			_, err = writeArgoRepoSecret(secretFile, workdir, *name, auth, gitopsrepo)
 			if err != nil {
 				return false, err
 			}
 
+			// Write out the known hosts of the repo so Argo CD only trusts the pinned keys
+			if auth.IsSSH() {
+				knownHosts, err := github.ReadKnownHosts(auth.KnownHostsFile)
+				if err != nil {
+					return false, err
+				}
+				knownHostsInfo := struct {
+					KnownHosts []string
+				}{
+					KnownHosts: knownHosts,
+				}
+				_, err = utils.WriteTemplate(ArgoCdOverlayDefaultKnownHostsConfigMap, dir+"/"+"argocd-ssh-known-hosts-cm.yaml", knownHostsInfo)
+				if err != nil {
+					return false, err
+				}
+			}
+
 		}
 		//	Now we move on to the components with appsets
 		if strings.Contains(dir, "components") && strings.Contains(dir, "applicationsets") {
-			// setup dummy values because the func needs it
-			dummyVars := struct {
-				Dummykey string
+			// The app layout gets its own application set
+			layoutVars := struct {
+				AppLayout bool
+				Capi      bool
 			}{
-				Dummykey: "unused",
+				AppLayout: layout == export.LayoutApp,
 			}
 
 			// Write out the kustomization file based on the vars and the template
-			_, err := utils.WriteTemplate(ArgoCdComponetnsApplicationSetKustomize, dir+"/"+"kustomization.yaml", dummyVars)
+			_, err := utils.WriteTemplate(ArgoCdComponetnsApplicationSetKustomize, dir+"/"+"kustomization.yaml", layoutVars)
 			if err != nil {
 				return false, err
 			}
@@ -122,10 +139,14 @@ func CreateArgoRepoSkel(name *string, workdir string, ghtoken string, gitopsrepo
 				ClusterGitOpsRepo string
 				RawPathBasename   string
 				RawPath           string
+				RepoPath          string
+				Branch            string
 			}{
 				ClusterGitOpsRepo: gitopsrepo,
 				RawPathBasename:   `'{{path.basename}}'`,
 				RawPath:           `'{{path}}'`,
+				RepoPath:          repoPathPrefix(repoPath),
+				Branch:            trackedBranch(commitOpts),
 			}
 
 			_, err = utils.WriteTemplate(ArgoCdClusterComponentApplicationSet, dir+"/"+"cluster-components.yaml", githubInfo)
@@ -138,6 +159,27 @@ func CreateArgoRepoSkel(name *string, workdir string, ghtoken string, gitopsrepo
 				return false, err
 			}
 
+			// Apps are named after their dir too, prefixed so they can't clash with the namespace ones
+			if layoutVars.AppLayout {
+				appsInfo := struct {
+					ClusterGitOpsRepo string
+					RawAppName        string
+					RawPath           string
+					RepoPath          string
+					Branch            string
+				}{
+					ClusterGitOpsRepo: gitopsrepo,
+					RawAppName:        `'app-{{path.basename}}'`,
+					RawPath:           `'{{path}}'`,
+					RepoPath:          repoPathPrefix(repoPath),
+					Branch:            trackedBranch(commitOpts),
+				}
+				_, err = utils.WriteTemplate(ArgoCdAppsApplicationSet, dir+"/"+"cluster-apps.yaml", appsInfo)
+				if err != nil {
+					return false, err
+				}
+			}
+
 		}
 
 		//	Components  with argo projects
@@ -213,8 +255,7 @@ func CreateArgoRepoSkel(name *string, workdir string, ghtoken string, gitopsrepo
 
 	// Commit and push initialize skel
 	log.Info("Pushing initial skel repo structure")
-	privateKeyFile := workdir + "/" + *name + "_rsa"
-	_, err := github.CommitAndPush(repoDir, privateKeyFile, "initializing skel repo structure")
+	_, err := github.CommitAndPush(ctx, repoDir, auth, commitOpts, "initializing skel repo structure")
 	if err != nil {
 		return false, err
 	}
@@ -223,17 +264,21 @@ func CreateArgoRepoSkel(name *string, workdir string, ghtoken string, gitopsrepo
 }
 
 // CreateFluxRepoSkel creates the skeleton repo structure at the given place
-func CreateFluxRepoSkel(name *string, workdir string, ghtoken string, gitopsrepo string, private *bool) (bool, error) {
-	// Repo Dir should be our workdir + the name of our cluster
-	repoDir := workdir + "/" + *name
+func CreateFluxRepoSkel(ctx context.Context, name *string, workdir string, auth *github.GitAuth, gitopsrepo string, private *bool, repoPath string, commitOpts *github.CommitOptions, layout string) (bool, error) {
+	// Repo Dir should be our workdir + the name of our cluster, plus the path of the cluster inside the repo
+	cloneDir := workdir + "/" + *name
+	repoDir := cloneDir
+	if repoPath != "" {
+		repoDir = cloneDir + "/" + repoPath
+	}
 	directories := []string{
 		repoDir + "/" + "cluster/core/flux-system/",
 		repoDir + "/" + "cluster/core/cluster-extras/",
 		repoDir + "/" + "cluster/tenants/kuard/",
 	}
 
-	// check if the dir is there. If not, error out
-	if _, err := os.Stat(repoDir); os.IsNotExist(err) {
+	// check if the clone is there. If not, error out
+	if _, err := os.Stat(cloneDir); os.IsNotExist(err) {
 		return false, err
 	}
 
@@ -247,11 +292,27 @@ func CreateFluxRepoSkel(name *string, workdir string, ghtoken string, gitopsrepo
 		//	flux-system
 		if strings.Contains(dir, "core") && strings.Contains(dir, "flux-system") {
 
+			// Only the deploy key is committed, the token is applied to the cluster from outside the repo
+			gitSecretFile := ""
+			if auth.IsSSH() {
+				gitSecretFile = "cluster-sshsecret.yaml"
+			}
+
+			// Commits are only verified if asked to
+			verifySecretFile := ""
+			if commitOpts.VerifyCommits {
+				verifySecretFile = "cluster-verifysecret.yaml"
+			}
+
 			// Set the version of Flux we want to install
 			FluxInstallVars := struct {
-				FluxcdVersion string
+				FluxcdVersion    string
+				GitSecretFile    string
+				VerifySecretFile string
 			}{
-				FluxcdVersion: "v0.23.0",
+				FluxcdVersion:    "v0.23.0",
+				GitSecretFile:    gitSecretFile,
+				VerifySecretFile: verifySecretFile,
 			}
 
 			// Write out the flux-system kustomization file based on the vars and the template
@@ -260,28 +321,45 @@ func CreateFluxRepoSkel(name *string, workdir string, ghtoken string, gitopsrepo
 				return false, err
 			}
 
-			// Set the Vars for the git ssh secret
-			privateKeyB64, _ := utils.B64EncodeFile(workdir + "/" + *name + "_rsa")
-			publicKeyB64, _ := utils.B64EncodeFile(workdir + "/" + *name + "_rsa.pub")
-			SshSecretVars := struct {
-				ClusterGitPrivateKey string
-				ClusterGitPublicKey  string
-			}{
-				ClusterGitPrivateKey: privateKeyB64,
-				ClusterGitPublicKey:  publicKeyB64,
+			// Write out the git secret based on the transport used
+			secretFile := GitCredentialsFile(workdir)
+			if auth.IsSSH() {
+				secretFile = dir + "/" + gitSecretFile
 			}
-
-			// Write out the GitRepository file based on the vars and the template
-			_, err = utils.WriteTemplate(FluxGitSshSecret, dir+"/"+"cluster-sshsecret.yaml", SshSecretVars)
+			_, err = writeFluxGitSecret(secretFile, workdir, *name, auth)
 			if err != nil {
 				return false, err
 			}
 
-			// Set the GitRepoURI
+			// Write out the keys Flux trusts to sign commits
+			if commitOpts.VerifyCommits {
+				verifyKeys, err := commitOpts.VerificationKeys()
+				if err != nil {
+					return false, err
+				}
+				VerifySecretVars := struct {
+					VerifyKeys string
+				}{
+					VerifyKeys: base64.StdEncoding.EncodeToString([]byte(verifyKeys)),
+				}
+				_, err = utils.WriteTemplate(FluxGitVerifySecret, dir+"/"+verifySecretFile, VerifySecretVars)
+				if err != nil {
+					return false, err
+				}
+			}
+
+			// Set the GitRepoURI. Flux wants ssh urls in the ssh:// form
 			GitRepoURIVars := struct {
-				GitRepoURI string
+				GitRepoURI    string
+				Branch        string
+				VerifyCommits bool
 			}{
-				GitRepoURI: "ssh://" + strings.ReplaceAll(gitopsrepo, ":", "/"),
+				GitRepoURI:    gitopsrepo,
+				Branch:        trackedBranch(commitOpts),
+				VerifyCommits: commitOpts.VerifyCommits,
+			}
+			if auth.IsSSH() {
+				GitRepoURIVars.GitRepoURI = "ssh://" + strings.ReplaceAll(gitopsrepo, ":", "/")
 			}
 
 			// Write out the GitRepository file based on the vars and the template
@@ -290,19 +368,26 @@ func CreateFluxRepoSkel(name *string, workdir string, ghtoken string, gitopsrepo
 				return false, err
 			}
 
-			// dummy vars for now
-			dummyVars := struct {
-				Dummykey string
+			// The Kustomizations point at the cluster inside the repo
+			repoPathVars := struct {
+				RepoPath string
 			}{
-				Dummykey: "unused",
+				RepoPath: repoPathPrefix(repoPath),
 			}
 
-			// Write out the Kustomization file. No vars needed so we dummy them
-			_, err = utils.WriteTemplate(FluxGotkKustomizationFile, dir+"/"+"cluster-kustomization.yaml", dummyVars)
+			// Write out the Kustomization file based on the vars and the template
+			_, err = utils.WriteTemplate(FluxGotkKustomizationFile, dir+"/"+"cluster-kustomization.yaml", repoPathVars)
 			if err != nil {
 				return false, err
 			}
 
+			// dummy vars for now
+			dummyVars := struct {
+				Dummykey string
+			}{
+				Dummykey: "unused",
+			}
+
 			// Write out the flux-system install YAML
 			_, err = utils.WriteTemplate(FluxInstallFile, dir+"/"+"flux-system.yaml", dummyVars)
 			if err != nil {
@@ -313,11 +398,13 @@ func CreateFluxRepoSkel(name *string, workdir string, ghtoken string, gitopsrepo
 		//	cluster-extras
 		if strings.Contains(dir, "core") && strings.Contains(dir, "cluster-extras") {
 
-			// Set the version of Flux we want to install
+			// Set the version of Flux we want to install and where the tenants live
 			FluxInstallVars := struct {
 				FluxcdVersion string
+				RepoPath      string
 			}{
 				FluxcdVersion: "v0.23.0",
+				RepoPath:      repoPathPrefix(repoPath),
 			}
 
 			// Write out the flux-system kustomization file based on the vars and the template
@@ -326,6 +413,14 @@ func CreateFluxRepoSkel(name *string, workdir string, ghtoken string, gitopsrepo
 				return false, err
 			}
 
+			// The app layout keeps the apps out of cluster/core, so they need their own Kustomization
+			if layout == export.LayoutApp {
+				_, err = utils.WriteTemplate(FluxGotkAppsFile, dir+"/"+"cluster-apps.yaml", FluxInstallVars)
+				if err != nil {
+					return false, err
+				}
+			}
+
 		}
 
 		//	Sample workload based on kuard
@@ -362,11 +457,180 @@ func CreateFluxRepoSkel(name *string, workdir string, ghtoken string, gitopsrepo
 
 	// Commit and push initialize skel
 	log.Info("Pushing initial skel repo structure")
-	privateKeyFile := workdir + "/" + *name + "_rsa"
-	_, err := github.CommitAndPush(repoDir, privateKeyFile, "initializing skel repo structure")
+	_, err := github.CommitAndPush(ctx, repoDir, auth, commitOpts, "initializing skel repo structure")
 	if err != nil {
 		return false, err
 	}
 	// If we're here, everything should be okay
 	return true, nil
 }
+
+// CreateCapiSync adds what syncs the CAPI objects in cluster/capi to the repo skeleton, an Argo CD Application
+// or a Flux Kustomization. It's for self managed clusters, once their CAPI objects were moved and exported.
+func CreateCapiSync(name *string, workdir string, gitopsrepo string, repoPath string, commitOpts *github.CommitOptions, gitOpsController string, layout string) (bool, error) {
+	// Repo Dir should be our workdir + the name of our cluster, plus the path of the cluster inside the repo
+	repoDir := workdir + "/" + *name
+	if repoPath != "" {
+		repoDir = repoDir + "/" + repoPath
+	}
+
+	if gitOpsController == "fluxcd" || gitOpsController == "flux" {
+		// The flux-system Kustomization picks it up from cluster-extras
+		fluxVars := struct {
+			RepoPath string
+		}{
+			RepoPath: repoPathPrefix(repoPath),
+		}
+
+		return utils.WriteTemplate(FluxGotkCapiFile, repoDir+"/cluster/core/cluster-extras/cluster-capi.yaml", fluxVars)
+	}
+
+	// Argo CD manages its own application sets, so it picks up the Application once it's listed with them
+	dir := repoDir + "/cluster/components/applicationsets"
+	layoutVars := struct {
+		AppLayout bool
+		Capi      bool
+	}{
+		AppLayout: layout == export.LayoutApp,
+		Capi:      true,
+	}
+	_, err := utils.WriteTemplate(ArgoCdComponetnsApplicationSetKustomize, dir+"/"+"kustomization.yaml", layoutVars)
+	if err != nil {
+		return false, err
+	}
+
+	githubInfo := struct {
+		ClusterGitOpsRepo string
+		RepoPath          string
+		Branch            string
+	}{
+		ClusterGitOpsRepo: gitopsrepo,
+		RepoPath:          repoPathPrefix(repoPath),
+		Branch:            trackedBranch(commitOpts),
+	}
+
+	return utils.WriteTemplate(ArgoCdCapiApplication, dir+"/"+"cluster-capi.yaml", githubInfo)
+}
+
+// writeArgoRepoSecret writes the Argo CD repository secret matching the git auth that is used
+func writeArgoRepoSecret(secretFile string, workdir string, name string, auth *github.GitAuth, gitopsrepo string) (bool, error) {
+	// Over ssh, Argo CD uses the deploy key
+	if auth.IsSSH() {
+		sshKeyFile, err := utils.B64EncodeFile(workdir + "/" + name + "_rsa")
+		if err != nil {
+			return false, err
+		}
+		githubInfo := struct {
+			ClusterGitOpsRepo string
+			SSHPrivateKey     string
+		}{
+			ClusterGitOpsRepo: base64.StdEncoding.EncodeToString([]byte(gitopsrepo)),
+			SSHPrivateKey:     sshKeyFile,
+		}
+		return utils.WriteTemplate(ArgoCdOverlayDefaultRepoSecret, secretFile, githubInfo)
+	}
+
+	// Argo CD mints its own installation tokens when given the GitHub App
+	if auth.IsGitHubApp() {
+		appPrivateKey, err := utils.B64EncodeFile(auth.AppPrivateKeyFile)
+		if err != nil {
+			return false, err
+		}
+		githubAppInfo := struct {
+			ClusterGitOpsRepo       string
+			GitHubAppID             string
+			GitHubAppInstallationID string
+			GitHubAppPrivateKey     string
+		}{
+			ClusterGitOpsRepo:       base64.StdEncoding.EncodeToString([]byte(gitopsrepo)),
+			GitHubAppID:             base64.StdEncoding.EncodeToString([]byte(strconv.FormatInt(auth.AppID, 10))),
+			GitHubAppInstallationID: base64.StdEncoding.EncodeToString([]byte(strconv.FormatInt(auth.AppInstallationID, 10))),
+			GitHubAppPrivateKey:     appPrivateKey,
+		}
+		return writeCredentials(ArgoCdOverlayDefaultRepoGitHubAppSecret, secretFile, githubAppInfo)
+	}
+
+	// Otherwise it's a token over https
+	tokenInfo := struct {
+		ClusterGitOpsRepo string
+		GitUsername       string
+		GitPassword       string
+	}{
+		ClusterGitOpsRepo: base64.StdEncoding.EncodeToString([]byte(gitopsrepo)),
+		GitUsername:       base64.StdEncoding.EncodeToString([]byte("x-access-token")),
+		GitPassword:       base64.StdEncoding.EncodeToString([]byte(auth.Token)),
+	}
+	return writeCredentials(ArgoCdOverlayDefaultRepoHttpsSecret, secretFile, tokenInfo)
+}
+
+// writeFluxGitSecret writes the Flux GitRepository secret matching the git auth that is used
+func writeFluxGitSecret(secretFile string, workdir string, name string, auth *github.GitAuth) (bool, error) {
+	// Over ssh, Flux uses the deploy key and the pinned host keys
+	if auth.IsSSH() {
+		privateKeyB64, _ := utils.B64EncodeFile(workdir + "/" + name + "_rsa")
+		publicKeyB64, _ := utils.B64EncodeFile(workdir + "/" + name + "_rsa.pub")
+		knownHostsB64, err := utils.B64EncodeFile(auth.KnownHostsFile)
+		if err != nil {
+			return false, err
+		}
+		SshSecretVars := struct {
+			ClusterGitPrivateKey string
+			ClusterGitPublicKey  string
+			ClusterGitKnownHosts string
+		}{
+			ClusterGitPrivateKey: privateKeyB64,
+			ClusterGitPublicKey:  publicKeyB64,
+			ClusterGitKnownHosts: knownHostsB64,
+		}
+		return utils.WriteTemplate(FluxGitSshSecret, secretFile, SshSecretVars)
+	}
+
+	// Otherwise it's a token over https
+	HttpsSecretVars := struct {
+		GitUsername string
+		GitPassword string
+	}{
+		GitUsername: base64.StdEncoding.EncodeToString([]byte("x-access-token")),
+		GitPassword: base64.StdEncoding.EncodeToString([]byte(auth.Token)),
+	}
+	return writeCredentials(FluxGitHttpsSecret, secretFile, HttpsSecretVars)
+}
+
+// writeCredentials writes a secret from the template that only the user can read
+func writeCredentials(tpl string, secretFile string, vars interface{}) (bool, error) {
+	err := ioutil.WriteFile(secretFile, nil, 0600)
+	if err != nil {
+		return false, err
+	}
+	err = os.Chmod(secretFile, 0600)
+	if err != nil {
+		return false, err
+	}
+
+	return utils.WriteTemplate(tpl, secretFile, vars)
+}
+
+// GitCredentialsFile returns where the secret with the token or GitHub App key the GitOps controller pulls
+// the repo with is written. It's outside the repo so it's never committed, and is applied to the cluster by
+// the bootstrap instead.
+func GitCredentialsFile(workdir string) string {
+	return workdir + "/" + "git-credentials.yaml"
+}
+
+// repoPathPrefix returns the path of the cluster inside the repo as a prefix for paths in the templates
+func repoPathPrefix(repoPath string) string {
+	if repoPath == "" {
+		return ""
+	}
+
+	return strings.Trim(repoPath, "/") + "/"
+}
+
+// trackedBranch returns the branch the GitOps controllers track
+func trackedBranch(commitOpts *github.CommitOptions) string {
+	if commitOpts.Branch == "" {
+		return "main"
+	}
+
+	return commitOpts.Branch
+}
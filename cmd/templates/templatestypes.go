@@ -4129,7 +4129,12 @@ kind: Kustomization
 resources:
 # - https://github.com/fluxcd/flux2/releases/download/{{.FluxcdVersion}}/install.yaml
 - flux-system.yaml
-- cluster-sshsecret.yaml
+{{- if .GitSecretFile}}
+- {{.GitSecretFile}}
+{{- end}}
+{{- if .VerifySecretFile}}
+- {{.VerifySecretFile}}
+{{- end}}
 - cluster-gitrepo.yaml
 - cluster-kustomization.yaml
 `
@@ -4143,7 +4148,30 @@ metadata:
 data:
   identity: {{.ClusterGitPrivateKey}}
   identity.pub: {{.ClusterGitPublicKey}}
-  known_hosts: Z2l0aHViLmNvbSBlY2RzYS1zaGEyLW5pc3RwMjU2IEFBQUFFMlZqWkhOaExYTm9ZVEl0Ym1semRIQXlOVFlBQUFBSWJtbHpkSEF5TlRZQUFBQkJCRW1LU0VOalFFZXpPbXhrWk15N29wS2d3RkI5bmt0NVlScllNak51RzVOODd1UmdnNkNMcmJvNXdBZFQveTZ2MG1LVjBVMncwV1oyWUIvKytUcG9ja2c9
+  known_hosts: {{.ClusterGitKnownHosts}}
+type: Opaque
+`
+
+var FluxGitHttpsSecret string = `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: flux-system
+  namespace: flux-system
+data:
+  username: {{.GitUsername}}
+  password: {{.GitPassword}}
+type: Opaque
+`
+
+var FluxGitVerifySecret string = `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: flux-git-verify
+  namespace: flux-system
+data:
+  trusted-keys.asc: {{.VerifyKeys}}
 type: Opaque
 `
 
@@ -4155,10 +4183,16 @@ metadata:
 spec:
   interval: 1m0s
   ref:
-    branch: main
+    branch: {{.Branch}}
   secretRef:
     name: flux-system
   url: {{.GitRepoURI}}
+{{- if .VerifyCommits}}
+  verify:
+    mode: head
+    secretRef:
+      name: flux-git-verify
+{{- end}}
 `
 
 var FluxGotkKustomizationFile string = `apiVersion: kustomize.toolkit.fluxcd.io/v1beta2
@@ -4168,7 +4202,7 @@ metadata:
   namespace: flux-system
 spec:
   interval: 5m0s
-  path: ./cluster/core
+  path: ./{{.RepoPath}}cluster/core
   prune: true
   sourceRef:
     kind: GitRepository
@@ -4182,7 +4216,41 @@ metadata:
   namespace: flux-system
 spec:
   interval: 5m0s
-  path: ./cluster/tenants
+  path: ./{{.RepoPath}}cluster/tenants
+  prune: false
+  sourceRef:
+    kind: GitRepository
+    name: flux-system
+`
+
+var FluxGotkAppsFile string = `apiVersion: kustomize.toolkit.fluxcd.io/v1beta2
+kind: Kustomization
+metadata:
+  name: apps
+  namespace: flux-system
+spec:
+  dependsOn:
+  - name: flux-system
+  interval: 5m0s
+  path: ./{{.RepoPath}}cluster/apps
+  prune: true
+  sourceRef:
+    kind: GitRepository
+    name: flux-system
+`
+
+// FluxGotkCapiFile syncs the CAPI objects of a self managed cluster. They are never pruned since that
+// would delete the cluster.
+var FluxGotkCapiFile string = `apiVersion: kustomize.toolkit.fluxcd.io/v1beta2
+kind: Kustomization
+metadata:
+  name: capi
+  namespace: flux-system
+spec:
+  dependsOn:
+  - name: flux-system
+  interval: 5m0s
+  path: ./{{.RepoPath}}cluster/capi
   prune: false
   sourceRef:
     kind: GitRepository
@@ -4212,8 +4280,13 @@ kind: Kustomization
 
 patchesStrategicMerge:
 - argocd-cm.yaml
+{{- if .SSHTransport }}
+- argocd-ssh-known-hosts-cm.yaml
+{{- end }}
+{{- if .SSHTransport }}
 resources:
 - repo-secret.yaml
+{{- end }}
 bases:
 - ../../base
 - ../../../components/argocdproj
@@ -4229,6 +4302,7 @@ metadata:
   name: argocd-cm
   namespace: argocd
 data:
+  application.resourceTrackingMethod: annotation+label
   resource.customizations: |
     storage.k8s.io/CSINode:
       ignoreDifferences: |
@@ -4240,6 +4314,21 @@ data:
         - /spec/allocations
 `
 
+var ArgoCdOverlayDefaultKnownHostsConfigMap string = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  labels:
+    app.kubernetes.io/name: argocd-ssh-known-hosts-cm
+    app.kubernetes.io/part-of: argocd
+  name: argocd-ssh-known-hosts-cm
+  namespace: argocd
+data:
+  ssh_known_hosts: |
+{{- range .KnownHosts }}
+    {{ . }}
+{{- end }}
+`
+
 /*
 var ArgoCdOverlayDefaultRepoSecret string = `apiVersion: v1
 kind: Secret
@@ -4271,9 +4360,46 @@ data:
   url: {{.ClusterGitOpsRepo}}
 `
 
+var ArgoCdOverlayDefaultRepoHttpsSecret string = `apiVersion: v1
+kind: Secret
+metadata:
+  name: cluster-repo
+  namespace: argocd
+  labels:
+    argocd.argoproj.io/secret-type: repository
+type: Opaque
+data:
+  username: {{.GitUsername}}
+  password: {{.GitPassword}}
+  type: Z2l0
+  url: {{.ClusterGitOpsRepo}}
+`
+
+var ArgoCdOverlayDefaultRepoGitHubAppSecret string = `apiVersion: v1
+kind: Secret
+metadata:
+  name: cluster-repo
+  namespace: argocd
+  labels:
+    argocd.argoproj.io/secret-type: repository
+type: Opaque
+data:
+  githubAppID: {{.GitHubAppID}}
+  githubAppInstallationID: {{.GitHubAppInstallationID}}
+  githubAppPrivateKey: {{.GitHubAppPrivateKey}}
+  type: Z2l0
+  url: {{.ClusterGitOpsRepo}}
+`
+
 var ArgoCdComponetnsApplicationSetKustomize string = `resources:
 - cluster-components.yaml
 - tenants.yaml
+{{- if .AppLayout }}
+- cluster-apps.yaml
+{{- end }}
+{{- if .Capi }}
+- cluster-capi.yaml
+{{- end }}
 `
 var ArgoCdComponentsArgoProjKustomize string = `resources:
 - cluster.yaml
@@ -4289,9 +4415,9 @@ spec:
   generators:
   - git:
       repoURL: {{.ClusterGitOpsRepo}}
-      revision: main
+      revision: {{.Branch}}
       directories:
-      - path: cluster/core/*
+      - path: {{.RepoPath}}cluster/core/*
   template:
     metadata:
       name: {{.RawPathBasename}}
@@ -4309,12 +4435,97 @@ spec:
             maxDuration: 5m
       source:
         repoURL: {{.ClusterGitOpsRepo}}
-        targetRevision: main
+        targetRevision: {{.Branch}}
+        path: {{.RawPath}}
+      destination:
+        server: https://kubernetes.default.svc
+`
+
+var ArgoCdAppsApplicationSet string = `
+apiVersion: argoproj.io/v1alpha1
+kind: ApplicationSet
+metadata:
+  name: apps
+  namespace: argocd
+spec:
+  generators:
+  - git:
+      repoURL: {{.ClusterGitOpsRepo}}
+      revision: {{.Branch}}
+      directories:
+      - path: {{.RepoPath}}cluster/apps/*
+  template:
+    metadata:
+      name: {{.RawAppName}}
+    spec:
+      project: cluster
+      syncPolicy:
+        automated:
+          prune: true
+          selfHeal: true
+        retry:
+          limit: 15
+          backoff:
+            duration: 15s
+            factor: 2
+            maxDuration: 5m
+      source:
+        repoURL: {{.ClusterGitOpsRepo}}
+        targetRevision: {{.Branch}}
         path: {{.RawPath}}
       destination:
         server: https://kubernetes.default.svc
 `
 
+// ArgoCdCapiApplication syncs the CAPI objects of a self managed cluster. They are never pruned since that
+// would delete the cluster, and the fields the CAPI controllers fill in are ignored.
+var ArgoCdCapiApplication string = `
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: capi
+  namespace: argocd
+spec:
+  project: cluster
+  syncPolicy:
+    automated:
+      prune: false
+      selfHeal: true
+    syncOptions:
+    - RespectIgnoreDifferences=true
+    retry:
+      limit: 15
+      backoff:
+        duration: 15s
+        factor: 2
+        maxDuration: 5m
+  ignoreDifferences:
+  - group: infrastructure.cluster.x-k8s.io
+    kind: AWSCluster
+    jsonPointers:
+    - /spec/controlPlaneEndpoint
+    - /spec/network
+  - group: infrastructure.cluster.x-k8s.io
+    kind: AzureCluster
+    jsonPointers:
+    - /spec/controlPlaneEndpoint
+    - /spec/networkSpec
+  - group: infrastructure.cluster.x-k8s.io
+    kind: DockerCluster
+    jsonPointers:
+    - /spec/controlPlaneEndpoint
+  - group: cluster.x-k8s.io
+    kind: MachineDeployment
+    jsonPointers:
+    - /spec/replicas
+  source:
+    repoURL: {{.ClusterGitOpsRepo}}
+    targetRevision: {{.Branch}}
+    path: {{.RepoPath}}cluster/capi
+  destination:
+    server: https://kubernetes.default.svc
+`
+
 var ArgoCdTenantApplicationSet string = `
 apiVersion: argoproj.io/v1alpha1
 kind: ApplicationSet
@@ -4325,9 +4536,9 @@ spec:
   generators:
   - git:
       repoURL: {{.ClusterGitOpsRepo}}
-      revision: main
+      revision: {{.Branch}}
       directories:
-      - path: cluster/tenants/*
+      - path: {{.RepoPath}}cluster/tenants/*
   template:
     metadata:
       name: {{.RawPathBasename}}
@@ -4345,7 +4556,7 @@ spec:
             maxDuration: 5m
       source:
         repoURL: {{.ClusterGitOpsRepo}}
-        targetRevision: main
+        targetRevision: {{.Branch}}
         path: {{.RawPath}}
       destination:
         server: https://kubernetes.default.svc
@@ -10,7 +10,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"text/template"
 
@@ -18,6 +18,7 @@ import (
 	"sigs.k8s.io/cluster-api/cmd/clusterctl/client"
 	"sigs.k8s.io/kustomize/api/krusty"
 	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"sigs.k8s.io/yaml"
 )
 
 // CheckPreReqs() checks to see if you have the proper CLI tools installed
@@ -101,40 +102,78 @@ func WriteYamlOutput(printer client.YamlPrinter, file string) error {
 	return nil
 }
 
-// SplitYamls takes a multi-part YAML file and splits it into multiple files in the specified directory splitting on the string given
-func SplitYamls(dir string, yaml string, spliton string) error {
-	// Read the YAML file into a []byte
-	yamlByte, err := ioutil.ReadFile(yaml)
+// SplitYamlDocuments reads a multi document YAML stream and returns its documents. Documents are split on
+// "---" at the start of a line, which may be followed by a comment or the start of the document, and "..." ends
+// one. Documents with nothing in them, like those with only comments, are left out.
+func SplitYamlDocuments(r io.Reader) ([][]byte, error) {
+	docs := [][]byte{}
+	doc := []string{}
 
-	if err != nil {
-		return err
+	// Keep what isn't empty
+	keep := func() error {
+		content := strings.Join(doc, "\n")
+		doc = []string{}
+
+		var parsed interface{}
+		err := yaml.Unmarshal([]byte(content), &parsed)
+		if err != nil {
+			return errors.New("document " + strconv.Itoa(len(docs)+1) + ": " + err.Error())
+		}
+		if parsed != nil {
+			docs = append(docs, []byte(content+"\n"))
+		}
+
+		return nil
 	}
 
-	// Read the []byte into a string
-	yml := string(yamlByte)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case line == "---" || strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "---\t"):
+			err := keep()
+			if err != nil {
+				return nil, err
+			}
+			rest := strings.TrimSpace(line[3:])
+			if rest != "" && !strings.HasPrefix(rest, "#") {
+				doc = append(doc, rest)
+			}
+		case line == "..." || strings.HasPrefix(line, "... "):
+			err := keep()
+			if err != nil {
+				return nil, err
+			}
+		default:
+			doc = append(doc, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
 
-	// Split the stringafied YAML and split on what was given to us
-	files := strings.Split(yml, spliton)
+	err := keep()
+	if err != nil {
+		return nil, err
+	}
 
-	// Split gives us a slice of string. Let's itterate and split them
+	return docs, nil
+}
 
-	for i, file := range files {
-		// create a directory provided to us
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return err
-		}
-		// Create the file and name it based on the index together with the name of the file
-		newYaml, err := os.Create(dir + "/" + fmt.Sprintf("%02d", i) + "." + filepath.Base(yaml))
-		if err != nil {
-			return err
-		}
-		defer newYaml.Close()
+// FetchURL returns what's at the url
+func FetchURL(url string) ([]byte, error) {
+	r, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
 
-		// Write this new filebased on the string given
-		newYaml.WriteString(file)
+	if r.StatusCode != http.StatusOK {
+		return nil, errors.New("unable to get " + url + ": " + r.Status)
 	}
 
-	return nil
+	return ioutil.ReadAll(r.Body)
 }
 
 // DownloadFile will download a url to a local file. It's like WGET
@@ -257,37 +296,18 @@ func B64EncodeFile(file string) (string, error) {
 	return encoded, nil
 }
 
-// RunKustomize runs kustomize on a specific dir and outputs it to a YAML to use for later
-func RunKustomize(dir string, outfile string) (bool, error) {
-	// set up where to run kustomize, how to write it, and which file to create
-	kustomizeDir := dir
-	fSys := filesys.MakeFsOnDisk()
-	writer, err := os.Create(outfile)
-	if err != nil {
-		return false, err
-	}
-
+// KustomizeBuild runs kustomize on a specific dir and returns the YAML it builds
+func KustomizeBuild(dir string) ([]byte, error) {
 	// The default options are fine for our use case
+	fSys := filesys.MakeFsOnDisk()
 	k := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
 
 	// Run Kustomize
-	m, err := k.Run(fSys, kustomizeDir)
+	m, err := k.Run(fSys, dir)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	// Convert to YAML
-	yml, err := m.AsYaml()
-	if err != nil {
-		return false, err
-	}
-
-	// Write YAML out
-	_, err = writer.Write(yml)
-	if err != nil {
-		return false, err
-	}
-
-	// If we're here, we should be okay
-	return false, nil
+	return m.AsYaml()
 }
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitYamlDocuments(t *testing.T) {
+	// A ConfigMap bigger than the default buffer of the scanner
+	big := "kind: ConfigMap\ndata:\n  big: " + strings.Repeat("x", 100*1024)
+
+	for _, tc := range []struct {
+		name string
+		yaml string
+		want []string
+	}{
+		{
+			name: "separators",
+			yaml: "kind: Namespace\n---\nkind: ConfigMap\n",
+			want: []string{"kind: Namespace\n", "kind: ConfigMap\n"},
+		},
+		{
+			name: "separator in a block scalar",
+			yaml: "kind: ConfigMap\ndata:\n  script: |\n    echo start\n    ---\n    echo end\n---\nkind: Secret\n",
+			want: []string{"kind: ConfigMap\ndata:\n  script: |\n    echo start\n    ---\n    echo end\n", "kind: Secret\n"},
+		},
+		{
+			name: "separator with a comment",
+			yaml: "--- # the namespace\nkind: Namespace\n---\t# the map\nkind: ConfigMap\n",
+			want: []string{"kind: Namespace\n", "kind: ConfigMap\n"},
+		},
+		{
+			name: "separator with the start of the document",
+			yaml: "--- kind: Namespace\n--- kind: ConfigMap\ndata:\n  a: b\n",
+			want: []string{"kind: Namespace\n", "kind: ConfigMap\ndata:\n  a: b\n"},
+		},
+		{
+			name: "document ends",
+			yaml: "kind: Namespace\n...\n---\nkind: ConfigMap\n...\n",
+			want: []string{"kind: Namespace\n", "kind: ConfigMap\n"},
+		},
+		{
+			name: "empty and comment only documents",
+			yaml: "---\n---\n# nothing here\n---\n\n\nkind: Namespace\n---\n# trailing\n",
+			want: []string{"\n\nkind: Namespace\n"},
+		},
+		{
+			name: "crlf line endings",
+			yaml: "kind: Namespace\r\n---\r\nkind: ConfigMap\r\ndata:\r\n  a: b\r\n",
+			want: []string{"kind: Namespace\n", "kind: ConfigMap\ndata:\n  a: b\n"},
+		},
+		{
+			name: "documents over 64 KiB",
+			yaml: big + "\n---\n" + big + "\n",
+			want: []string{big + "\n", big + "\n"},
+		},
+		{
+			name: "nothing",
+			yaml: "",
+			want: []string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			docs, err := SplitYamlDocuments(strings.NewReader(tc.yaml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(docs) != len(tc.want) {
+				t.Fatalf("got %d documents, want %d: %q", len(docs), len(tc.want), docs)
+			}
+			for i, doc := range docs {
+				if string(doc) != tc.want[i] {
+					t.Errorf("document %d: got %q, want %q", i+1, doc, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSplitYamlDocumentsInvalid(t *testing.T) {
+	_, err := SplitYamlDocuments(strings.NewReader("kind: Namespace\n---\nkind: [\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "document 2: ") {
+		t.Fatalf("got %v, want an error for document 2", err)
+	}
+}
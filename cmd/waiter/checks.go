@@ -0,0 +1,231 @@
+package waiter
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// The API resources the waits watch
+var (
+	DeploymentResource        = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	NodeResource              = schema.GroupVersionResource{Version: "v1", Resource: "nodes"}
+	ClusterResource           = schema.GroupVersionResource{Group: "cluster.x-k8s.io", Version: "v1beta1", Resource: "clusters"}
+	MachineResource           = schema.GroupVersionResource{Group: "cluster.x-k8s.io", Version: "v1beta1", Resource: "machines"}
+	MachineDeploymentResource = schema.GroupVersionResource{Group: "cluster.x-k8s.io", Version: "v1beta1", Resource: "machinedeployments"}
+	ControlPlaneResource      = schema.GroupVersionResource{Group: "controlplane.cluster.x-k8s.io", Version: "v1beta1", Resource: "kubeadmcontrolplanes"}
+)
+
+// clusterNameLabel is the label CAPI puts on the objects of a cluster
+var clusterNameLabel = "cluster.x-k8s.io/cluster-name"
+
+// Deployment waits until the Deployment is rolled out, with every replica updated and available
+func Deployment(ctx context.Context, client dynamic.Interface, namespace string, name string, opts Options) error {
+	target := Target{
+		Resource:    DeploymentResource,
+		Namespace:   namespace,
+		Name:        name,
+		Description: "deployment " + namespace + "/" + name,
+	}
+
+	return For(ctx, client, target, DeploymentRolledOut, opts)
+}
+
+// Cluster waits until the CAPI Cluster is provisioned. It fails if the Cluster does.
+func Cluster(ctx context.Context, client dynamic.Interface, namespace string, name string, opts Options) error {
+	target := Target{
+		Resource:    ClusterResource,
+		Namespace:   namespace,
+		Name:        name,
+		Description: "cluster " + namespace + "/" + name,
+	}
+
+	return For(ctx, client, target, ClusterProvisioned, opts)
+}
+
+// ControlPlane waits until the KubeadmControlPlane of the cluster is initialized and has all its machines
+func ControlPlane(ctx context.Context, client dynamic.Interface, namespace string, clusterName string, opts Options) error {
+	target := Target{
+		Resource:      ControlPlaneResource,
+		Namespace:     namespace,
+		LabelSelector: clusterNameLabel + "=" + clusterName,
+		Description:   "control plane of cluster " + namespace + "/" + clusterName,
+	}
+
+	return For(ctx, client, target, ControlPlaneUp, opts)
+}
+
+// Machines waits until every Machine of the cluster is running. It fails if one of them does.
+func Machines(ctx context.Context, client dynamic.Interface, namespace string, clusterName string, opts Options) error {
+	target := Target{
+		Resource:      MachineResource,
+		Namespace:     namespace,
+		LabelSelector: clusterNameLabel + "=" + clusterName,
+		Description:   "machines of cluster " + namespace + "/" + clusterName,
+	}
+
+	return For(ctx, client, target, MachinesRunning, opts)
+}
+
+// Nodes waits until at least count Nodes are Ready
+func Nodes(ctx context.Context, client dynamic.Interface, count int, opts Options) error {
+	target := Target{
+		Resource:    NodeResource,
+		Description: strconv.Itoa(count) + " ready nodes",
+	}
+
+	return For(ctx, client, target, NodesReady(count), opts)
+}
+
+// Condition waits until every object of the target has the condition True
+func Condition(ctx context.Context, client dynamic.Interface, target Target, conditionType string, opts Options) error {
+	return For(ctx, client, target, ConditionTrue(conditionType), opts)
+}
+
+// DeploymentRolledOut checks the Deployment has seen its latest spec, every replica is updated and available,
+// and the replicas of the old spec are gone
+func DeploymentRolledOut(objects []*unstructured.Unstructured) (bool, string, error) {
+	if len(objects) == 0 {
+		return false, "not created yet", nil
+	}
+	d := objects[0]
+
+	observed, _, _ := unstructured.NestedInt64(d.Object, "status", "observedGeneration")
+	if observed < d.GetGeneration() {
+		return false, "waiting for the rollout to start", nil
+	}
+
+	replicas, found, _ := unstructured.NestedInt64(d.Object, "spec", "replicas")
+	if !found {
+		replicas = 1
+	}
+	current, _, _ := unstructured.NestedInt64(d.Object, "status", "replicas")
+	updated, _, _ := unstructured.NestedInt64(d.Object, "status", "updatedReplicas")
+	available, _, _ := unstructured.NestedInt64(d.Object, "status", "availableReplicas")
+	status := strconv.FormatInt(available, 10) + " of " + strconv.FormatInt(replicas, 10) + " replicas available"
+	if current > updated {
+		status += ", " + strconv.FormatInt(current-updated, 10) + " old replicas terminating"
+	}
+
+	return updated >= replicas && current == updated && available >= replicas, status, nil
+}
+
+// ClusterProvisioned checks the CAPI Cluster is in the Provisioned phase
+func ClusterProvisioned(objects []*unstructured.Unstructured) (bool, string, error) {
+	if len(objects) == 0 {
+		return false, "not created yet", nil
+	}
+	c := objects[0]
+
+	phase, _, _ := unstructured.NestedString(c.Object, "status", "phase")
+	if phase == "Failed" {
+		return false, "", errors.New("cluster " + c.GetName() + " failed: " + failureMessage(c))
+	}
+	if phase == "" {
+		phase = "Pending"
+	}
+
+	return phase == "Provisioned", "phase " + phase, nil
+}
+
+// ControlPlaneUp checks the KubeadmControlPlane is initialized and has as many machines as it asks for
+func ControlPlaneUp(objects []*unstructured.Unstructured) (bool, string, error) {
+	if len(objects) == 0 {
+		return false, "not created yet", nil
+	}
+	kcp := objects[0]
+
+	wanted, _, _ := unstructured.NestedInt64(kcp.Object, "spec", "replicas")
+	replicas, _, _ := unstructured.NestedInt64(kcp.Object, "status", "replicas")
+	initialized, _, _ := unstructured.NestedBool(kcp.Object, "status", "initialized")
+	status := strconv.FormatInt(replicas, 10) + " of " + strconv.FormatInt(wanted, 10) + " machines"
+	if !initialized {
+		status += ", not initialized"
+	}
+
+	return initialized && replicas >= wanted, status, nil
+}
+
+// MachinesRunning checks every Machine is in the Running phase. A failed Machine is an error.
+func MachinesRunning(objects []*unstructured.Unstructured) (bool, string, error) {
+	if len(objects) == 0 {
+		return false, "no machines yet", nil
+	}
+
+	running := 0
+	for _, m := range objects {
+		phase, _, _ := unstructured.NestedString(m.Object, "status", "phase")
+		switch phase {
+		case "Running":
+			running++
+		case "Failed":
+			return false, "", errors.New("machine " + m.GetName() + " failed: " + failureMessage(m))
+		}
+	}
+
+	return running == len(objects), strconv.Itoa(running) + " of " + strconv.Itoa(len(objects)) + " running", nil
+}
+
+// NodesReady returns a check for at least count Nodes being Ready
+func NodesReady(count int) Check {
+	return func(objects []*unstructured.Unstructured) (bool, string, error) {
+		ready := 0
+		for _, n := range objects {
+			if conditionStatus(n, "Ready") == "True" {
+				ready++
+			}
+		}
+
+		return ready >= count, strconv.Itoa(ready) + " of " + strconv.Itoa(count) + " ready", nil
+	}
+}
+
+// ConditionTrue returns a check for every object having the condition True. There has to be at least one.
+func ConditionTrue(conditionType string) Check {
+	return func(objects []*unstructured.Unstructured) (bool, string, error) {
+		if len(objects) == 0 {
+			return false, "not created yet", nil
+		}
+
+		met := 0
+		for _, obj := range objects {
+			if conditionStatus(obj, conditionType) == "True" {
+				met++
+			}
+		}
+
+		return met == len(objects), strconv.Itoa(met) + " of " + strconv.Itoa(len(objects)) + " " + conditionType, nil
+	}
+}
+
+// conditionStatus returns the status of the condition of the object, empty if it doesn't have it
+func conditionStatus(obj *unstructured.Unstructured, conditionType string) string {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, _ := c.(map[string]interface{})
+		if condition["type"] == conditionType {
+			status, _ := condition["status"].(string)
+			return status
+		}
+	}
+
+	return ""
+}
+
+// failureMessage returns why the CAPI object failed
+func failureMessage(obj *unstructured.Unstructured) string {
+	reason, _, _ := unstructured.NestedString(obj.Object, "status", "failureReason")
+	message, _, _ := unstructured.NestedString(obj.Object, "status", "failureMessage")
+	if reason != "" && message != "" {
+		return reason + ": " + message
+	}
+	if reason == "" && message == "" {
+		return "no reason given"
+	}
+
+	return reason + message
+}
@@ -0,0 +1,205 @@
+package waiter
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+)
+
+// Options are how long to wait and how to report on it
+type Options struct {
+	// Timeout is how long to wait. Zero waits until the context is done.
+	Timeout time.Duration
+
+	// Progress is called with what's waited for and where the wait is at whenever that changes
+	Progress func(description string, status string)
+}
+
+// Target is what to watch
+type Target struct {
+	// Resource is the API resource of the objects
+	Resource schema.GroupVersionResource
+
+	// Namespace of the objects, empty for cluster scoped ones or every namespace
+	Namespace string
+
+	// Name of the object. Empty watches every object matching LabelSelector.
+	Name string
+
+	// LabelSelector the objects have to match
+	LabelSelector string
+
+	// Description names what's waited for in progress reports and errors
+	Description string
+}
+
+// Check looks at the watched objects and returns true once they are what's waited for, along with a short
+// status of where they're at. The objects are sorted by namespace and name. An error stops the wait.
+type Check func(objects []*unstructured.Unstructured) (bool, string, error)
+
+// For watches the target until the check passes, the context is done or the timeout is reached.
+// The check runs on what's there when the wait starts, and again on every change.
+func For(ctx context.Context, client dynamic.Interface, target Target, check Check, opts Options) error {
+	ctx, cancel := watchtools.ContextWithOptionalTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	// Only list and watch what we're waiting for
+	resource := client.Resource(target.Resource).Namespace(target.Namespace)
+	selectTarget := func(options *metav1.ListOptions) {
+		if target.Name != "" {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", target.Name).String()
+		}
+		options.LabelSelector = target.LabelSelector
+	}
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			selectTarget(&options)
+			return resource.List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			selectTarget(&options)
+			return resource.Watch(ctx, options)
+		},
+	}
+
+	// Keep track of the objects so the check sees all of them every time
+	objects := map[string]*unstructured.Unstructured{}
+	reporter := &progress{description: target.Description, report: opts.Progress}
+	evaluate := func() (bool, error) {
+		done, status, err := check(sortedObjects(objects))
+		if err != nil {
+			return false, err
+		}
+		reporter.update(status)
+
+		return done, nil
+	}
+	track := func(obj *unstructured.Unstructured, deleted bool) {
+		if target.Name != "" && obj.GetName() != target.Name {
+			return
+		}
+		if deleted {
+			delete(objects, objectKey(obj))
+			return
+		}
+		objects[objectKey(obj)] = obj
+	}
+
+	_, err := watchtools.UntilWithSync(ctx, lw, &unstructured.Unstructured{}, func(store cache.Store) (bool, error) {
+		for _, item := range store.List() {
+			if obj, ok := item.(*unstructured.Unstructured); ok {
+				track(obj, false)
+			}
+		}
+
+		return evaluate()
+	}, func(event watch.Event) (bool, error) {
+		obj, ok := event.Object.(*unstructured.Unstructured)
+		if !ok {
+			return false, nil
+		}
+		switch event.Type {
+		case watch.Added, watch.Modified:
+			track(obj, false)
+		case watch.Deleted:
+			track(obj, true)
+		default:
+			return false, nil
+		}
+
+		return evaluate()
+	})
+	if err != nil && ctx.Err() != nil {
+		return reporter.stopped(ctx.Err())
+	}
+
+	return err
+}
+
+// Poll runs the check every interval until it passes, the context is done or the timeout is reached.
+// It's for what can't be watched, like the API server taking manifests. An error from the check stops it.
+func Poll(ctx context.Context, interval time.Duration, description string, check func(ctx context.Context) (bool, string, error), opts Options) error {
+	ctx, cancel := watchtools.ContextWithOptionalTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	reporter := &progress{description: description, report: opts.Progress}
+	for {
+		done, status, err := check(ctx)
+		if err != nil {
+			return err
+		}
+		reporter.update(status)
+		if done {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return reporter.stopped(ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+// progress reports the status of a wait when it changes, and remembers it for errors
+type progress struct {
+	description string
+	report      func(description string, status string)
+	status      string
+}
+
+// update reports the status if it changed
+func (p *progress) update(status string) {
+	if status == "" || status == p.status {
+		return
+	}
+	p.status = status
+	if p.report != nil {
+		p.report(p.description, status)
+	}
+}
+
+// stopped returns the error for a wait that ended with the context, saying where it was at
+func (p *progress) stopped(err error) error {
+	msg := "stopped waiting for " + p.description
+	if err == context.DeadlineExceeded {
+		msg = "timed out waiting for " + p.description
+	}
+	if p.status != "" {
+		msg += " (" + p.status + ")"
+	}
+
+	return errors.New(msg)
+}
+
+// objectKey returns the namespace/name of the object
+func objectKey(obj *unstructured.Unstructured) string {
+	return obj.GetNamespace() + "/" + obj.GetName()
+}
+
+// sortedObjects returns the objects sorted by namespace and name
+func sortedObjects(objects map[string]*unstructured.Unstructured) []*unstructured.Unstructured {
+	keys := []string{}
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sorted := []*unstructured.Unstructured{}
+	for _, key := range keys {
+		sorted = append(sorted, objects[key])
+	}
+
+	return sorted
+}
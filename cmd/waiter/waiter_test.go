@@ -0,0 +1,309 @@
+package waiter
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// crdResource is the API resource of CustomResourceDefinitions, for waiting on a condition
+var crdResource = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+
+// listKinds are the list kinds of the resources the waits watch, the fake client needs them
+var listKinds = map[schema.GroupVersionResource]string{
+	DeploymentResource:        "DeploymentList",
+	NodeResource:              "NodeList",
+	ClusterResource:           "ClusterList",
+	MachineResource:           "MachineList",
+	MachineDeploymentResource: "MachineDeploymentList",
+	ControlPlaneResource:      "KubeadmControlPlaneList",
+	crdResource:               "CustomResourceDefinitionList",
+}
+
+// newFakeClient returns a fake client with the objects, and the watcher its watches get events from
+func newFakeClient(objects ...runtime.Object) (*dynamicfake.FakeDynamicClient, *watch.FakeWatcher) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+	watcher := watch.NewFakeWithChanSize(10, false)
+	client.PrependWatchReactor("*", k8stesting.DefaultWatchReactor(watcher, nil))
+
+	return client, watcher
+}
+
+// newObject returns an object with the status, and the spec if it's not nil
+func newObject(apiVersion string, kind string, namespace string, name string, labels map[string]string, spec map[string]interface{}, status map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+		"status":     status,
+	}}
+	if spec != nil {
+		obj.Object["spec"] = spec
+	}
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	obj.SetLabels(labels)
+
+	return obj
+}
+
+// condition returns a status condition
+func condition(conditionType string, status string) map[string]interface{} {
+	return map[string]interface{}{"type": conditionType, "status": status}
+}
+
+// progressRecorder keeps the statuses a wait reports
+type progressRecorder struct {
+	mu       sync.Mutex
+	statuses []string
+}
+
+func (p *progressRecorder) record(description string, status string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.statuses = append(p.statuses, status)
+}
+
+func (p *progressRecorder) all() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.statuses...)
+}
+
+// waitResult runs the wait in the background and returns what it returned
+func waitResult(wait func() error) chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- wait()
+	}()
+
+	return result
+}
+
+// expectDone fails the test if the wait doesn't return the error, nil for a wait that passed
+func expectDone(t *testing.T, result chan error, want string) {
+	t.Helper()
+	select {
+	case err := <-result:
+		if want == "" && err != nil {
+			t.Fatalf("wait failed: %v", err)
+		}
+		if want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+			t.Fatalf("got error %v, want one containing %q", err, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("wait didn't return")
+	}
+}
+
+// expectWaiting fails the test if the wait returned
+func expectWaiting(t *testing.T, result chan error) {
+	t.Helper()
+	select {
+	case err := <-result:
+		t.Fatalf("wait returned early: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func deployment(generation int64, observed int64, current int64, updated int64, available int64) *unstructured.Unstructured {
+	d := newObject("apps/v1", "Deployment", "argocd", "argocd-server", nil, map[string]interface{}{"replicas": int64(2)}, map[string]interface{}{
+		"observedGeneration": observed,
+		"replicas":           current,
+		"updatedReplicas":    updated,
+		"availableReplicas":  available,
+	})
+	d.SetGeneration(generation)
+
+	return d
+}
+
+func TestDeployment(t *testing.T) {
+	client, watcher := newFakeClient(deployment(2, 1, 2, 0, 2))
+	progress := &progressRecorder{}
+	result := waitResult(func() error {
+		return Deployment(context.Background(), client, "argocd", "argocd-server", Options{Progress: progress.record})
+	})
+	expectWaiting(t, result)
+
+	// Updated and available, but an old replica is still around
+	watcher.Modify(deployment(2, 2, 3, 2, 2))
+	expectWaiting(t, result)
+
+	watcher.Modify(deployment(2, 2, 2, 2, 2))
+	expectDone(t, result, "")
+
+	statuses := progress.all()
+	if len(statuses) < 2 || statuses[len(statuses)-2] != "2 of 2 replicas available, 1 old replicas terminating" {
+		t.Errorf("old replicas weren't reported: %v", statuses)
+	}
+}
+
+func TestDeploymentRolledOut(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		d    *unstructured.Unstructured
+		done bool
+	}{
+		{"rollout not started", deployment(2, 1, 2, 2, 2), false},
+		{"not updated", deployment(1, 1, 2, 1, 2), false},
+		{"not available", deployment(1, 1, 2, 2, 1), false},
+		{"old replicas", deployment(1, 1, 3, 2, 2), false},
+		{"rolled out", deployment(1, 1, 2, 2, 2), true},
+	} {
+		done, _, err := DeploymentRolledOut([]*unstructured.Unstructured{tc.d})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if done != tc.done {
+			t.Errorf("%s: got %v, want %v", tc.name, done, tc.done)
+		}
+	}
+}
+
+func cluster(phase string) *unstructured.Unstructured {
+	return newObject("cluster.x-k8s.io/v1beta1", "Cluster", "default", "mycluster", nil, nil, map[string]interface{}{
+		"phase":          phase,
+		"failureReason":  "CreateError",
+		"failureMessage": "no quota",
+	})
+}
+
+func TestCluster(t *testing.T) {
+	client, watcher := newFakeClient(cluster("Provisioning"))
+	result := waitResult(func() error {
+		return Cluster(context.Background(), client, "default", "mycluster", Options{})
+	})
+	expectWaiting(t, result)
+
+	watcher.Modify(cluster("Provisioned"))
+	expectDone(t, result, "")
+}
+
+func TestClusterFailed(t *testing.T) {
+	client, watcher := newFakeClient()
+	result := waitResult(func() error {
+		return Cluster(context.Background(), client, "default", "mycluster", Options{})
+	})
+	expectWaiting(t, result)
+
+	watcher.Add(cluster("Failed"))
+	expectDone(t, result, "cluster mycluster failed: CreateError: no quota")
+}
+
+func controlPlane(name string, replicas int64, initialized bool) *unstructured.Unstructured {
+	return newObject("controlplane.cluster.x-k8s.io/v1beta1", "KubeadmControlPlane", "default", name,
+		map[string]string{clusterNameLabel: "mycluster"},
+		map[string]interface{}{"replicas": int64(3)},
+		map[string]interface{}{"replicas": replicas, "initialized": initialized})
+}
+
+func TestControlPlane(t *testing.T) {
+	client, watcher := newFakeClient(controlPlane("mycluster-control-plane", 1, false))
+	progress := &progressRecorder{}
+	result := waitResult(func() error {
+		return ControlPlane(context.Background(), client, "default", "mycluster", Options{Progress: progress.record})
+	})
+	expectWaiting(t, result)
+
+	watcher.Modify(controlPlane("mycluster-control-plane", 1, true))
+	expectWaiting(t, result)
+
+	watcher.Modify(controlPlane("mycluster-control-plane", 3, true))
+	expectDone(t, result, "")
+
+	statuses := progress.all()
+	want := []string{"1 of 3 machines, not initialized", "1 of 3 machines", "3 of 3 machines"}
+	if strings.Join(statuses, "|") != strings.Join(want, "|") {
+		t.Errorf("got progress %v, want %v", statuses, want)
+	}
+}
+
+func node(name string, ready string) *unstructured.Unstructured {
+	return newObject("v1", "Node", "", name, nil, nil, map[string]interface{}{
+		"conditions": []interface{}{condition("Ready", ready)},
+	})
+}
+
+func TestNodes(t *testing.T) {
+	client, watcher := newFakeClient(node("node-1", "True"), node("node-2", "False"))
+	result := waitResult(func() error {
+		return Nodes(context.Background(), client, 3, Options{})
+	})
+	expectWaiting(t, result)
+
+	watcher.Modify(node("node-2", "True"))
+	expectWaiting(t, result)
+
+	// A node going away doesn't count anymore
+	watcher.Delete(node("node-1", "True"))
+	watcher.Add(node("node-3", "True"))
+	expectWaiting(t, result)
+
+	watcher.Add(node("node-4", "True"))
+	expectDone(t, result, "")
+}
+
+func TestCondition(t *testing.T) {
+	crd := func(name string, established string) *unstructured.Unstructured {
+		return newObject("apiextensions.k8s.io/v1", "CustomResourceDefinition", "", name, nil, nil, map[string]interface{}{
+			"conditions": []interface{}{condition("Established", established)},
+		})
+	}
+	target := Target{Resource: crdResource, Description: "crds"}
+
+	client, watcher := newFakeClient(crd("a.example.com", "True"), crd("b.example.com", "False"))
+	result := waitResult(func() error {
+		return Condition(context.Background(), client, target, "Established", Options{})
+	})
+	expectWaiting(t, result)
+
+	watcher.Modify(crd("b.example.com", "True"))
+	expectDone(t, result, "")
+}
+
+func TestTimeout(t *testing.T) {
+	client, _ := newFakeClient(cluster("Provisioning"))
+	err := Cluster(context.Background(), client, "default", "mycluster", Options{Timeout: time.Second})
+	if err == nil || err.Error() != "timed out waiting for cluster default/mycluster (phase Provisioning)" {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	client, _ := newFakeClient(cluster("Provisioning"))
+	ctx, cancel := context.WithCancel(context.Background())
+	result := waitResult(func() error {
+		return Cluster(ctx, client, "default", "mycluster", Options{})
+	})
+	expectWaiting(t, result)
+
+	cancel()
+	expectDone(t, result, "stopped waiting for cluster default/mycluster (phase Provisioning)")
+}
+
+func TestPoll(t *testing.T) {
+	calls := 0
+	err := Poll(context.Background(), time.Millisecond, "manifests", func(ctx context.Context) (bool, string, error) {
+		calls++
+		return calls == 3, "", nil
+	}, Options{})
+	if err != nil || calls != 3 {
+		t.Fatalf("got %v after %d calls", err, calls)
+	}
+
+	err = Poll(context.Background(), time.Millisecond, "manifests", func(ctx context.Context) (bool, string, error) {
+		return false, "not applied", nil
+	}, Options{Timeout: 50 * time.Millisecond})
+	if err == nil || err.Error() != "timed out waiting for manifests (not applied)" {
+		t.Fatalf("got %v", err)
+	}
+}
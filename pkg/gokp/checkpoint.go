@@ -0,0 +1,71 @@
+package gokp
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+// Checkpoint is how far an install got. It's saved after every step, so an install that was
+// interrupted or failed can be resumed with the same options.
+type Checkpoint struct {
+	Provider         string  `json:"provider"`
+	GitOpsController string  `json:"gitOpsController"`
+	Cluster          Cluster `json:"cluster"`
+
+	// Done are the steps that finished
+	Done []string `json:"done"`
+
+	// GitPrivateKeyFile and GitKnownHostsFile are what the repo is pushed to over ssh with, once it's created
+	GitPrivateKeyFile string `json:"gitPrivateKeyFile,omitempty"`
+	GitKnownHostsFile string `json:"gitKnownHostsFile,omitempty"`
+
+	// FeatureBranch is where pull requests are opened from, a resumed install reuses its pull request
+	FeatureBranch string `json:"featureBranch,omitempty"`
+}
+
+// CheckpointFile returns where the checkpoint of the install into the artifacts dir is saved
+func CheckpointFile(artifactsDir string) string {
+	return artifactsDir + ".checkpoint.json"
+}
+
+// LoadCheckpoint reads the checkpoint from the file
+func LoadCheckpoint(file string) (*Checkpoint, error) {
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, errors.New("no install to resume, " + file + " doesn't exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &Checkpoint{}
+	err = json.Unmarshal(content, cp)
+	if err != nil {
+		return nil, errors.New("unable to read checkpoint " + file + ": " + err.Error())
+	}
+
+	return cp, nil
+}
+
+// save writes the checkpoint to the file
+func (cp *Checkpoint) save(file string) error {
+	content, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, content, 0600)
+}
+
+// done returns true if the step finished
+func (cp *Checkpoint) done(step string) bool {
+	for _, d := range cp.Done {
+		if d == step {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,168 @@
+package gokp
+
+import (
+	"context"
+
+	"github.com/christianh814/gokp/cmd/argo"
+	"github.com/christianh814/gokp/cmd/export"
+	"github.com/christianh814/gokp/cmd/flux"
+	"github.com/christianh814/gokp/cmd/github"
+	"github.com/christianh814/gokp/cmd/kind"
+	"github.com/christianh814/gokp/cmd/templates"
+)
+
+// KindBootstrapper runs the temporary control plane with kind
+type KindBootstrapper struct {
+	// MountDocker gives the kind cluster the docker socket, for providers that run the cluster on docker
+	MountDocker bool
+}
+
+// Create creates the kind cluster
+func (b *KindBootstrapper) Create(ctx context.Context, c *Cluster) error {
+	if b.MountDocker {
+		return kind.CreateCAPDKindCluster(ctx, c.BootstrapName, c.BootstrapKubeconfig, c.WorkDir)
+	}
+
+	return kind.CreateKindCluster(ctx, c.BootstrapName, c.BootstrapKubeconfig)
+}
+
+// Delete deletes the kind cluster
+func (b *KindBootstrapper) Delete(ctx context.Context, c *Cluster) error {
+	return kind.DeleteKindCluster(c.BootstrapName, c.BootstrapKubeconfig)
+}
+
+// GitHubRepo is a GitOps repo on GitHub
+type GitHubRepo struct {
+	Auth    *github.GitAuth
+	Private bool
+	Repo    *github.RepoOptions
+	Commit  *github.CommitOptions
+}
+
+// Create creates the repo on GitHub, or checks out the existing one
+func (r *GitHubRepo) Create(ctx context.Context, c *Cluster) (string, error) {
+	_, url, err := github.CreateRepo(ctx, &c.Name, r.Auth, &r.Private, c.WorkDir, r.Repo, r.Commit)
+
+	return url, err
+}
+
+// Push commits and pushes the repo dir, and opens a pull request for it if asked to
+func (r *GitHubRepo) Push(ctx context.Context, c *Cluster, msg string) error {
+	_, err := github.CommitAndPush(ctx, c.RepoDir, r.Auth, r.Commit, msg)
+	if err != nil {
+		return err
+	}
+	if !r.Commit.ViaPullRequest {
+		return nil
+	}
+
+	// Waits for the merge too if asked to
+	_, err = github.OpenPullRequest(ctx, c.RepoDir, r.Auth, r.Commit, "gokp: bootstrap cluster "+c.Name)
+
+	return err
+}
+
+// Protect requires pull requests on the tracked branch, reviewed by the team for what it owns, if a team owns the repo
+func (r *GitHubRepo) Protect(ctx context.Context, c *Cluster) error {
+	_, err := github.ProtectRepo(ctx, c.Name, r.Auth, r.Repo, r.Commit.Branch)
+
+	return err
+}
+
+// ArgoCD is the Argo CD GitOps controller
+type ArgoCD struct {
+	Auth    *github.GitAuth
+	Private bool
+	Commit  *github.CommitOptions
+	Layout  string
+}
+
+// Name returns argocd
+func (a *ArgoCD) Name() string {
+	return "argocd"
+}
+
+// DisplayName returns Argo CD
+func (a *ArgoCD) DisplayName() string {
+	return "Argo CD"
+}
+
+// CreateRepoSkel writes the repo structure with the Argo CD install YAMLs and base YAMLs, and pushes it
+func (a *ArgoCD) CreateRepoSkel(ctx context.Context, c *Cluster) error {
+	_, err := templates.CreateArgoRepoSkel(ctx, &c.Name, c.WorkDir, a.Auth, c.RepoURL, &a.Private, c.RepoPath, a.Commit, a.Layout)
+
+	return err
+}
+
+// CreateCapiSync writes the Application syncing the CAPI objects
+func (a *ArgoCD) CreateCapiSync(ctx context.Context, c *Cluster) error {
+	_, err := templates.CreateCapiSync(&c.Name, c.WorkDir, c.RepoURL, c.RepoPath, a.Commit, a.Name(), a.Layout)
+
+	return err
+}
+
+// Bootstrap installs Argo CD with its applications and applicationsets
+func (a *ArgoCD) Bootstrap(ctx context.Context, c *Cluster) error {
+	_, err := argo.BootstrapArgoCD(ctx, &c.Name, c.WorkDir, c.Kubeconfig, c.RepoPath)
+
+	return err
+}
+
+// FluxCD is the Flux CD GitOps controller
+type FluxCD struct {
+	Auth    *github.GitAuth
+	Private bool
+	Commit  *github.CommitOptions
+	Layout  string
+}
+
+// Name returns fluxcd
+func (f *FluxCD) Name() string {
+	return "fluxcd"
+}
+
+// DisplayName returns Flux CD
+func (f *FluxCD) DisplayName() string {
+	return "Flux CD"
+}
+
+// CreateRepoSkel writes the repo structure with the Flux CD install YAMLs and base YAMLs, and pushes it
+func (f *FluxCD) CreateRepoSkel(ctx context.Context, c *Cluster) error {
+	_, err := templates.CreateFluxRepoSkel(ctx, &c.Name, c.WorkDir, f.Auth, c.RepoURL, &f.Private, c.RepoPath, f.Commit, f.Layout)
+
+	return err
+}
+
+// CreateCapiSync writes the Kustomization syncing the CAPI objects
+func (f *FluxCD) CreateCapiSync(ctx context.Context, c *Cluster) error {
+	_, err := templates.CreateCapiSync(&c.Name, c.WorkDir, c.RepoURL, c.RepoPath, f.Commit, f.Name(), f.Layout)
+
+	return err
+}
+
+// Bootstrap installs Flux CD with all its components
+func (f *FluxCD) Bootstrap(ctx context.Context, c *Cluster) error {
+	_, err := flux.BootstrapFluxCD(ctx, &c.Name, c.WorkDir, c.Kubeconfig, c.RepoPath)
+
+	return err
+}
+
+// ClusterExporter exports the cluster with the export package
+type ClusterExporter struct {
+	GitOpsController string
+	Options          *export.Options
+}
+
+// ExportCluster exports what runs on the cluster into the repo dir
+func (e *ClusterExporter) ExportCluster(ctx context.Context, c *Cluster) error {
+	_, err := export.ExportClusterYaml(ctx, c.Kubeconfig, c.RepoDir, e.GitOpsController, e.Options)
+
+	return err
+}
+
+// ExportCapi exports the CAPI objects of the cluster into the repo dir
+func (e *ClusterExporter) ExportCapi(ctx context.Context, c *Cluster) error {
+	_, err := export.ExportCapiYaml(ctx, c.Kubeconfig, c.RepoDir, e.GitOpsController, e.Options)
+
+	return err
+}
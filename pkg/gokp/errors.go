@@ -0,0 +1,77 @@
+package gokp
+
+import (
+	"errors"
+
+	"github.com/christianh814/gokp/cmd/events"
+)
+
+// The kinds of errors an install fails with, match them with errors.Is
+var (
+	ErrInvalidOptions = errors.New("invalid options")
+	ErrPrerequisites  = errors.New("prerequisites not met")
+	ErrCluster        = errors.New("cluster operation failed")
+	ErrGit            = errors.New("git operation failed")
+	ErrGitOps         = errors.New("gitops controller failed")
+	ErrExport         = errors.New("export failed")
+	ErrFilesystem     = errors.New("filesystem operation failed")
+	ErrCanceled       = errors.New("install canceled")
+)
+
+// codes are the event codes of the kinds of errors
+var codes = map[error]string{
+	ErrInvalidOptions: events.CodeInvalidInput,
+	ErrPrerequisites:  events.CodePrerequisites,
+	ErrCluster:        events.CodeCluster,
+	ErrGit:            events.CodeGit,
+	ErrGitOps:         events.CodeGitOps,
+	ErrExport:         events.CodeExport,
+	ErrFilesystem:     events.CodeFilesystem,
+	ErrCanceled:       events.CodeCanceled,
+}
+
+// Error is what the Installer fails with. It matches its Kind with errors.Is, and unwraps to the
+// underlying error, so a canceled install matches context.Canceled as well as ErrCanceled.
+type Error struct {
+	// Step that failed, empty if the install never started
+	Step string
+
+	// Kind is one of the Err values
+	Kind error
+
+	// Err is what went wrong
+	Err error
+}
+
+// Error returns the step and what went wrong
+func (e *Error) Error() string {
+	if e.Step == "" {
+		return e.Err.Error()
+	}
+
+	return e.Step + ": " + e.Err.Error()
+}
+
+// Unwrap returns what went wrong
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true for the kind of the error
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Code returns the event code of the error
+func (e *Error) Code() string {
+	return codes[e.Kind]
+}
+
+// withKind marks the error as of the kind, for steps that fail in more than one way
+func withKind(kind error, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &Error{Kind: kind, Err: err}
+}
@@ -0,0 +1,200 @@
+// Package gokp installs GitOps ready Kubernetes clusters. It's what the gokp commands run, for embedding
+// in other programs. An Installer creates the cluster on a Provider from a temporary kind cluster, creates
+// its GitOps repo with the cluster exported into it, and bootstraps the GitOps controller on it.
+//
+// Progress is published as events, see the events package for where they go.
+package gokp
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/christianh814/gokp/cmd/events"
+	"github.com/christianh814/gokp/cmd/export"
+	"github.com/christianh814/gokp/cmd/github"
+)
+
+// The steps of an install, as they're named in the events and errors
+const (
+	StepPrerequisites         = "prerequisites"
+	StepTemporaryControlPlane = "temporary-control-plane"
+	StepCluster               = "cluster"
+	StepRepo                  = "repo"
+	StepRepoSkeleton          = "repo-skeleton"
+	StepExport                = "export"
+	StepPush                  = "push"
+	StepGitOpsController      = "gitops-controller"
+	StepMove                  = "move"
+	StepCapiExport            = "capi-export"
+	StepProtectRepo           = "protect-repo"
+	StepCleanup               = "cleanup"
+	StepArtifacts             = "artifacts"
+)
+
+// DefaultBootstrapName is the name of the temporary kind cluster
+var DefaultBootstrapName = "gokp-bootstrapper"
+
+// Options are what to install
+type Options struct {
+	// ClusterName names the cluster, its repo and its artifacts
+	ClusterName string
+
+	// GitOpsController is either argocd or fluxcd
+	GitOpsController string
+
+	// PrivateRepo makes the created repo private
+	PrivateRepo bool
+
+	// GitAuth is how to talk to GitHub and the repo
+	GitAuth *github.GitAuth
+
+	// Repo is where and how to create the repo
+	Repo *github.RepoOptions
+
+	// Commit is how to commit to the repo
+	Commit *github.CommitOptions
+
+	// Export is how the cluster is exported into the repo
+	Export *export.Options
+
+	// ArtifactsDir is where the kubeconfig, keys and repo checkout end up. Defaults to ~/.gokp/<ClusterName>.
+	ArtifactsDir string
+
+	// BootstrapName is the name of the temporary kind cluster. Defaults to DefaultBootstrapName.
+	BootstrapName string
+
+	// Resume picks up an install that didn't finish from its checkpoint, skipping the steps that did
+	Resume bool
+}
+
+// Validate returns an error if the options can't be installed with
+func (o *Options) Validate() error {
+	if o.ClusterName == "" {
+		return errors.New("cluster name is required")
+	}
+	if o.GitOpsController != "argocd" && o.GitOpsController != "fluxcd" && o.GitOpsController != "flux" {
+		return errors.New("unrecognized gitops controller: " + o.GitOpsController)
+	}
+	if o.GitAuth == nil || o.Repo == nil || o.Commit == nil || o.Export == nil {
+		return errors.New("git auth, repo, commit and export options are required")
+	}
+
+	err := o.GitAuth.Validate(o.GitOpsController)
+	if err != nil {
+		return err
+	}
+	err = o.Repo.Validate(o.GitAuth)
+	if err != nil {
+		return err
+	}
+	err = o.Commit.Validate(o.GitOpsController)
+	if err != nil {
+		return err
+	}
+
+	return o.Export.Validate()
+}
+
+// setDefaults fills in what wasn't set
+func (o *Options) setDefaults() {
+	if o.ArtifactsDir == "" {
+		o.ArtifactsDir = os.Getenv("HOME") + "/.gokp/" + o.ClusterName
+	}
+	if o.BootstrapName == "" {
+		o.BootstrapName = DefaultBootstrapName
+	}
+}
+
+// Cluster is where an install is at. Every step gets it, and fills in what it made.
+type Cluster struct {
+	// Name of the cluster
+	Name string `json:"name"`
+
+	// WorkDir is where everything is made before it's moved to the artifacts dir
+	WorkDir string `json:"workDir"`
+
+	// BootstrapName is the name of the temporary kind cluster
+	BootstrapName string `json:"bootstrapName"`
+
+	// BootstrapKubeconfig is the kubeconfig of the temporary kind cluster
+	BootstrapKubeconfig string `json:"bootstrapKubeconfig"`
+
+	// Kubeconfig is the kubeconfig of the cluster
+	Kubeconfig string `json:"kubeconfig"`
+
+	// RepoURL is the URL of the GitOps repo
+	RepoURL string `json:"repoURL"`
+
+	// RepoPath is the path of the cluster inside the repo, empty for the root
+	RepoPath string `json:"repoPath"`
+
+	// RepoDir is the dir of the cluster in the checkout of the repo
+	RepoDir string `json:"repoDir"`
+}
+
+// Result is what an install leaves behind
+type Result = events.ClusterResult
+
+// Bootstrapper runs the temporary control plane the cluster is created from
+type Bootstrapper interface {
+	Create(ctx context.Context, c *Cluster) error
+	Delete(ctx context.Context, c *Cluster) error
+}
+
+// Provider creates clusters on an infrastructure
+type Provider interface {
+	// Name of the provider, like aws
+	Name() string
+
+	// DisplayName of the provider for people, like AWS
+	DisplayName() string
+
+	// Create creates the cluster from the bootstrap cluster and writes its kubeconfig
+	Create(ctx context.Context, c *Cluster) error
+
+	// SelfManaged is true if the cluster manages itself once it's created
+	SelfManaged() bool
+
+	// Move moves the CAPI objects from the bootstrap cluster into the cluster
+	Move(ctx context.Context, c *Cluster) error
+}
+
+// Repo is the GitOps repo of the cluster
+type Repo interface {
+	// Create creates the repo, or checks out the existing one, and returns its URL
+	Create(ctx context.Context, c *Cluster) (string, error)
+
+	// Push commits what changed in the repo dir and pushes it, through a pull request if asked to
+	Push(ctx context.Context, c *Cluster, msg string) error
+
+	// Protect requires pull requests on the tracked branch, reviewed by the code owners of what they change
+	Protect(ctx context.Context, c *Cluster) error
+}
+
+// GitOpsController syncs the cluster from its repo
+type GitOpsController interface {
+	// Name of the controller, like argocd
+	Name() string
+
+	// DisplayName of the controller for people, like Argo CD
+	DisplayName() string
+
+	// CreateRepoSkel writes the repo structure with the controller's own install and pushes it
+	CreateRepoSkel(ctx context.Context, c *Cluster) error
+
+	// CreateCapiSync writes what syncs the exported CAPI objects of a self managed cluster
+	CreateCapiSync(ctx context.Context, c *Cluster) error
+
+	// Bootstrap installs the controller on the cluster
+	Bootstrap(ctx context.Context, c *Cluster) error
+}
+
+// Exporter writes the objects of the cluster into the repo
+type Exporter interface {
+	// ExportCluster exports what runs on the cluster
+	ExportCluster(ctx context.Context, c *Cluster) error
+
+	// ExportCapi exports the CAPI objects of a self managed cluster
+	ExportCapi(ctx context.Context, c *Cluster) error
+}
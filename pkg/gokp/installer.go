@@ -0,0 +1,340 @@
+package gokp
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/christianh814/gokp/cmd/capi"
+	"github.com/christianh814/gokp/cmd/events"
+	"github.com/christianh814/gokp/cmd/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// notNeeded are left in the work dir by the install, and aren't moved to the artifacts dir
+var notNeeded = []string{
+	"git-credentials.yaml",
+	"kind.kubeconfig",
+	"kindconfig.yaml",
+}
+
+// Installer installs a cluster. Its parts default to the real ones, replace them to change how the
+// cluster is made, or with fakes to run an install without infrastructure.
+type Installer struct {
+	Provider     Provider
+	Bootstrapper Bootstrapper
+	Repo         Repo
+	GitOps       GitOpsController
+	Exporter     Exporter
+
+	opts       Options
+	checkpoint *Checkpoint
+}
+
+// step is a step of the install. Errors are of the kind unless the step says otherwise with withKind.
+type step struct {
+	name    string
+	message string
+	kind    error
+	run     func(ctx context.Context, c *Cluster) error
+}
+
+// NewInstaller returns an installer of the cluster on the provider. It fails with ErrInvalidOptions.
+func NewInstaller(provider Provider, opts Options) (*Installer, error) {
+	if provider == nil {
+		return nil, &Error{Kind: ErrInvalidOptions, Err: errors.New("provider is required")}
+	}
+	err := opts.Validate()
+	if err != nil {
+		return nil, &Error{Kind: ErrInvalidOptions, Err: err}
+	}
+	opts.setDefaults()
+
+	i := &Installer{
+		Provider:     provider,
+		Bootstrapper: &KindBootstrapper{MountDocker: provider.Name() == "docker"},
+		Repo: &GitHubRepo{
+			Auth:    opts.GitAuth,
+			Private: opts.PrivateRepo,
+			Repo:    opts.Repo,
+			Commit:  opts.Commit,
+		},
+		Exporter: &ClusterExporter{
+			GitOpsController: opts.GitOpsController,
+			Options:          opts.Export,
+		},
+		opts: opts,
+	}
+	if opts.GitOpsController == "argocd" {
+		i.GitOps = &ArgoCD{Auth: opts.GitAuth, Private: opts.PrivateRepo, Commit: opts.Commit, Layout: opts.Export.Layout}
+	} else {
+		i.GitOps = &FluxCD{Auth: opts.GitAuth, Private: opts.PrivateRepo, Commit: opts.Commit, Layout: opts.Export.Layout}
+	}
+
+	return i, nil
+}
+
+// Install creates the cluster, its repo and the GitOps controller syncing it, publishing the progress as
+// events. Once the context is done it stops waiting on what it's doing, and doesn't start another step.
+// On failure the work dir is left behind with everything made so far, along with the checkpoint to resume
+// from, and the error is an *Error.
+func (i *Installer) Install(ctx context.Context) (*Result, error) {
+	cp, err := i.startCheckpoint()
+	if err != nil {
+		return nil, i.fail(&Error{Kind: ErrInvalidOptions, Err: err})
+	}
+	i.checkpoint = cp
+	c := &cp.Cluster
+
+	for _, s := range i.steps() {
+		if cp.done(s.name) {
+			log.Info("Skipping ", s.name, ", it's done already")
+			continue
+		}
+		err := i.runStep(ctx, s, c)
+		if err != nil {
+			return nil, err
+		}
+
+		// Nothing's left to resume once the artifacts are where they belong
+		if s.name == StepArtifacts {
+			break
+		}
+		cp.Done = append(cp.Done, s.name)
+		cp.GitPrivateKeyFile = i.opts.GitAuth.PrivateKeyFile
+		cp.GitKnownHostsFile = i.opts.GitAuth.KnownHostsFile
+		cp.FeatureBranch = i.opts.Commit.FeatureBranch
+		err = cp.save(i.CheckpointFile())
+		if err != nil {
+			return nil, i.fail(&Error{Step: s.name, Kind: ErrFilesystem, Err: errors.New("unable to save checkpoint: " + err.Error())})
+		}
+	}
+	os.Remove(i.CheckpointFile())
+
+	result := &Result{
+		Name:              c.Name,
+		Provider:          i.Provider.Name(),
+		KubernetesVersion: capi.KubernetesVersion,
+		GitOpsController:  i.GitOps.Name(),
+		RepoURL:           c.RepoURL,
+		RepoPath:          c.RepoPath,
+		Branch:            i.opts.Commit.Branch,
+		KubeconfigPath:    i.opts.ArtifactsDir + "/" + c.Name + ".kubeconfig",
+		ArtifactsDir:      i.opts.ArtifactsDir,
+	}
+	events.Done(*result)
+
+	return result, nil
+}
+
+// CheckpointFile returns where the checkpoint of the install is saved
+func (i *Installer) CheckpointFile() string {
+	return CheckpointFile(i.opts.ArtifactsDir)
+}
+
+// DeleteBootstrap deletes the temporary control plane of an install that didn't finish. Until the cluster
+// is created, and moved if it manages itself, the temporary control plane is what manages it. Deleting it
+// before then leaves the install impossible to resume, so its checkpoint is removed.
+func (i *Installer) DeleteBootstrap(ctx context.Context) error {
+	cp := i.checkpoint
+	if cp == nil || !cp.done(StepPrerequisites) || cp.done(StepCleanup) {
+		return nil
+	}
+
+	err := i.Bootstrapper.Delete(ctx, &cp.Cluster)
+	if err != nil {
+		return err
+	}
+
+	needed := StepCluster
+	if i.Provider.SelfManaged() {
+		needed = StepMove
+	}
+	if !cp.done(needed) {
+		log.Warn("The install of ", cp.Cluster.Name, " can't be resumed without its temporary control plane")
+		return os.Remove(i.CheckpointFile())
+	}
+	cp.Done = append(cp.Done, StepCleanup)
+
+	return cp.save(i.CheckpointFile())
+}
+
+// startCheckpoint returns the checkpoint of the install to resume, or a new one
+func (i *Installer) startCheckpoint() (*Checkpoint, error) {
+	if !i.opts.Resume {
+		return &Checkpoint{
+			Provider:         i.Provider.Name(),
+			GitOpsController: i.GitOps.Name(),
+			Cluster: Cluster{
+				Name:          i.opts.ClusterName,
+				BootstrapName: i.opts.BootstrapName,
+			},
+		}, nil
+	}
+
+	cp, err := LoadCheckpoint(i.CheckpointFile())
+	if err != nil {
+		return nil, err
+	}
+	if cp.Provider != i.Provider.Name() || cp.GitOpsController != i.GitOps.Name() {
+		return nil, errors.New("the install to resume is on " + cp.Provider + " with " + cp.GitOpsController)
+	}
+
+	// The repo is pushed to with the keys it was created with
+	if cp.GitPrivateKeyFile != "" {
+		i.opts.GitAuth.PrivateKeyFile = cp.GitPrivateKeyFile
+		i.opts.GitAuth.KnownHostsFile = cp.GitKnownHostsFile
+	}
+
+	// And to the pull request it opened, the feature branch is named when the install starts
+	if cp.FeatureBranch != "" {
+		i.opts.Commit.FeatureBranch = cp.FeatureBranch
+	}
+
+	return cp, nil
+}
+
+// steps returns the steps of the install, in order
+func (i *Installer) steps() []step {
+	steps := []step{
+		{StepPrerequisites, "Checking prerequisites", ErrPrerequisites, i.prepare},
+		{StepTemporaryControlPlane, "Creating temporary control plane", ErrCluster, i.Bootstrapper.Create},
+		{StepCluster, "Creating cluster " + i.opts.ClusterName + " on " + i.Provider.DisplayName(), ErrCluster, i.Provider.Create},
+		{StepRepo, "Creating GitOps repo", ErrGit, i.createRepo},
+		{StepRepoSkeleton, "Creating GitOps repo structure", ErrGit, i.GitOps.CreateRepoSkel},
+		{StepExport, "Exporting Cluster YAML", ErrExport, i.Exporter.ExportCluster},
+		{StepPush, "Pushing exported YAML", ErrGit, i.push("exporting existing YAML")},
+		{StepGitOpsController, "Deploying " + i.GitOps.DisplayName() + " GitOps Controller", ErrGitOps, i.GitOps.Bootstrap},
+	}
+
+	// Self managed clusters get their CAPI objects, which are only exported once they're moved
+	if i.Provider.SelfManaged() {
+		steps = append(steps,
+			step{StepMove, "Moving CAPI Artifacts to: " + i.opts.ClusterName, ErrCluster, i.Provider.Move},
+			step{StepCapiExport, "Exporting CAPI YAML", ErrExport, i.exportCapi},
+		)
+	}
+
+	// The branch is protected once nothing is pushed to it anymore, the deploy key can't bypass the reviews
+	return append(steps,
+		step{StepProtectRepo, "Protecting the " + i.opts.Commit.Branch + " branch", ErrGit, i.Repo.Protect},
+		step{StepCleanup, "Deleting temporary control plane", ErrCluster, i.Bootstrapper.Delete},
+		step{StepArtifacts, "Saving cluster artifacts to: " + i.opts.ArtifactsDir, ErrFilesystem, i.saveArtifacts},
+	)
+}
+
+// runStep publishes the start of the step, runs it and publishes how it ended
+func (i *Installer) runStep(ctx context.Context, s step, c *Cluster) error {
+	if ctx.Err() != nil {
+		return i.fail(&Error{Step: s.name, Kind: ErrCanceled, Err: ctx.Err()})
+	}
+
+	progress := events.StartStep(s.name, s.message)
+	err := s.run(ctx, c)
+	if err == nil {
+		progress.Finish()
+		return nil
+	}
+
+	// Steps can say what kind of error they failed with, otherwise it's the kind of the step
+	stepErr := &Error{}
+	if !errors.As(err, &stepErr) {
+		stepErr = &Error{Kind: s.kind, Err: err}
+	}
+	stepErr.Step = s.name
+	if ctx.Err() != nil {
+		stepErr.Kind = ErrCanceled
+	}
+	progress.Fail(stepErr.Code(), stepErr.Err)
+
+	return stepErr
+}
+
+// fail publishes an error that didn't happen while a step ran, and returns it
+func (i *Installer) fail(err *Error) error {
+	events.Fail(err.Code(), err)
+
+	return err
+}
+
+// prepare checks nothing is in the way of the install and creates the work dir
+func (i *Installer) prepare(ctx context.Context, c *Cluster) error {
+	_, err := utils.CheckPreReqs(i.opts.ArtifactsDir, i.opts.GitOpsController)
+	if err != nil {
+		return err
+	}
+
+	// Starting over would leave what the last install made behind
+	if _, err := os.Stat(i.CheckpointFile()); err == nil {
+		return errors.New("an install of " + c.Name + " didn't finish, resume it or remove " + i.CheckpointFile())
+	}
+
+	// The work dir is next to the artifacts dir, so it can be renamed to it at the end
+	parent := filepath.Dir(i.opts.ArtifactsDir)
+	err = os.MkdirAll(parent, 0775)
+	if err != nil {
+		return withKind(ErrFilesystem, err)
+	}
+	c.WorkDir, err = ioutil.TempDir(parent, ".gokpinstall")
+	if err != nil {
+		return withKind(ErrFilesystem, err)
+	}
+	c.BootstrapKubeconfig = c.WorkDir + "/" + "kind.kubeconfig"
+	c.Kubeconfig = c.WorkDir + "/" + c.Name + ".kubeconfig"
+
+	return nil
+}
+
+// createRepo creates the repo. The cluster can live in a subdirectory of it.
+func (i *Installer) createRepo(ctx context.Context, c *Cluster) error {
+	url, err := i.Repo.Create(ctx, c)
+	if err != nil {
+		return err
+	}
+	c.RepoURL = url
+	c.RepoPath = i.opts.Repo.ClusterPath(c.Name)
+	c.RepoDir = i.opts.Repo.ClusterDir(c.WorkDir, c.Name)
+
+	return nil
+}
+
+// push returns a step pushing the repo with the commit message
+func (i *Installer) push(msg string) func(ctx context.Context, c *Cluster) error {
+	return func(ctx context.Context, c *Cluster) error {
+		return i.Repo.Push(ctx, c, msg)
+	}
+}
+
+// exportCapi exports the CAPI objects of the cluster, which manages itself now, along with what syncs them
+func (i *Installer) exportCapi(ctx context.Context, c *Cluster) error {
+	err := i.Exporter.ExportCapi(ctx, c)
+	if err != nil {
+		return err
+	}
+	err = i.GitOps.CreateCapiSync(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	return withKind(ErrGit, i.Repo.Push(ctx, c, "exporting CAPI YAML"))
+}
+
+// saveArtifacts moves the work dir to the artifacts dir, and removes what you don't need to know
+func (i *Installer) saveArtifacts(ctx context.Context, c *Cluster) error {
+	err := os.Rename(c.WorkDir, i.opts.ArtifactsDir)
+	if err != nil {
+		return err
+	}
+	c.WorkDir = i.opts.ArtifactsDir
+
+	for _, notNeededthing := range notNeeded {
+		err = os.RemoveAll(i.opts.ArtifactsDir + "/" + notNeededthing)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
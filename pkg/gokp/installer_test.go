@@ -0,0 +1,471 @@
+package gokp
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/christianh814/gokp/cmd/events"
+	"github.com/christianh814/gokp/cmd/export"
+	"github.com/christianh814/gokp/cmd/github"
+)
+
+// fakes records what the install calls on its parts, in order, and fails the call it's told to
+type fakes struct {
+	calls []string
+
+	// failAt is the call that fails with err, or cancels the install if cancel is set
+	failAt string
+	err    error
+	cancel context.CancelFunc
+
+	selfManaged bool
+
+	// protected is set once the repo is protected, pushes are rejected from then on like GitHub does
+	protected bool
+}
+
+// call records the call, and returns the error it's told to fail with
+func (f *fakes) call(ctx context.Context, name string) error {
+	f.calls = append(f.calls, name)
+	if name != f.failAt {
+		return nil
+	}
+	if f.cancel != nil {
+		f.cancel()
+		return ctx.Err()
+	}
+
+	return f.err
+}
+
+type fakeProvider struct{ *fakes }
+
+func (p fakeProvider) Name() string        { return "fake" }
+func (p fakeProvider) DisplayName() string { return "Fake" }
+func (p fakeProvider) SelfManaged() bool   { return p.selfManaged }
+func (p fakeProvider) Create(ctx context.Context, c *Cluster) error {
+	return p.call(ctx, "provider.create")
+}
+func (p fakeProvider) Move(ctx context.Context, c *Cluster) error {
+	return p.call(ctx, "provider.move")
+}
+
+type fakeBootstrapper struct{ *fakes }
+
+func (b fakeBootstrapper) Create(ctx context.Context, c *Cluster) error {
+	return b.call(ctx, "bootstrap.create")
+}
+func (b fakeBootstrapper) Delete(ctx context.Context, c *Cluster) error {
+	return b.call(ctx, "bootstrap.delete")
+}
+
+type fakeRepo struct{ *fakes }
+
+func (r fakeRepo) Create(ctx context.Context, c *Cluster) (string, error) {
+	return "git@github.com:example/" + c.Name + ".git", r.call(ctx, "repo.create")
+}
+func (r fakeRepo) Push(ctx context.Context, c *Cluster, msg string) error {
+	err := r.call(ctx, "repo.push: "+msg)
+	if err == nil && r.protected {
+		return errors.New("protected branch hook declined")
+	}
+
+	return err
+}
+func (r fakeRepo) Protect(ctx context.Context, c *Cluster) error {
+	err := r.call(ctx, "repo.protect")
+	if err == nil {
+		r.protected = true
+	}
+
+	return err
+}
+
+type fakeGitOps struct{ *fakes }
+
+func (g fakeGitOps) Name() string        { return "argocd" }
+func (g fakeGitOps) DisplayName() string { return "Argo CD" }
+func (g fakeGitOps) CreateRepoSkel(ctx context.Context, c *Cluster) error {
+	return g.call(ctx, "gitops.skel")
+}
+func (g fakeGitOps) CreateCapiSync(ctx context.Context, c *Cluster) error {
+	return g.call(ctx, "gitops.capisync")
+}
+func (g fakeGitOps) Bootstrap(ctx context.Context, c *Cluster) error {
+	return g.call(ctx, "gitops.bootstrap")
+}
+
+type fakeExporter struct{ *fakes }
+
+func (e fakeExporter) ExportCluster(ctx context.Context, c *Cluster) error {
+	return e.call(ctx, "export.cluster")
+}
+func (e fakeExporter) ExportCapi(ctx context.Context, c *Cluster) error {
+	return e.call(ctx, "export.capi")
+}
+
+// recorder keeps the events that are published
+type recorder struct {
+	mu     sync.Mutex
+	events []events.Event
+}
+
+func (r *recorder) Publish(event events.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+// ofType returns the events of the type
+func (r *recorder) ofType(eventType string) []events.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	found := []events.Event{}
+	for _, e := range r.events {
+		if e.Type == eventType {
+			found = append(found, e)
+		}
+	}
+
+	return found
+}
+
+// recordEvents sends the events to a recorder for the rest of the test
+func recordEvents(t *testing.T) *recorder {
+	r := &recorder{}
+	events.SetPublisher(r)
+	t.Cleanup(func() {
+		events.SetPublisher(events.LogPublisher{})
+	})
+
+	return r
+}
+
+// newTestInstaller returns an installer into a temporary artifacts dir with every part faked
+func newTestInstaller(t *testing.T, artifactsDir string, f *fakes, resume bool) *Installer {
+	i, err := NewInstaller(fakeProvider{f}, Options{
+		ClusterName:      "mycluster",
+		GitOpsController: "argocd",
+		GitAuth:          &github.GitAuth{Token: "token"},
+		Repo:             &github.RepoOptions{},
+		Commit:           &github.CommitOptions{Branch: "main"},
+		Export:           &export.Options{Secrets: &export.SecretPolicy{}},
+		ArtifactsDir:     artifactsDir,
+		Resume:           resume,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.Bootstrapper = fakeBootstrapper{f}
+	i.Repo = fakeRepo{f}
+	i.GitOps = fakeGitOps{f}
+	i.Exporter = fakeExporter{f}
+
+	return i
+}
+
+// installCalls are what a finished install calls, in order
+var installCalls = []string{
+	"bootstrap.create",
+	"provider.create",
+	"repo.create",
+	"gitops.skel",
+	"export.cluster",
+	"repo.push: exporting existing YAML",
+	"gitops.bootstrap",
+}
+
+// selfManagedCalls are what a self managed cluster adds before the repo is protected
+var selfManagedCalls = []string{
+	"provider.move",
+	"export.capi",
+	"gitops.capisync",
+	"repo.push: exporting CAPI YAML",
+}
+
+func TestInstallStepOrder(t *testing.T) {
+	for _, tc := range []struct {
+		selfManaged bool
+		calls       []string
+		steps       []string
+	}{
+		{
+			selfManaged: false,
+			calls:       append(append([]string{}, installCalls...), "repo.protect", "bootstrap.delete"),
+			steps: []string{StepPrerequisites, StepTemporaryControlPlane, StepCluster, StepRepo, StepRepoSkeleton, StepExport,
+				StepPush, StepGitOpsController, StepProtectRepo, StepCleanup, StepArtifacts},
+		},
+		{
+			selfManaged: true,
+			calls:       append(append(append([]string{}, installCalls...), selfManagedCalls...), "repo.protect", "bootstrap.delete"),
+			steps: []string{StepPrerequisites, StepTemporaryControlPlane, StepCluster, StepRepo, StepRepoSkeleton, StepExport,
+				StepPush, StepGitOpsController, StepMove, StepCapiExport, StepProtectRepo, StepCleanup, StepArtifacts},
+		},
+	} {
+		r := recordEvents(t)
+		f := &fakes{selfManaged: tc.selfManaged}
+		artifactsDir := t.TempDir() + "/mycluster"
+		i := newTestInstaller(t, artifactsDir, f, false)
+
+		result, err := i.Install(context.Background())
+		if err != nil {
+			t.Fatalf("self managed %v: %v", tc.selfManaged, err)
+		}
+
+		if strings.Join(f.calls, "\n") != strings.Join(tc.calls, "\n") {
+			t.Errorf("self managed %v: got calls\n%s\nwant\n%s", tc.selfManaged, strings.Join(f.calls, "\n"), strings.Join(tc.calls, "\n"))
+		}
+		started := []string{}
+		for _, e := range r.ofType(events.StepStarted) {
+			started = append(started, e.Step)
+		}
+		if strings.Join(started, ",") != strings.Join(tc.steps, ",") {
+			t.Errorf("self managed %v: got steps %v, want %v", tc.selfManaged, started, tc.steps)
+		}
+
+		// The work dir is the artifacts dir now, and there's nothing to resume
+		if result.ArtifactsDir != artifactsDir || result.RepoURL != "git@github.com:example/mycluster.git" {
+			t.Errorf("self managed %v: got result %+v", tc.selfManaged, result)
+		}
+		if _, err := os.Stat(artifactsDir); err != nil {
+			t.Errorf("self managed %v: artifacts dir wasn't saved: %v", tc.selfManaged, err)
+		}
+		if _, err := os.Stat(i.CheckpointFile()); !os.IsNotExist(err) {
+			t.Errorf("self managed %v: checkpoint wasn't removed", tc.selfManaged)
+		}
+		if len(r.ofType(events.Result)) != 1 {
+			t.Errorf("self managed %v: result wasn't published", tc.selfManaged)
+		}
+	}
+}
+
+func TestInstallErrors(t *testing.T) {
+	for _, tc := range []struct {
+		failAt string
+		step   string
+		kind   error
+		code   string
+	}{
+		{"bootstrap.create", StepTemporaryControlPlane, ErrCluster, events.CodeCluster},
+		{"provider.create", StepCluster, ErrCluster, events.CodeCluster},
+		{"repo.create", StepRepo, ErrGit, events.CodeGit},
+		{"gitops.skel", StepRepoSkeleton, ErrGit, events.CodeGit},
+		{"export.cluster", StepExport, ErrExport, events.CodeExport},
+		{"repo.push: exporting existing YAML", StepPush, ErrGit, events.CodeGit},
+		{"gitops.bootstrap", StepGitOpsController, ErrGitOps, events.CodeGitOps},
+		{"provider.move", StepMove, ErrCluster, events.CodeCluster},
+		{"export.capi", StepCapiExport, ErrExport, events.CodeExport},
+		{"gitops.capisync", StepCapiExport, ErrExport, events.CodeExport},
+		{"repo.push: exporting CAPI YAML", StepCapiExport, ErrGit, events.CodeGit},
+		{"repo.protect", StepProtectRepo, ErrGit, events.CodeGit},
+		{"bootstrap.delete", StepCleanup, ErrCluster, events.CodeCluster},
+	} {
+		r := recordEvents(t)
+		failed := errors.New("failed")
+		f := &fakes{selfManaged: true, failAt: tc.failAt, err: failed}
+		i := newTestInstaller(t, t.TempDir()+"/mycluster", f, false)
+
+		_, err := i.Install(context.Background())
+		installErr := &Error{}
+		if !errors.As(err, &installErr) {
+			t.Fatalf("%s: got %v, want an *Error", tc.failAt, err)
+		}
+		if installErr.Step != tc.step || !errors.Is(err, tc.kind) || !errors.Is(err, failed) {
+			t.Errorf("%s: got step %q kind %v, want step %q kind %v", tc.failAt, installErr.Step, installErr.Kind, tc.step, tc.kind)
+		}
+		if f.calls[len(f.calls)-1] != tc.failAt {
+			t.Errorf("%s: install went on to %s", tc.failAt, f.calls[len(f.calls)-1])
+		}
+
+		errorEvents := r.ofType(events.Error)
+		if len(errorEvents) != 1 || errorEvents[0].Step != tc.step || errorEvents[0].Code != tc.code {
+			t.Errorf("%s: got error events %+v, want one for step %q with code %q", tc.failAt, errorEvents, tc.step, tc.code)
+		}
+	}
+}
+
+func TestInstallCanceled(t *testing.T) {
+	recordEvents(t)
+
+	// Canceled while a step runs
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &fakes{failAt: "provider.create", cancel: cancel}
+	i := newTestInstaller(t, t.TempDir()+"/mycluster", f, false)
+	_, err := i.Install(ctx)
+	installErr := &Error{}
+	if !errors.As(err, &installErr) || installErr.Step != StepCluster || !errors.Is(err, ErrCanceled) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want the cluster step canceled", err)
+	}
+	if installErr.Code() != events.CodeCanceled {
+		t.Errorf("got code %q, want %q", installErr.Code(), events.CodeCanceled)
+	}
+
+	// Canceled before it starts
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	f = &fakes{}
+	i = newTestInstaller(t, t.TempDir()+"/mycluster", f, false)
+	_, err = i.Install(ctx)
+	if !errors.As(err, &installErr) || installErr.Step != StepPrerequisites || !errors.Is(err, ErrCanceled) {
+		t.Fatalf("got %v, want the prerequisites step canceled", err)
+	}
+	if len(f.calls) != 0 {
+		t.Errorf("a canceled install called %v", f.calls)
+	}
+}
+
+func TestInstallResume(t *testing.T) {
+	recordEvents(t)
+	artifactsDir := t.TempDir() + "/mycluster"
+
+	f := &fakes{failAt: "repo.protect", err: errors.New("not allowed")}
+	i := newTestInstaller(t, artifactsDir, f, false)
+	_, err := i.Install(context.Background())
+	if err == nil {
+		t.Fatal("install didn't fail")
+	}
+
+	// The checkpoint has the steps that finished, and the work dir they made
+	cp, err := LoadCheckpoint(i.CheckpointFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := []string{StepPrerequisites, StepTemporaryControlPlane, StepCluster, StepRepo, StepRepoSkeleton, StepExport, StepPush,
+		StepGitOpsController}
+	if strings.Join(cp.Done, ",") != strings.Join(done, ",") {
+		t.Errorf("got done steps %v, want %v", cp.Done, done)
+	}
+	if cp.Cluster.WorkDir == "" || cp.Cluster.RepoURL == "" || cp.Provider != "fake" || cp.GitOpsController != "argocd" {
+		t.Errorf("checkpoint is missing what the steps made: %+v", cp)
+	}
+
+	// Starting over is refused while there's an install to resume
+	f = &fakes{}
+	_, err = newTestInstaller(t, artifactsDir, f, false).Install(context.Background())
+	if !errors.Is(err, ErrPrerequisites) {
+		t.Errorf("got %v, want the prerequisites to fail", err)
+	}
+
+	// Resuming picks up at the step that failed
+	f = &fakes{}
+	i = newTestInstaller(t, artifactsDir, f, true)
+	_, err = i.Install(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := []string{"repo.protect", "bootstrap.delete"}
+	if strings.Join(f.calls, ",") != strings.Join(calls, ",") {
+		t.Errorf("got calls %v, want %v", f.calls, calls)
+	}
+	if _, err := os.Stat(i.CheckpointFile()); !os.IsNotExist(err) {
+		t.Error("checkpoint wasn't removed")
+	}
+	if _, err := os.Stat(cp.Cluster.WorkDir); !os.IsNotExist(err) {
+		t.Error("work dir wasn't moved to the artifacts dir")
+	}
+}
+
+func TestResumeReusesFeatureBranch(t *testing.T) {
+	recordEvents(t)
+	artifactsDir := t.TempDir() + "/mycluster"
+
+	f := &fakes{failAt: "repo.push: exporting existing YAML", err: errors.New("merge timed out")}
+	i := newTestInstaller(t, artifactsDir, f, false)
+	i.opts.Commit.FeatureBranch = "gokp/mycluster-1"
+	_, err := i.Install(context.Background())
+	if err == nil {
+		t.Fatal("install didn't fail")
+	}
+
+	// Resuming names a new branch, but pushes to the one the pull request is open for
+	i = newTestInstaller(t, artifactsDir, &fakes{}, true)
+	i.opts.Commit.FeatureBranch = "gokp/mycluster-2"
+	_, err = i.Install(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.opts.Commit.FeatureBranch != "gokp/mycluster-1" {
+		t.Errorf("got feature branch %q, want gokp/mycluster-1", i.opts.Commit.FeatureBranch)
+	}
+}
+
+func TestResumeWithoutCheckpoint(t *testing.T) {
+	recordEvents(t)
+	_, err := newTestInstaller(t, t.TempDir()+"/mycluster", &fakes{}, true).Install(context.Background())
+	if !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("got %v, want invalid options", err)
+	}
+}
+
+func TestDeleteBootstrap(t *testing.T) {
+	recordEvents(t)
+
+	// Before the move the temporary control plane manages the cluster, so there's nothing left to resume
+	artifactsDir := t.TempDir() + "/mycluster"
+	f := &fakes{selfManaged: true, failAt: "provider.move", err: errors.New("move failed")}
+	i := newTestInstaller(t, artifactsDir, f, false)
+	_, err := i.Install(context.Background())
+	if err == nil {
+		t.Fatal("install didn't fail")
+	}
+	err = i.DeleteBootstrap(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.calls[len(f.calls)-1] != "bootstrap.delete" {
+		t.Errorf("temporary control plane wasn't deleted: %v", f.calls)
+	}
+	if _, err := os.Stat(i.CheckpointFile()); !os.IsNotExist(err) {
+		t.Error("checkpoint of an install that can't be resumed wasn't removed")
+	}
+
+	// Once it's moved the install can go on without it, and doesn't delete it again
+	artifactsDir = t.TempDir() + "/mycluster"
+	f = &fakes{selfManaged: true, failAt: "export.capi", err: errors.New("export failed")}
+	i = newTestInstaller(t, artifactsDir, f, false)
+	_, err = i.Install(context.Background())
+	if err == nil {
+		t.Fatal("install didn't fail")
+	}
+	err = i.DeleteBootstrap(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, err := LoadCheckpoint(i.CheckpointFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cp.done(StepCleanup) {
+		t.Errorf("cleanup isn't done in the checkpoint: %v", cp.Done)
+	}
+
+	f = &fakes{selfManaged: true}
+	_, err = newTestInstaller(t, artifactsDir, f, true).Install(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := []string{"export.capi", "gitops.capisync", "repo.push: exporting CAPI YAML", "repo.protect"}
+	if strings.Join(f.calls, ",") != strings.Join(calls, ",") {
+		t.Errorf("got calls %v, want %v", f.calls, calls)
+	}
+
+	// Nothing is deleted if the install stopped before making the temporary control plane, like on stray artifacts
+	artifactsDir = t.TempDir()
+	f = &fakes{}
+	i = newTestInstaller(t, artifactsDir, f, false)
+	_, err = i.Install(context.Background())
+	if !errors.Is(err, ErrPrerequisites) {
+		t.Fatalf("got %v, want the prerequisites to fail", err)
+	}
+	err = i.DeleteBootstrap(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.calls) != 0 {
+		t.Errorf("deleted a temporary control plane that wasn't made: %v", f.calls)
+	}
+}
@@ -0,0 +1,48 @@
+package gokp
+
+import (
+	"context"
+
+	"github.com/christianh814/gokp/cmd/capi"
+)
+
+// CAPIProvider creates clusters with CAPI on an infrastructure provider, like capi.AWS
+type CAPIProvider struct {
+	// Infra is the infrastructure the cluster is created on
+	Infra capi.InfraProvider
+
+	// HA creates three control plane machines instead of one
+	HA bool
+}
+
+// Name returns the name of the infrastructure provider
+func (p *CAPIProvider) Name() string {
+	return p.Infra.Name()
+}
+
+// DisplayName returns the display name of the infrastructure provider
+func (p *CAPIProvider) DisplayName() string {
+	return p.Infra.DisplayName()
+}
+
+// Create creates the cluster on the infrastructure provider
+func (p *CAPIProvider) Create(ctx context.Context, c *Cluster) error {
+	_, err := capi.CreateCluster(ctx, p.Infra, c.BootstrapKubeconfig, c.Name, c.Kubeconfig, p.HA)
+
+	return err
+}
+
+// SelfManaged returns true if the infrastructure provider's clusters manage themselves
+func (p *CAPIProvider) SelfManaged() bool {
+	return p.Infra.SelfManaged()
+}
+
+// Move moves the CAPI objects into the cluster, if it manages itself
+func (p *CAPIProvider) Move(ctx context.Context, c *Cluster) error {
+	if !p.Infra.SelfManaged() {
+		return nil
+	}
+	_, err := capi.MoveMgmtCluster(ctx, p.Infra, c.BootstrapKubeconfig, c.Kubeconfig)
+
+	return err
+}